@@ -0,0 +1,54 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"unsafe"
+)
+
+// The provider of devices behind a Freenect context: libfreenect itself, or the simulator.
+// Frames are delivered by calling videoFrame and depthFrame on the owning Device from within process.
+type backend interface {
+	// Called once with the context the backend serves, before event processing starts.
+	attach(freenect *Freenect)
+	// Returns the serial numbers of the attached devices in index order; a serial may be empty if unknown.
+	devices() []string
+	// Opens a device by index, or by serial if the index is negative.
+	open(index int, serial string, owner *Device) (deviceBackend, int)
+	// Processes pending events, waiting briefly if there are none. Returns a negative value on failure.
+	process() int
+	setLogLevel(level LoggerLevel)
+	shutdown() int
+}
+
+// An open device of a backend.
+type deviceBackend interface {
+	close() int
+	setLED(option LEDOption) int
+	setFlag(flag Flag, on bool) int
+	// Reads the motor and accelerometer; only the angle, status and acceleration are filled in.
+	tiltState() (TiltState, int)
+	setTilt(deg float64) int
+	setVideoMode(res Resolution, format VideoFormat) (frameMode, int)
+	setDepthMode(res Resolution, format DepthFormat) (frameMode, int)
+	setVideoBuffer(buffer unsafe.Pointer) int
+	setDepthBuffer(buffer unsafe.Pointer) int
+	startVideo() int
+	stopVideo() int
+	startDepth() int
+	stopDepth() int
+}
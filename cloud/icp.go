@@ -0,0 +1,306 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"freenect"
+)
+
+// Errors returned by ICP and odometry.
+var (
+	ErrTooFewMatches			= errors.New("cloud: too few corresponding points")
+	ErrDegenerate					= errors.New("cloud: scene does not constrain the motion")
+	ErrUnsupportedFormat	= errors.New("cloud: unsupported depth format")
+)
+
+// The default settings of ICP.
+const (
+	DefaultICPIterations	= 20
+	DefaultMatchDistance	= 0.1
+	DefaultMatchAngle			= 30.0
+	DefaultICPTolerance		= 1e-6
+	DefaultICPStride			= 4
+)
+
+// Registers one organized point cloud against another by point-to-plane ICP. Each iteration moves every Stride-th
+// point of the source by the current estimate and projects it into the target's image to find its partner, a
+// projective association that suits consecutive frames of a moving sensor. Pairs farther apart than MatchDistance
+// meters, or whose normals differ by more than MatchAngle degrees, are rejected. The motion minimizing the distances
+// of the sources from the planes of their partners is then solved for, linearized about the estimate. Iteration
+// stops when an update moves less than Tolerance, in meters and radians, or after Iterations updates.
+//
+// Intrinsics describe the target's camera; they are scaled to its width.
+type ICP struct {
+	Iterations		int
+	MatchDistance	float64
+	MatchAngle		float64
+	Tolerance			float64
+	Stride				int
+	Intrinsics		freenect.Intrinsics
+}
+
+// Creates ICP with the default settings and the Kinect's typical intrinsics.
+func NewICP() *ICP {
+	return &ICP{
+		Iterations:		DefaultICPIterations,
+		MatchDistance:	DefaultMatchDistance,
+		MatchAngle:		DefaultMatchAngle,
+		Tolerance:		DefaultICPTolerance,
+		Stride:				DefaultICPStride,
+		Intrinsics:		freenect.DefaultIntrinsics,
+	}
+}
+
+// The outcome of a registration. Transform maps points of the source into the target's frame. Converged is set when
+// the last update fell below the tolerance within the allowed iterations. Matches counts the pairs used in the last
+// iteration and Error is their root mean square distance from the target's planes, in meters.
+type Registration struct {
+	Transform		freenect.Transform
+	Iterations	int
+	Converged		bool
+	Matches			int
+	Error				float64
+}
+
+// Registers the source cloud against the target, starting from the initial estimate of the transform from source to
+// target. The target needs normals; they are estimated if it has none. The source's normals, if it has them, are used
+// to reject pairs.
+func (icp *ICP) Align(source, target freenect.PointCloud, initial freenect.Transform) (Registration, error) {
+	if target.Normals == nil {
+		NewNormalEstimator(CROSS).Apply(&target)
+	}
+
+	intr := scaled(icp.Intrinsics, target.Width)
+	stride := max(icp.Stride, 1)
+	minCos := math.Cos(icp.MatchAngle * math.Pi / 180)
+
+	reg := Registration{Transform: initial}
+	for reg.Iterations < max(icp.Iterations, 1) {
+		reg.Iterations++
+		rotate := freenect.Transform{R: reg.Transform.R}
+
+		var ata [6][6]float64
+		var atb [6]float64
+		matches, sq := 0, 0.0
+		for y := 0; y < source.Height; y += stride {
+			for x := 0; x < source.Width; x += stride {
+				i := y*source.Width + x
+				p := source.Points[i]
+				if !p.Valid() {
+					continue
+				}
+				p = reg.Transform.Apply(p)
+				if p.Z <= 0 {
+					continue
+				}
+				u := int(math.Round(intr.Fx*p.X/p.Z + intr.Cx))
+				v := int(math.Round(intr.Cy - intr.Fy*p.Y/p.Z))
+				if u < 0 || u >= target.Width || v < 0 || v >= target.Height {
+					continue
+				}
+				j := v*target.Width + u
+				q, n := target.Points[j], target.Normals[j]
+				if !q.Valid() || !n.Valid() || p.Sub(q).Norm() > icp.MatchDistance {
+					continue
+				}
+				if source.Normals != nil {
+					if m := source.Normals[i]; m.Valid() && rotate.Apply(m).Dot(n) < minCos {
+						continue
+					}
+				}
+
+				// the residual and its derivative in the small rotation and translation applied after the estimate
+				r := n.Dot(p.Sub(q))
+				c := p.Cross(n)
+				row := [6]float64{c.X, c.Y, c.Z, n.X, n.Y, n.Z}
+				for a := 0; a < 6; a++ {
+					for b := 0; b < 6; b++ {
+						ata[a][b] += row[a] * row[b]
+					}
+					atb[a] -= row[a] * r
+				}
+				matches++
+				sq += r * r
+			}
+		}
+
+		reg.Matches = matches
+		if matches < 6 {
+			return reg, ErrTooFewMatches
+		}
+		reg.Error = math.Sqrt(sq / float64(matches))
+
+		step, ok := solve6(ata, atb)
+		if !ok {
+			return reg, ErrDegenerate
+		}
+		update := freenect.Transform{
+			R:	rotation(freenect.Vector{X: step[0], Y: step[1], Z: step[2]}),
+			T:	freenect.Vector{X: step[3], Y: step[4], Z: step[5]},
+		}
+		reg.Transform = update.Compose(reg.Transform)
+
+		size := 0.0
+		for _, s := range step {
+			size = math.Max(size, math.Abs(s))
+		}
+		if size < icp.Tolerance {
+			reg.Converged = true
+			break
+		}
+	}
+	return reg, nil
+}
+
+// Returns the intrinsics, given for a 640 pixel wide image, for an image of the width.
+func scaled(intr freenect.Intrinsics, width int) freenect.Intrinsics {
+	scale := float64(width) / 640
+	return freenect.Intrinsics{Fx: intr.Fx * scale, Fy: intr.Fy * scale, Cx: intr.Cx * scale, Cy: intr.Cy * scale}
+}
+
+// Returns the rotation by the vector's length in radians about its direction.
+func rotation(w freenect.Vector) [3][3]float64 {
+	angle := w.Norm()
+	if angle < 1e-15 {
+		return freenect.Identity.R
+	}
+	k := w.Scale(1 / angle)
+	s, c := math.Sincos(angle)
+	t := 1 - c
+	return [3][3]float64{
+		{c + k.X*k.X*t, k.X*k.Y*t - k.Z*s, k.X*k.Z*t + k.Y*s},
+		{k.Y*k.X*t + k.Z*s, c + k.Y*k.Y*t, k.Y*k.Z*t - k.X*s},
+		{k.Z*k.X*t - k.Y*s, k.Z*k.Y*t + k.X*s, c + k.Z*k.Z*t},
+	}
+}
+
+// Solves the 6x6 system by Gaussian elimination with partial pivoting. Reports false if it is close to singular: a
+// pivot under a thousandth of the largest diagonal term means some motion is barely constrained by the matches, and
+// the solution would be made up along it.
+func solve6(a [6][6]float64, b [6]float64) ([6]float64, bool) {
+	scale := 0.0
+	for i := 0; i < 6; i++ {
+		scale = math.Max(scale, math.Abs(a[i][i]))
+	}
+	for col := 0; col < 6; col++ {
+		pivot := col
+		for r := col + 1; r < 6; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) <= 1e-3*scale {
+			return b, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < 6; r++ {
+			f := a[r][col] / a[col][col]
+			for k := col; k < 6; k++ {
+				a[r][k] -= f * a[col][k]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	var x [6]float64
+	for r := 5; r >= 0; r-- {
+		sum := b[r]
+		for k := r + 1; k < 6; k++ {
+			sum -= a[r][k] * x[k]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, true
+}
+
+// Tracks the pose of a moving sensor by registering each depth frame against the one before. The pose maps the
+// current camera frame into the camera frame of the first frame. Each registration starts from the motion between
+// the previous two frames. All methods are safe for concurrent use.
+type Odometry struct {
+	ICP				*ICP
+	Normals		*NormalEstimator
+
+	lock			sync.Mutex
+	previous	*freenect.PointCloud
+	pose			freenect.Transform
+	motion		freenect.Transform
+}
+
+// Creates odometry with the default ICP settings, estimating normals by the CROSS method.
+func NewOdometry() *Odometry {
+	return &Odometry{ICP: NewICP(), Normals: NewNormalEstimator(CROSS), pose: freenect.Identity, motion: freenect.Identity}
+}
+
+// Returns the latest pose.
+func (o *Odometry) Pose() freenect.Transform {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.pose
+}
+
+// Forgets the frames seen so far; the next frame starts again at the identity pose.
+func (o *Odometry) Reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.previous = nil
+	o.pose, o.motion = freenect.Identity, freenect.Identity
+}
+
+// Registers a depth image of the given size and format against the previous one and returns the new pose with the
+// registration's diagnostics. The first frame only sets the reference. When registration fails the pose is left
+// as it was and the frame becomes the new reference, so tracking carries on from the next frame.
+func (o *Odometry) Update(depth []uint16, width, height int, format freenect.DepthFormat) (freenect.Transform, Registration, error) {
+	current := freenect.DepthToPoints(depth, width, height, scaled(o.ICP.Intrinsics, width), freenect.MetersConverter(format))
+	if current.Points == nil {
+		return o.Pose(), Registration{}, ErrUnsupportedFormat
+	}
+	o.Normals.Apply(&current)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	previous := o.previous
+	o.previous = &current
+	if previous == nil {
+		return o.pose, Registration{Transform: freenect.Identity, Converged: true}, nil
+	}
+
+	reg, err := o.ICP.Align(current, *previous, o.motion)
+	if err != nil {
+		o.motion = freenect.Identity
+		return o.pose, reg, err
+	}
+	o.motion = reg.Transform
+	o.pose = o.pose.Compose(reg.Transform)
+	return o.pose, reg, nil
+}
+
+// Wraps a handler of poses as a depth sink, for tracking straight from a DepthCamera. The size and format must be
+// those the camera was created with. Registration takes tens of milliseconds; to keep it off the event loop, feed
+// Update from a pipeline stage instead.
+func (o *Odometry) Sink(next func(pose freenect.Transform, reg Registration, err error), width, height int, format freenect.DepthFormat) freenect.DepthSink {
+	return func(buffer []uint16, stamp int32) {
+		pose, reg, err := o.Update(buffer, width, height, format)
+		if next != nil {
+			next(pose, reg, err)
+		}
+	}
+}
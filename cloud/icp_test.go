@@ -0,0 +1,143 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud_test
+
+import (
+	"math"
+	"testing"
+
+	"freenect"
+	"freenect/cloud"
+)
+
+// The corner of a room: a floor, a back wall and a side wall.
+var corner = []cloud.Plane{
+	{Normal: freenect.Vector{X: 0, Y: 1, Z: 0}, D: 0.8},
+	{Normal: freenect.Vector{X: 0, Y: 0, Z: -1}, D: 3},
+	{Normal: freenect.Vector{X: 1, Y: 0, Z: 0}, D: 1.2},
+}
+
+// Renders the depth, in millimeters, of the room corner seen from the pose at the given size.
+func render(pose freenect.Transform, width, height int) []uint16 {
+	scale := float64(width) / 640
+	intr := freenect.Intrinsics{Fx: freenect.DefaultIntrinsics.Fx * scale, Fy: freenect.DefaultIntrinsics.Fy * scale, Cx: freenect.DefaultIntrinsics.Cx * scale, Cy: freenect.DefaultIntrinsics.Cy * scale}
+	eye := pose.Apply(freenect.Vector{})
+	rotate := freenect.Transform{R: pose.R}
+
+	depth := make([]uint16, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// scaled so the ray's camera Z is 1, making the distance along it the depth
+			ray := rotate.Apply(freenect.Vector{X: (float64(x) - intr.Cx) / intr.Fx, Y: -(float64(y) - intr.Cy) / intr.Fy, Z: 1})
+			z := math.Inf(1)
+			for _, plane := range corner {
+				if d := plane.Normal.Dot(ray); d < 0 {
+					if t := -plane.Distance(eye) / d; t > 0 {
+						z = math.Min(z, t)
+					}
+				}
+			}
+			if !math.IsInf(z, 1) {
+				depth[y*width+x] = uint16(math.Round(z * 1000))
+			}
+		}
+	}
+	return depth
+}
+
+// Returns the sensor pose after turning by the given degrees about Y and moving by the offset.
+func moved(degrees float64, offset freenect.Vector) freenect.Transform {
+	s, c := math.Sincos(degrees * math.Pi / 180)
+	return freenect.Transform{R: [3][3]float64{{c, 0, s}, {0, 1, 0}, {-s, 0, c}}, T: offset}
+}
+
+func near(a, b freenect.Transform, meters, radians float64) bool {
+	if a.T.Sub(b.T).Norm() > meters {
+		return false
+	}
+	// the angle of the rotation between them, from its trace
+	d := a.Inverse().Compose(b)
+	trace := d.R[0][0] + d.R[1][1] + d.R[2][2]
+	return math.Acos(math.Max(-1, math.Min(1, (trace-1)/2))) <= radians
+}
+
+func points(depth []uint16) freenect.PointCloud {
+	return freenect.DepthToPoints(depth, 640, 480, freenect.DefaultIntrinsics, freenect.MillimetersToMeters)
+}
+
+func TestAlign(t *testing.T) {
+	target := points(render(freenect.Identity, 640, 480))
+	pose := moved(3, freenect.Vector{X: 0.04, Y: -0.02, Z: 0.05})
+	source := points(render(pose, 640, 480))
+
+	reg, err := cloud.NewICP().Align(source, target, freenect.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reg.Converged || reg.Matches < 1000 || reg.Error > 0.005 {
+		t.Errorf("expected a close fit, got %+v", reg)
+	}
+	if !near(reg.Transform, pose, 0.005, 0.2*math.Pi/180) {
+		t.Errorf("expected the sensor's motion %+v, got %+v", pose, reg.Transform)
+	}
+
+	// a single wall leaves the motion along it unknown
+	wall := make([]uint16, 640*480)
+	for i := range wall {
+		wall[i] = 2000
+	}
+	if _, err = cloud.NewICP().Align(points(wall), points(wall), freenect.Identity); err != cloud.ErrDegenerate {
+		t.Errorf("expected a degenerate scene, got %v", err)
+	}
+
+	// nothing in common
+	if _, err = cloud.NewICP().Align(source, points(make([]uint16, 640*480)), freenect.Identity); err != cloud.ErrTooFewMatches {
+		t.Errorf("expected too few matches, got %v", err)
+	}
+}
+
+func TestOdometry(t *testing.T) {
+	odometry := cloud.NewOdometry()
+
+	// the sensor pans and steps sideways over a few frames, at full and at half resolution
+	var pose freenect.Transform
+	for _, size := range [][2]int{{640, 480}, {320, 240}} {
+		odometry.Reset()
+		for i := 0; i <= 5; i++ {
+			truth := moved(0.5*float64(i), freenect.Vector{X: 0.01 * float64(i), Z: 0.005 * float64(i)})
+			var err error
+			pose, _, err = odometry.Update(render(truth, size[0], size[1]), size[0], size[1], freenect.MM)
+			if err != nil {
+				t.Fatalf("%dx%d frame %d: %v", size[0], size[1], i, err)
+			}
+			if !near(pose, truth, 0.01, 0.5*math.Pi/180) {
+				t.Fatalf("%dx%d frame %d: expected %+v, got %+v", size[0], size[1], i, truth, pose)
+			}
+		}
+	}
+	if odometry.Pose() != pose {
+		t.Errorf("expected Pose to report the latest pose")
+	}
+
+	odometry.Reset()
+	if pose, _, _ = odometry.Update(render(freenect.Identity, 640, 480), 640, 480, freenect.MM); pose != freenect.Identity {
+		t.Errorf("expected a reset to start over, got %+v", pose)
+	}
+	if _, _, err := odometry.Update(nil, 640, 480, freenect.MM); err != cloud.ErrUnsupportedFormat {
+		t.Errorf("expected a short frame to be refused, got %v", err)
+	}
+}
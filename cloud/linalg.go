@@ -0,0 +1,112 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud
+
+import (
+	"math"
+
+	"freenect"
+)
+
+// Accumulates the mean and scatter of a set of points.
+type moments struct {
+	n			float64
+	sum		freenect.Vector
+	outer	[3][3]float64
+}
+
+func (m *moments) add(p freenect.Vector) {
+	m.n++
+	m.sum = m.sum.Add(p)
+	v := [3]float64{p.X, p.Y, p.Z}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m.outer[i][j] += v[i] * v[j]
+		}
+	}
+}
+
+func (m *moments) mean() freenect.Vector {
+	return m.sum.Scale(1 / m.n)
+}
+
+// Returns the covariance of the points.
+func (m *moments) covariance() [3][3]float64 {
+	c := m.mean()
+	mu := [3]float64{c.X, c.Y, c.Z}
+	var cov [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			cov[i][j] = m.outer[i][j]/m.n - mu[i]*mu[j]
+		}
+	}
+	return cov
+}
+
+// Returns the unit normal of the plane best fitting the points, the direction in which they spread least, and the
+// fraction of their spread along it: 0 for points lying exactly in a plane, 1/3 for a ball.
+func (m *moments) normal() (freenect.Vector, float64) {
+	values, vectors := eigenSymmetric(m.covariance())
+	smallest := 0
+	for i := 1; i < 3; i++ {
+		if values[i] < values[smallest] {
+			smallest = i
+		}
+	}
+	total := values[0] + values[1] + values[2]
+	curvature := 0.0
+	if total > 0 {
+		curvature = values[smallest] / total
+	}
+	return freenect.Vector{X: vectors[0][smallest], Y: vectors[1][smallest], Z: vectors[2][smallest]}, curvature
+}
+
+// Computes the eigenvalues and eigenvectors, the columns of the second result, of a symmetric 3x3 matrix by Jacobi
+// rotations.
+func eigenSymmetric(a [3][3]float64) ([3]float64, [3][3]float64) {
+	v := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	for sweep := 0; sweep < 50; sweep++ {
+		off := a[0][1]*a[0][1] + a[0][2]*a[0][2] + a[1][2]*a[1][2]
+		if off < 1e-30 {
+			break
+		}
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p], v[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+	return [3]float64{a[0][0], a[1][1], a[2][2]}, v
+}
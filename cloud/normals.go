@@ -0,0 +1,208 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud
+
+import (
+	"image"
+	"math"
+
+	"freenect"
+)
+
+// How normals are estimated from the organized grid of a cloud.
+type NormalMethod int
+
+const (
+	// The cross product of the differences between the neighbors Radius pixels away on either side, horizontally
+	// and vertically. Fast and sharp, but noisy.
+	CROSS				NormalMethod = iota
+	// The direction of least spread of the points in a square window of Radius pixels around each point, computed
+	// in constant time per point from integral images. Smoother, at the cost of rounding off edges.
+	INTEGRAL
+)
+
+// The default settings of a normal estimator.
+const (
+	DefaultNormalRadius	= 2
+	DefaultMaxJump			= 0.05
+)
+
+// Estimates the surface normal at every point of an organized cloud. Neighbors whose depth differs from the point's
+// by more than MaxJump, as a fraction of its depth, lie across an edge and are not used by the CROSS method; the
+// INTEGRAL method uses every valid point of its window. Normals point towards the sensor.
+type NormalEstimator struct {
+	Method		NormalMethod
+	Radius		int
+	MaxJump		float64
+}
+
+// Creates an estimator using the method with the default settings.
+func NewNormalEstimator(method NormalMethod) *NormalEstimator {
+	return &NormalEstimator{Method: method, Radius: DefaultNormalRadius, MaxJump: DefaultMaxJump}
+}
+
+// Returns the normal at every point of the cloud, NaN where there is no point or too few neighbors to tell.
+func (e *NormalEstimator) Estimate(cloud freenect.PointCloud) []freenect.Vector {
+	normals := make([]freenect.Vector, len(cloud.Points))
+	nan := freenect.Vector{X: math.NaN(), Y: math.NaN(), Z: math.NaN()}
+	for i := range normals {
+		normals[i] = nan
+	}
+	if len(cloud.Points) < cloud.Width*cloud.Height {
+		return normals
+	}
+
+	if e.Method == INTEGRAL {
+		e.integral(cloud, normals)
+	} else {
+		e.cross(cloud, normals)
+	}
+	return normals
+}
+
+// Estimates the normals of the cloud and stores them in its Normals.
+func (e *NormalEstimator) Apply(cloud *freenect.PointCloud) {
+	cloud.Normals = e.Estimate(*cloud)
+}
+
+func (e *NormalEstimator) cross(cloud freenect.PointCloud, normals []freenect.Vector) {
+	w, h, r := cloud.Width, cloud.Height, max(e.Radius, 1)
+	at := func(x, y int, p freenect.Vector) (freenect.Vector, bool) {
+		if x < 0 || x >= w || y < 0 || y >= h {
+			return freenect.Vector{}, false
+		}
+		q := cloud.Points[y*w+x]
+		if !q.Valid() || (e.MaxJump > 0 && math.Abs(q.Z-p.Z) > e.MaxJump*p.Z) {
+			return freenect.Vector{}, false
+		}
+		return q, true
+	}
+	// the difference across the point, from one side alone if the other is missing
+	span := func(p, a, b freenect.Vector, okA, okB bool) (freenect.Vector, bool) {
+		switch {
+		case okA && okB:
+			return b.Sub(a), true
+		case okB:
+			return b.Sub(p), true
+		case okA:
+			return p.Sub(a), true
+		}
+		return freenect.Vector{}, false
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := cloud.Points[y*w+x]
+			if !p.Valid() {
+				continue
+			}
+			left, okL := at(x-r, y, p)
+			right, okR := at(x+r, y, p)
+			up, okU := at(x, y-r, p)
+			down, okD := at(x, y+r, p)
+			dx, okX := span(p, left, right, okL, okR)
+			dy, okY := span(p, up, down, okU, okD)
+			if !okX || !okY {
+				continue
+			}
+			if n, ok := facing(dx.Cross(dy), p); ok {
+				normals[y*w+x] = n
+			}
+		}
+	}
+}
+
+func (e *NormalEstimator) integral(cloud freenect.PointCloud, normals []freenect.Vector) {
+	w, h, r := cloud.Width, cloud.Height, max(e.Radius, 1)
+
+	// summed area tables of the count, coordinates and products of the valid points, one row and column larger than
+	// the cloud so the sums start at zero
+	const fields = 10
+	stride := w + 1
+	table := make([][fields]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var row [fields]float64
+		for x := 0; x < w; x++ {
+			if p := cloud.Points[y*w+x]; p.Valid() {
+				v := [fields]float64{1, p.X, p.Y, p.Z, p.X * p.X, p.X * p.Y, p.X * p.Z, p.Y * p.Y, p.Y * p.Z, p.Z * p.Z}
+				for k := range row {
+					row[k] += v[k]
+				}
+			}
+			above := table[y*stride+x+1]
+			cell := &table[(y+1)*stride+x+1]
+			for k := range row {
+				cell[k] = above[k] + row[k]
+			}
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := cloud.Points[y*w+x]
+			if !p.Valid() {
+				continue
+			}
+			x0, y0, x1, y1 := max(x-r, 0), max(y-r, 0), min(x+r+1, w), min(y+r+1, h)
+			var s [fields]float64
+			for k := range s {
+				s[k] = table[y1*stride+x1][k] - table[y0*stride+x1][k] - table[y1*stride+x0][k] + table[y0*stride+x0][k]
+			}
+			if s[0] < 3 {
+				continue
+			}
+			m := moments{
+				n:		s[0],
+				sum:	freenect.Vector{X: s[1], Y: s[2], Z: s[3]},
+				outer:	[3][3]float64{{s[4], s[5], s[6]}, {s[5], s[7], s[8]}, {s[6], s[8], s[9]}},
+			}
+			normal, _ := m.normal()
+			if n, ok := facing(normal, p); ok {
+				normals[y*w+x] = n
+			}
+		}
+	}
+}
+
+// Returns the normal scaled to unit length and turned to face the sensor, at the origin, from the point.
+func facing(n, p freenect.Vector) (freenect.Vector, bool) {
+	if n.Norm() < 1e-12 {
+		return freenect.Vector{}, false
+	}
+	n = n.Unit()
+	if n.Dot(p) > 0 {
+		n = n.Scale(-1)
+	}
+	return n, true
+}
+
+// Draws normals as an image, mapping each component from -1..1 to 0..255 as red, green and blue. Points without a
+// normal are transparent.
+func NormalMap(normals []freenect.Vector, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	channel := func(v float64) uint8 {
+		return uint8(math.Round((math.Max(-1, math.Min(1, v)) + 1) * 127.5))
+	}
+	for i := 0; i < width*height && i < len(normals); i++ {
+		n := normals[i]
+		if !n.Valid() {
+			continue
+		}
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = channel(n.X), channel(n.Y), channel(n.Z), 0xff
+	}
+	return img
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud_test
+
+import (
+	"math"
+	"testing"
+
+	"freenect"
+	"freenect/cloud"
+)
+
+func TestNormals(t *testing.T) {
+	// level sensor: the floor faces up, the wall faces the sensor
+	depth := room(0.5, 0, 3.0)
+	points := freenect.DepthToPoints(depth, 640, 480, freenect.DefaultIntrinsics, freenect.MillimetersToMeters)
+	floor, wall := 470*640+320, 100*640+320
+
+	for _, method := range []cloud.NormalMethod{cloud.CROSS, cloud.INTEGRAL} {
+		c := points
+		cloud.NewNormalEstimator(method).Apply(&c)
+		if len(c.Normals) != len(c.Points) {
+			t.Fatalf("method %d: expected a normal per point", method)
+		}
+		if n := c.Normals[floor]; n.Y < 0.99 {
+			t.Errorf("method %d: expected the floor to face up, got %v", method, n)
+		}
+		if n := c.Normals[wall]; n.Z > -0.99 {
+			t.Errorf("method %d: expected the wall to face the sensor, got %v", method, n)
+		}
+
+		// normals turn with the cloud
+		turned := c.Transform(freenect.WorldTransform(freenect.Vector{X: 1, Y: 1, Z: 0}, 0))
+		if n := turned.Normals[floor]; math.Abs(n.Norm()-1) > 1e-9 || n.Y > 0.8 {
+			t.Errorf("method %d: expected the floor normal to turn, got %v", method, n)
+		}
+	}
+
+	// no points, no normals
+	empty := freenect.DepthToPoints(make([]uint16, 4), 2, 2, freenect.DefaultIntrinsics, freenect.MillimetersToMeters)
+	for _, n := range cloud.NewNormalEstimator(cloud.CROSS).Estimate(empty) {
+		if n.Valid() {
+			t.Errorf("expected no normal, got %v", n)
+		}
+	}
+}
+
+func TestNormalMap(t *testing.T) {
+	nan := math.NaN()
+	normals := []freenect.Vector{{X: 0, Y: 1, Z: 0}, {X: 0, Y: 0, Z: -1}, {X: nan, Y: nan, Z: nan}}
+	img := cloud.NormalMap(normals, 3, 1)
+
+	if c := img.RGBAAt(0, 0); c.R != 128 || c.G != 255 || c.B != 128 || c.A != 255 {
+		t.Errorf("expected an up normal green, got %v", c)
+	}
+	if c := img.RGBAAt(1, 0); c.B != 0 {
+		t.Errorf("expected a normal facing the sensor without blue, got %v", c)
+	}
+	if c := img.RGBAAt(2, 0); c.A != 0 {
+		t.Errorf("expected a missing normal transparent, got %v", c)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cloud works with the geometry of freenect point clouds: the floor, surface normals and how the sensor moved
+// between frames.
+package cloud
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+
+	"freenect"
+)
+
+// A plane: the points p for which Normal·p + D = 0. Normal has unit length.
+type Plane struct {
+	Normal	freenect.Vector
+	D				float64
+}
+
+// Returns the signed distance of the point from the plane, positive on the side the normal points to.
+func (plane Plane) Distance(p freenect.Vector) float64 {
+	return plane.Normal.Dot(p) + plane.D
+}
+
+// Returned when a cloud holds no plane meeting the requirements.
+var ErrNoPlane = errors.New("cloud: no plane found")
+
+// The default settings of a plane fit.
+const (
+	DefaultIterations		= 200
+	DefaultThreshold		= 0.02
+	DefaultStride				= 4
+	DefaultMaxAngle			= 15.0
+	DefaultMinInliers		= 0.1
+)
+
+// Finds the dominant plane of a point cloud by RANSAC: it repeatedly fits a plane through three random points and
+// keeps the one with the most points within Threshold meters, then refines it by least squares over those points.
+// To keep it quick, only every Stride-th point of every Stride-th row is sampled and scored.
+//
+// Set Up to the accelerometer's gravity vector (Tilt.Gravity) to look for the floor: only planes within MaxAngle
+// degrees of level are considered, so walls are passed over however large. A plane is accepted when at least
+// MinInliers of the sampled points lie on it. Seed makes the random sampling repeatable.
+type PlaneFit struct {
+	Iterations	int
+	Threshold		float64
+	Stride			int
+	Up					freenect.Vector
+	MaxAngle		float64
+	MinInliers	float64
+	Seed				uint64
+}
+
+// Creates a plane fit with the default settings.
+func NewPlaneFit() *PlaneFit {
+	return &PlaneFit{
+		Iterations:	DefaultIterations,
+		Threshold:	DefaultThreshold,
+		Stride:			DefaultStride,
+		MaxAngle:		DefaultMaxAngle,
+		MinInliers:	DefaultMinInliers,
+	}
+}
+
+// A plane found in a cloud and the sensor's pose relative to it. The plane's normal points towards the sensor.
+// Inliers marks the points of the cloud lying on the plane. Height is the distance of the sensor from the plane and
+// Orientation the sensor's pitch and roll relative to it, as if the plane were level.
+type Floor struct {
+	Plane				Plane
+	Inliers			[]bool
+	Count				int
+	Height			float64
+	Orientation	freenect.Orientation
+}
+
+// Returns the transform from the camera frame into a frame standing on the plane: Y up along the plane's normal,
+// the origin on the plane below the sensor, so a point's Y is its height above the floor. See freenect.WorldTransform.
+func (floor Floor) Transform() freenect.Transform {
+	return freenect.WorldTransform(floor.Plane.Normal, floor.Height)
+}
+
+// Fits the dominant plane of a cloud.
+func (fit *PlaneFit) Fit(cloud freenect.PointCloud) (Floor, error) {
+	stride := max(fit.Stride, 1)
+	var samples []freenect.Vector
+	for y := 0; y < cloud.Height; y += stride {
+		for x := 0; x < cloud.Width; x += stride {
+			if p := cloud.Points[y*cloud.Width+x]; p.Valid() {
+				samples = append(samples, p)
+			}
+		}
+	}
+	if len(samples) < 3 {
+		return Floor{}, ErrNoPlane
+	}
+
+	up := fit.Up.Unit()
+	minCos := math.Cos(fit.MaxAngle * math.Pi / 180)
+	rng := rand.New(rand.NewPCG(fit.Seed, fit.Seed))
+
+	var best Plane
+	bestCount := 0
+	for i := 0; i < max(fit.Iterations, 1); i++ {
+		a, b, c := samples[rng.IntN(len(samples))], samples[rng.IntN(len(samples))], samples[rng.IntN(len(samples))]
+		plane, ok := through(a, b, c)
+		if !ok || (up != (freenect.Vector{}) && plane.Normal.Dot(up) < minCos) {
+			continue
+		}
+		count := 0
+		for _, p := range samples {
+			if math.Abs(plane.Distance(p)) <= fit.Threshold {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = plane, count
+		}
+	}
+	if bestCount == 0 || float64(bestCount) < fit.MinInliers*float64(len(samples)) {
+		return Floor{}, ErrNoPlane
+	}
+
+	// refine by least squares over every inlier of the cloud, then take the inliers of the refined plane
+	var m moments
+	for _, p := range cloud.Points {
+		if p.Valid() && math.Abs(best.Distance(p)) <= fit.Threshold {
+			m.add(p)
+		}
+	}
+	if m.n >= 3 {
+		normal, _ := m.normal()
+		if normal.Dot(best.Normal) < 0 {
+			normal = normal.Scale(-1)
+		}
+		best = Plane{normal, -normal.Dot(m.mean())}
+	}
+
+	floor := Floor{Plane: best, Inliers: make([]bool, len(cloud.Points))}
+	for i, p := range cloud.Points {
+		if p.Valid() && math.Abs(best.Distance(p)) <= fit.Threshold {
+			floor.Inliers[i] = true
+			floor.Count++
+		}
+	}
+	floor.Height = best.D
+	floor.Orientation = best.Normal.Orientation()
+	return floor, nil
+}
+
+// Fits the dominant plane of a depth image of the given size and format, projected with the intrinsics.
+func (fit *PlaneFit) FitDepth(depth []uint16, width, height int, format freenect.DepthFormat, intr freenect.Intrinsics) (Floor, error) {
+	points := freenect.DepthToPoints(depth, width, height, intr, freenect.MetersConverter(format))
+	if points.Points == nil {
+		return Floor{}, ErrNoPlane
+	}
+	return fit.Fit(points)
+}
+
+// Returns the plane through three points, its normal facing the origin where the sensor is.
+func through(a, b, c freenect.Vector) (Plane, bool) {
+	n := b.Sub(a).Cross(c.Sub(a))
+	if n.Norm() < 1e-9 {
+		return Plane{}, false
+	}
+	n = n.Unit()
+	if n.Dot(a) > 0 {
+		n = n.Scale(-1)
+	}
+	return Plane{n, -n.Dot(a)}, true
+}
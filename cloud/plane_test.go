@@ -0,0 +1,99 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cloud_test
+
+import (
+	"math"
+	"testing"
+
+	"freenect"
+	"freenect/cloud"
+)
+
+// Renders the depth, in millimeters, seen by a sensor height meters above a floor and pitched by the given degrees,
+// facing a wall at the given distance.
+func room(height, pitch, wall float64) []uint16 {
+	intr := freenect.DefaultIntrinsics
+	s, c := math.Sincos(pitch * math.Pi / 180)
+	up := freenect.Vector{X: 0, Y: c, Z: s}
+	// the wall faces the sensor, which is pitched relative to it too
+	back := freenect.Vector{X: 0, Y: -s, Z: c}
+
+	depth := make([]uint16, 640*480)
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			ray := freenect.Vector{X: (float64(x) - intr.Cx) / intr.Fx, Y: -(float64(y) - intr.Cy) / intr.Fy, Z: 1}
+			z := math.Inf(1)
+			if d := ray.Dot(up); d < 0 {
+				z = -height / d
+			}
+			if d := ray.Dot(back); d > 0 {
+				z = math.Min(z, wall/d)
+			}
+			if !math.IsInf(z, 1) {
+				depth[y*640+x] = uint16(math.Round(z * 1000))
+			}
+		}
+	}
+	return depth
+}
+
+func TestFloor(t *testing.T) {
+	depth := room(1.2, -20, 2.5)
+	fit := cloud.NewPlaneFit()
+
+	// unguided, the wall is the larger plane
+	floor, err := fit.FitDepth(depth, 640, 480, freenect.MM, freenect.DefaultIntrinsics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(floor.Plane.Normal.Z) < 0.9 {
+		t.Errorf("expected the wall, got %+v", floor.Plane)
+	}
+
+	// seeded with a slightly off gravity reading, the floor
+	fit.Up = freenect.Vector{X: 0.3, Y: 9.2, Z: -3.5}
+	floor, err = fit.FitDepth(depth, 640, 480, freenect.MM, freenect.DefaultIntrinsics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(floor.Height-1.2) > 0.01 {
+		t.Errorf("expected a height of 1.2m, got %f", floor.Height)
+	}
+	if math.Abs(floor.Orientation.Pitch+20) > 0.5 || math.Abs(floor.Orientation.Roll) > 0.5 {
+		t.Errorf("expected a pitch of -20 degrees, got %+v", floor.Orientation)
+	}
+	if floor.Count < 640*100 || !floor.Inliers[479*640+320] || floor.Inliers[0] {
+		t.Errorf("expected the bottom of the image on the floor and the top not, %d inliers", floor.Count)
+	}
+
+	// in the floor's frame the floor is at height zero and the sensor 1.2m above it
+	points := freenect.DepthToPoints(depth, 640, 480, freenect.DefaultIntrinsics, freenect.MillimetersToMeters)
+	transform := floor.Transform()
+	if p := transform.Apply(points.Points[479*640+320]); math.Abs(p.Y) > 0.01 {
+		t.Errorf("expected a floor point at height 0, got %f", p.Y)
+	}
+	if p := transform.Apply(freenect.Vector{}); math.Abs(p.Y-1.2) > 0.01 {
+		t.Errorf("expected the sensor at 1.2m, got %f", p.Y)
+	}
+
+	// a sensor looking straight at the wall sees no floor
+	fit.MaxAngle = 5
+	if _, err = fit.FitDepth(room(1.2, 0, 0.5), 640, 480, freenect.MM, freenect.DefaultIntrinsics); err != cloud.ErrNoPlane {
+		t.Errorf("expected no floor, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package colormap renders freenect depth frames as color images, so every tool shows depth the same way.
+package colormap
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"freenect"
+)
+
+// Type definition for a color ramp. It maps a depth normalized to 0 (near) .. 1 (far) to a color.
+type Map func(t float64) color.RGBA
+
+// The default depth range in meters, roughly the working range of the sensor.
+const (
+	DefaultNear		= 0.4
+	DefaultFar		= 4.5
+)
+
+// Returned for frames that are not depth frames or whose format carries no depth, for depth buffers holding fewer
+// values than their width and height call for, and for a width or height that is not positive.
+var (
+	ErrUnsupportedFormat	= errors.New("colormap: unsupported depth format")
+	ErrShortFrame					= errors.New("colormap: frame shorter than its size")
+	ErrBadSize						= errors.New("colormap: frame size not positive")
+)
+
+// The ramp of libfreenect's glview sample: white up close through red, yellow, green and cyan to blue, fading to black
+// at the far end.
+func Glview(t float64) color.RGBA {
+	pval := int(clamp(t) * (6*256 - 1))
+	lb := uint8(pval & 0xff)
+	switch pval >> 8 {
+	case 0:
+		return color.RGBA{255, 255 - lb, 255 - lb, 255}
+	case 1:
+		return color.RGBA{255, lb, 0, 255}
+	case 2:
+		return color.RGBA{255 - lb, 255, 0, 255}
+	case 3:
+		return color.RGBA{0, 255, lb, 255}
+	case 4:
+		return color.RGBA{0, 255 - lb, 255, 255}
+	default:
+		return color.RGBA{0, 0, 255 - lb, 255}
+	}
+}
+
+// The classic MATLAB ramp, from dark red up close through yellow and cyan to dark blue.
+func Jet(t float64) color.RGBA {
+	t = 1 - clamp(t)
+	return color.RGBA{
+		channel(1.5 - math.Abs(4*t-3)),
+		channel(1.5 - math.Abs(4*t-2)),
+		channel(1.5 - math.Abs(4*t-1)),
+		255,
+	}
+}
+
+// Google's Turbo ramp, a perceptually smoother Jet, from red up close to dark blue. Uses the published polynomial fit.
+func Turbo(t float64) color.RGBA {
+	t = 1 - clamp(t)
+	r := 0.13572138 + t*(4.61539260+t*(-42.66032258+t*(132.13108234+t*(-152.94239396+t*59.28637943))))
+	g := 0.09140261 + t*(2.19418839+t*(4.84296658+t*(-14.18503333+t*(4.27729857+t*2.82956604))))
+	b := 0.10667330 + t*(12.64194608+t*(-60.58204836+t*(110.36276771+t*(-89.90310912+t*27.34824973))))
+	return color.RGBA{channel(r), channel(g), channel(b), 255}
+}
+
+// Grayscale, white up close fading to black.
+func Gray(t float64) color.RGBA {
+	v := channel(1 - clamp(t))
+	return color.RGBA{v, v, v, 255}
+}
+
+// The built in maps by name, for picking one from a flag or a URL.
+var Maps = map[string]Map{
+	"glview":		Glview,
+	"jet":			Jet,
+	"turbo":		Turbo,
+	"gray":			Gray,
+}
+
+func clamp(t float64) float64 {
+	return math.Max(0, math.Min(1, t))
+}
+
+func channel(v float64) uint8 {
+	return uint8(math.Round(255 * clamp(v)))
+}
+
+// Renders depth with a color map. Depths are normalized linearly between Near and Far, in meters, and clamped to that
+// range; pixels without a reading are painted Invalid. With Equalize set the depths are histogram equalized instead,
+// spreading the colors evenly over whatever range the scene occupies.
+type Renderer struct {
+	Map				Map
+	Near			float64
+	Far				float64
+	Invalid		color.RGBA
+	Equalize	bool
+}
+
+// Creates a renderer for the map with the default range and opaque black for invalid pixels.
+func New(m Map) *Renderer {
+	return &Renderer{Map: m, Near: DefaultNear, Far: DefaultFar, Invalid: color.RGBA{0, 0, 0, 255}}
+}
+
+// Returns the depth in meters of each value in the given format, NaN where there is no reading.
+func Meters(depth []uint16, format freenect.DepthFormat) ([]float64, error) {
+	convert := freenect.MetersConverter(format)
+	if convert == nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	meters := make([]float64, len(depth))
+	for i, v := range depth {
+		meters[i] = convert(v)
+	}
+	return meters, nil
+}
+
+// Renders a depth image of the given size and format.
+func (r *Renderer) Render(depth []uint16, width, height int, format freenect.DepthFormat) (*image.RGBA, error) {
+	if width <= 0 || height <= 0 {
+		return nil, ErrBadSize
+	}
+	if len(depth) < width*height {
+		return nil, ErrShortFrame
+	}
+	meters, err := Meters(depth[:width*height], format)
+	if err != nil {
+		return nil, err
+	}
+	return r.RenderMeters(meters, width, height), nil
+}
+
+// Renders a depth frame, such as one received from a camera subscription.
+func (r *Renderer) RenderFrame(frame *freenect.Frame) (*image.RGBA, error) {
+	if frame.Stream != "depth" {
+		return nil, ErrUnsupportedFormat
+	}
+	return r.Render(frame.Depth, frame.Width, frame.Height, frame.DepthFormat())
+}
+
+// Renders depths already in meters, with NaN marking pixels without a reading.
+func (r *Renderer) RenderMeters(meters []float64, width, height int) *image.RGBA {
+	m := r.Map
+	if m == nil {
+		m = Glview
+	}
+
+	normalize := r.linear()
+	if r.Equalize {
+		normalize = equalizer(meters)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height && i < len(meters); i++ {
+		c := r.Invalid
+		if !math.IsNaN(meters[i]) {
+			c = m(normalize(meters[i]))
+		}
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func (r *Renderer) linear() func(m float64) float64 {
+	near, far := r.Near, r.Far
+	if far <= near {
+		near, far = DefaultNear, DefaultFar
+	}
+	return func(m float64) float64 {
+		return (m - near) / (far - near)
+	}
+}
+
+// Histogram equalization works at millimeter resolution up to this depth.
+const histogramBins = 10000
+
+// Returns a function mapping a depth to the fraction of the frame's valid depths that are nearer.
+func equalizer(meters []float64) func(m float64) float64 {
+	cdf := make([]float64, histogramBins+1)
+	total := 0.0
+	for _, m := range meters {
+		if !math.IsNaN(m) {
+			cdf[bin(m)]++
+			total++
+		}
+	}
+	for i := 1; i < len(cdf); i++ {
+		cdf[i] += cdf[i-1]
+	}
+
+	return func(m float64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return cdf[bin(m)] / total
+	}
+}
+
+func bin(m float64) int {
+	return int(math.Max(0, math.Min(histogramBins, m*1000)))
+}
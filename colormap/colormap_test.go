@@ -0,0 +1,101 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package colormap_test
+
+import (
+	"image/color"
+	"testing"
+
+	"freenect"
+	"freenect/colormap"
+)
+
+func TestMaps(t *testing.T) {
+	ends := []struct {
+		name			string
+		near, far	color.RGBA
+	}{
+		{"glview", color.RGBA{255, 255, 255, 255}, color.RGBA{0, 0, 0, 255}},
+		{"jet", color.RGBA{128, 0, 0, 255}, color.RGBA{0, 0, 128, 255}},
+		{"gray", color.RGBA{255, 255, 255, 255}, color.RGBA{0, 0, 0, 255}},
+	}
+	for _, e := range ends {
+		m := colormap.Maps[e.name]
+		if c := m(0); c != e.near {
+			t.Errorf("%s: expected %v up close, got %v", e.name, e.near, c)
+		}
+		if c := m(1); c != e.far {
+			t.Errorf("%s: expected %v far away, got %v", e.name, e.far, c)
+		}
+		// out of range values are clamped
+		if m(-1) != m(0) || m(2) != m(1) {
+			t.Errorf("%s: expected clamping", e.name)
+		}
+	}
+
+	if c := colormap.Turbo(0); c.R < 100 || c.B > 50 {
+		t.Errorf("expected turbo red up close, got %v", c)
+	}
+}
+
+func TestRender(t *testing.T) {
+	r := colormap.New(colormap.Gray)
+	r.Near, r.Far = 1, 3
+	r.Invalid = color.RGBA{255, 0, 255, 255}
+
+	depth := []uint16{1000, 2000, 3000, 0}
+	img, err := r.Render(depth, 2, 2, freenect.MM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint8{255, 128, 0}
+	for i, v := range expected {
+		if c := img.RGBAAt(i%2, i/2); c.R != v {
+			t.Errorf("pixel %d: expected %d, got %v", i, v, c)
+		}
+	}
+	if c := img.RGBAAt(1, 1); c != r.Invalid {
+		t.Errorf("expected the invalid color, got %v", c)
+	}
+
+	// equalized, the three readings spread over the whole ramp regardless of the range
+	r.Equalize = true
+	r.Near, r.Far = 0, 10
+	img, _ = r.Render(depth, 2, 2, freenect.MM)
+	if c := img.RGBAAt(1, 0); c.R < 80 || c.R > 90 {
+		t.Errorf("expected the middle reading mid gray, got %v", c)
+	}
+	if c := img.RGBAAt(0, 1); c.R != 0 {
+		t.Errorf("expected the farthest reading black, got %v", c)
+	}
+
+	if _, err = r.Render(depth, 2, 2, freenect.D11BIT_PACKED); err != colormap.ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	if _, err = r.Render(depth[:3], 2, 2, freenect.MM); err != colormap.ErrShortFrame {
+		t.Errorf("expected ErrShortFrame, got %v", err)
+	}
+	for _, size := range [][2]int{{-2, -2}, {-1, 3}, {0, 2}} {
+		if _, err = r.Render(depth, size[0], size[1], freenect.MM); err != colormap.ErrBadSize {
+			t.Errorf("expected ErrBadSize for %dx%d, got %v", size[0], size[1], err)
+		}
+	}
+	frame := &freenect.Frame{Stream: "video"}
+	if _, err = r.RenderFrame(frame); err != colormap.ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat for a video frame, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported from the stream callbacks.
+var (
+	ErrNoCamera						= errors.New("freenect: frame arrived for a device or stream with no camera")
+	ErrUnexpectedBuffer		= errors.New("freenect: frame arrived in an unexpected buffer")
+	ErrSetBuffer					= errors.New("freenect: failed to set frame buffer")
+	ErrSinkPanic					= errors.New("freenect: sink panicked")
+)
+
+// Returned by NewVideoPool and NewDepthPool for a pool too small to deliver frames: one buffer is always with the
+// camera, so a pool needs at least two.
+var ErrPoolSize = errors.New("freenect: a frame pool needs at least two buffers")
+
+// Returned by RegisterLEDPattern for a pattern without steps, or with a step that is not held for any time.
+var ErrLEDPattern = errors.New("freenect: LED pattern needs steps of positive duration")
+
+// An error returned by libfreenect's event processing. The event loop backs off briefly and carries on.
+type LoopError struct {
+	Code	int
+}
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("freenect: event processing failed (%d)", e.Code)
+}
+
+// An error raised while handling a frame. Stream is "video" or "depth"; Code holds the libfreenect return code where
+// there is one and Detail any further description, such as a recovered panic value.
+type StreamError struct {
+	Stream	string
+	Err			error
+	Code		int
+	Detail	string
+}
+
+func (e *StreamError) Error() string {
+	msg := fmt.Sprintf("%s stream: %v", e.Stream, e.Err)
+	if e.Code != 0 {
+		msg += fmt.Sprintf(" (%d)", e.Code)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// Type definition for the function receiving errors raised from the libfreenect callbacks. It is invoked on the
+// event processing go routine and should return quickly.
+type ErrorHandler func(err error)
+
+// What a camera does with its stream after reporting an error.
+type ErrorPolicy int
+
+const (
+	SkipOnError			= ErrorPolicy(iota)	// drop the offending frame and keep streaming
+	StopOnError												// stop the stream
+	RestartOnError										// stop the stream and start it again
+)
+
+// Registers the function receiving errors that are not specific to a camera: frames that cannot be routed and
+// event processing failures. Provide nil to ignore them.
+func (freenect *Freenect) OnError(handler ErrorHandler) {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	freenect.errors = handler
+}
+
+// Registers the function receiving errors raised while handling frames, and the policy applied to the stream
+// afterwards. Provide a nil handler to only apply the policy. The default is to skip the frame.
+func (s *stream) OnError(handler ErrorHandler, policy ErrorPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors = handler
+	s.policy = policy
+}
+
+// Passes an error that is not specific to a camera to the context's handler.
+func reportError(freenect *Freenect, err error) {
+	if freenect == nil {
+		return
+	}
+	freenect.structured().Error("freenect error", "err", err)
+
+	freenect.lock.Lock()
+	handler := freenect.errors
+	freenect.lock.Unlock()
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// Reports the error and applies the policy. The stream is stopped off the event processing go routine,
+// since libfreenect cannot stop a stream from inside its own callback.
+func (s *stream) fail(err error) {
+	s.lock.Lock()
+	handler, policy := s.errors, s.policy
+	s.lock.Unlock()
+
+	s.log().Error("stream error", "err", err, "policy", policy)
+	s.stats.failed()
+	if handler != nil {
+		handler(err)
+	}
+
+	switch policy {
+	case StopOnError:
+		go s.control.Stop()
+	case RestartOnError:
+		go func() {
+			s.control.Stop()
+			s.control.Start()
+		}()
+	}
+}
+
+// Invokes the sink, converting a panic into an error.
+func (camera *VideoCamera) deliver(frame []byte, stamp int32) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &StreamError{Stream: "video", Err: ErrSinkPanic, Detail: fmt.Sprint(r)}
+		}
+	}()
+	camera.sink(frame, stamp)
+	return nil
+}
+
+// See VideoCamera.deliver.
+func (camera *DepthCamera) deliver(frame []uint16, stamp int32) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &StreamError{Stream: "depth", Err: ErrSinkPanic, Detail: fmt.Sprint(r)}
+		}
+	}()
+	camera.sink(frame, stamp)
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package filter cleans up freenect depth frames. Filters work on the unpacked formats (D11BIT, D10BIT, MM and
+// REGISTERED) and can be chained onto a live DepthCamera with Sink or run over recorded frames with Apply.
+package filter
+
+import (
+	"freenect"
+)
+
+// Implemented by every filter. Filter processes a depth image of the given size and format in place.
+type Filter interface {
+	Filter(depth []uint16, width, height int, format freenect.DepthFormat)
+}
+
+// Returns the value marking a pixel without a reading in the given format.
+func Invalid(format freenect.DepthFormat) uint16 {
+	switch format {
+	case freenect.D11BIT:
+		return 2047
+	case freenect.D10BIT:
+		return 1023
+	}
+	return 0
+}
+
+// Wraps a depth sink so every frame passes through the filters, in order, before reaching it. The frames are
+// filtered in the camera's buffer; subscribers to the camera still see the raw frames. The size and format must be
+// those the camera was created with.
+func Sink(next freenect.DepthSink, width, height int, format freenect.DepthFormat, filters ...Filter) freenect.DepthSink {
+	return func(buffer []uint16, stamp int32) {
+		for _, f := range filters {
+			f.Filter(buffer, width, height, format)
+		}
+		if next != nil {
+			next(buffer, stamp)
+		}
+	}
+}
+
+// Returns a copy of a recorded depth frame passed through the filters, in order. The frame itself is not changed.
+func Apply(frame freenect.Frame, filters ...Filter) freenect.Frame {
+	frame.Depth = append([]uint16(nil), frame.Depth...)
+	for _, f := range filters {
+		f.Filter(frame.Depth, frame.Width, frame.Height, frame.DepthFormat())
+	}
+	return frame
+}
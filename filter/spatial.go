@@ -0,0 +1,296 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filter
+
+import (
+	"math"
+
+	"freenect"
+)
+
+// How a hole filling filter chooses values for pixels without a reading.
+type HoleMethod int
+
+const (
+	// Copy the value of the nearest pixel with a reading.
+	NEAREST			HoleMethod = iota
+	// Fill each gap in a row with the farther of the readings on either side. The shadows the Kinect casts beside
+	// foreground objects belong to the background, so this fills them with the background rather than the object.
+	DIRECTIONAL
+	// Grow the surrounding readings into the hole a ring at a time, each pixel the average of its filled neighbors.
+	INPAINT
+)
+
+// A filter filling the holes in a depth image. MaxDistance, if positive, limits how many pixels a reading may be
+// carried into a hole; pixels farther from any reading stay invalid.
+type HoleFill struct {
+	Method			HoleMethod
+	MaxDistance	int
+}
+
+// Implements Filter.
+func (f HoleFill) Filter(depth []uint16, width, height int, format freenect.DepthFormat) {
+	if len(depth) < width*height {
+		return
+	}
+	invalid := Invalid(format)
+	switch f.Method {
+	case DIRECTIONAL:
+		f.directional(depth, width, height, invalid)
+	case INPAINT:
+		f.inpaint(depth, width, height, invalid)
+	default:
+		f.nearest(depth, width, height, invalid)
+	}
+}
+
+// Breadth first from every valid pixel at once, so each hole takes the value of the closest reading.
+func (f HoleFill) nearest(depth []uint16, width, height int, invalid uint16) {
+	dist := make([]int32, width*height)
+	queue := make([]int, 0, width*height)
+	for i := 0; i < width*height; i++ {
+		if depth[i] != invalid {
+			queue = append(queue, i)
+		} else {
+			dist[i] = -1
+		}
+	}
+
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if f.MaxDistance > 0 && int(dist[i]) >= f.MaxDistance {
+			continue
+		}
+		x, y := i%width, i/width
+		for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+			if n[0] < 0 || n[0] >= width || n[1] < 0 || n[1] >= height {
+				continue
+			}
+			j := n[1]*width + n[0]
+			if dist[j] < 0 {
+				dist[j] = dist[i] + 1
+				depth[j] = depth[i]
+				queue = append(queue, j)
+			}
+		}
+	}
+}
+
+func (f HoleFill) directional(depth []uint16, width, height int, invalid uint16) {
+	for y := 0; y < height; y++ {
+		row := depth[y*width : (y+1)*width]
+		for x := 0; x < width; {
+			if row[x] != invalid {
+				x++
+				continue
+			}
+			start := x
+			for x < width && row[x] == invalid {
+				x++
+			}
+			if f.MaxDistance > 0 && x-start > f.MaxDistance {
+				continue
+			}
+
+			// both the raw and millimeter formats grow with distance
+			fill := invalid
+			if start > 0 {
+				fill = row[start-1]
+			}
+			if x < width && (fill == invalid || row[x] > fill) {
+				fill = row[x]
+			}
+			for i := start; i < x; i++ {
+				row[i] = fill
+			}
+		}
+	}
+}
+
+func (f HoleFill) inpaint(depth []uint16, width, height int, invalid uint16) {
+	next := make([]uint16, len(depth))
+	for ring := 0; f.MaxDistance <= 0 || ring < f.MaxDistance; ring++ {
+		copy(next, depth)
+		filled := false
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if depth[y*width+x] != invalid {
+					continue
+				}
+				sum, n := 0, 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := x+dx, y+dy
+						if nx < 0 || nx >= width || ny < 0 || ny >= height {
+							continue
+						}
+						if v := depth[ny*width+nx]; v != invalid {
+							sum += int(v)
+							n++
+						}
+					}
+				}
+				if n > 0 {
+					next[y*width+x] = uint16((sum + n/2) / n)
+					filled = true
+				}
+			}
+		}
+		copy(depth, next)
+		if !filled {
+			break
+		}
+	}
+}
+
+// The default settings of a bilateral filter.
+const (
+	DefaultRadius				= 2
+	DefaultSigmaSpace		= 1.5
+	DefaultSigmaDepth		= 0.03
+)
+
+// An edge preserving smoothing filter. Each pixel becomes a weighted average of the readings within Radius pixels,
+// the weights falling off with the distance in the image (SigmaSpace, in pixels) and with the difference in depth
+// (SigmaDepth, as a fraction of the pixel's own depth). Readings across an edge count for almost nothing, so edges
+// stay sharp while flat surfaces are smoothed. Pixels without a reading are left alone.
+type Bilateral struct {
+	Radius			int
+	SigmaSpace	float64
+	SigmaDepth	float64
+}
+
+// Creates a bilateral filter with the default settings.
+func NewBilateral() Bilateral {
+	return Bilateral{Radius: DefaultRadius, SigmaSpace: DefaultSigmaSpace, SigmaDepth: DefaultSigmaDepth}
+}
+
+// Implements Filter.
+func (f Bilateral) Filter(depth []uint16, width, height int, format freenect.DepthFormat) {
+	if len(depth) < width*height || f.Radius < 1 || f.SigmaSpace <= 0 || f.SigmaDepth <= 0 {
+		return
+	}
+	invalid := Invalid(format)
+
+	// the spatial weights are the same for every pixel
+	r := f.Radius
+	size := 2*r + 1
+	spatial := make([]float64, size*size)
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			spatial[(dy+r)*size+dx+r] = math.Exp(-float64(dx*dx+dy*dy) / (2 * f.SigmaSpace * f.SigmaSpace))
+		}
+	}
+
+	src := append([]uint16(nil), depth[:width*height]...)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := src[y*width+x]
+			if c == invalid {
+				continue
+			}
+			center := float64(c)
+			sigma := f.SigmaDepth * center
+			if sigma < 1 {
+				sigma = 1
+			}
+
+			sum, total := 0.0, 0.0
+			for dy := -r; dy <= r; dy++ {
+				ny := y + dy
+				if ny < 0 || ny >= height {
+					continue
+				}
+				for dx := -r; dx <= r; dx++ {
+					nx := x + dx
+					if nx < 0 || nx >= width {
+						continue
+					}
+					v := src[ny*width+nx]
+					if v == invalid {
+						continue
+					}
+					d := float64(v) - center
+					w := spatial[(dy+r)*size+dx+r] * math.Exp(-d*d/(2*sigma*sigma))
+					sum += w * float64(v)
+					total += w
+				}
+			}
+			depth[y*width+x] = uint16(math.Round(sum / total))
+		}
+	}
+}
+
+// A filter removing speckles: small islands of readings, often spurious, surrounded by holes or by readings at a
+// different depth. Neighboring pixels belong to the same region when their depths differ by at most MaxDiff, as a
+// fraction of the depth; every region smaller than MinSize pixels is marked invalid.
+type Speckle struct {
+	MinSize	int
+	MaxDiff	float64
+}
+
+// Implements Filter.
+func (f Speckle) Filter(depth []uint16, width, height int, format freenect.DepthFormat) {
+	if len(depth) < width*height || f.MinSize < 2 {
+		return
+	}
+	invalid := Invalid(format)
+
+	label := make([]bool, width*height)
+	region := make([]int, 0, f.MinSize)
+	stack := make([]int, 0, 64)
+	for seed := 0; seed < width*height; seed++ {
+		if label[seed] || depth[seed] == invalid {
+			continue
+		}
+
+		// flood the region, remembering its pixels only while it may still turn out to be a speckle
+		region = region[:0]
+		size := 0
+		label[seed] = true
+		stack = append(stack[:0], seed)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			size++
+			if size < f.MinSize {
+				region = append(region, i)
+			}
+
+			x, y := i%width, i/width
+			limit := f.MaxDiff * float64(depth[i])
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= width || n[1] < 0 || n[1] >= height {
+					continue
+				}
+				j := n[1]*width + n[0]
+				if label[j] || depth[j] == invalid || math.Abs(float64(depth[j])-float64(depth[i])) > limit {
+					continue
+				}
+				label[j] = true
+				stack = append(stack, j)
+			}
+		}
+
+		if size < f.MinSize {
+			for _, i := range region {
+				depth[i] = invalid
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filter_test
+
+import (
+	"reflect"
+	"testing"
+
+	"freenect"
+	"freenect/filter"
+)
+
+func TestHoleFill(t *testing.T) {
+	// an object at 1000 casting a shadow onto a wall at 2000
+	row := []uint16{1000, 1000, 0, 0, 0, 2000, 2000}
+	fills := []struct {
+		fill			filter.HoleFill
+		expected	[]uint16
+	}{
+		{filter.HoleFill{Method: filter.NEAREST}, []uint16{1000, 1000, 1000, 1000, 2000, 2000, 2000}},
+		{filter.HoleFill{Method: filter.NEAREST, MaxDistance: 1}, []uint16{1000, 1000, 1000, 0, 2000, 2000, 2000}},
+		{filter.HoleFill{Method: filter.DIRECTIONAL}, []uint16{1000, 1000, 2000, 2000, 2000, 2000, 2000}},
+		{filter.HoleFill{Method: filter.DIRECTIONAL, MaxDistance: 2}, row},
+		{filter.HoleFill{Method: filter.INPAINT}, []uint16{1000, 1000, 1000, 1500, 2000, 2000, 2000}},
+	}
+	for i, f := range fills {
+		depth := append([]uint16(nil), row...)
+		f.fill.Filter(depth, len(depth), 1, freenect.MM)
+		if !reflect.DeepEqual(depth, f.expected) {
+			t.Errorf("fill %d: expected %v, got %v", i, f.expected, depth)
+		}
+	}
+
+	// a hole in the middle of a surface is filled from every side
+	depth := []uint16{
+		2047, 600, 600,
+		600, 2047, 600,
+		600, 600, 600,
+	}
+	filter.HoleFill{Method: filter.INPAINT}.Filter(depth, 3, 3, freenect.D11BIT)
+	for i, v := range depth {
+		if v != 600 {
+			t.Errorf("pixel %d: expected 600, got %d", i, v)
+		}
+	}
+}
+
+func TestBilateral(t *testing.T) {
+	// a noisy step: the noise is smoothed, the step survives
+	width, height := 8, 8
+	depth := make([]uint16, width*height)
+	for i := range depth {
+		x := i % width
+		depth[i] = 1000 + uint16(i%2)*20
+		if x >= 4 {
+			depth[i] = 2000 + uint16(i%2)*20
+		}
+	}
+	depth[0] = 0
+
+	filter.NewBilateral().Filter(depth, width, height, freenect.MM)
+
+	if depth[0] != 0 {
+		t.Errorf("expected the hole to stay, got %d", depth[0])
+	}
+	for y := 1; y < height-1; y++ {
+		if v := depth[y*width+2]; v < 1005 || v > 1015 {
+			t.Errorf("row %d: expected the near side smoothed to about 1010, got %d", y, v)
+		}
+		if v := depth[y*width+5]; v < 2005 || v > 2015 {
+			t.Errorf("row %d: expected the far side smoothed to about 2010, got %d", y, v)
+		}
+	}
+}
+
+func TestSpeckle(t *testing.T) {
+	depth := []uint16{
+		900, 900, 900, 0, 0,
+		900, 900, 900, 0, 400,
+		900, 900, 1500, 0, 0,
+	}
+	filter.Speckle{MinSize: 3, MaxDiff: 0.05}.Filter(depth, 5, 3, freenect.MM)
+
+	expected := []uint16{
+		900, 900, 900, 0, 0,
+		900, 900, 900, 0, 0,
+		900, 900, 0, 0, 0,
+	}
+	if !reflect.DeepEqual(depth, expected) {
+		t.Errorf("expected %v, got %v", expected, depth)
+	}
+}
+
+func TestChain(t *testing.T) {
+	frame := freenect.Frame{Stream: "depth", Format: int32(freenect.MM), Width: 4, Height: 1, Depth: []uint16{1000, 1000, 0, 3000}}
+	out := filter.Apply(frame,
+		filter.Speckle{MinSize: 2, MaxDiff: 0.05},
+		filter.HoleFill{Method: filter.NEAREST})
+
+	expected := []uint16{1000, 1000, 1000, 1000}
+	if !reflect.DeepEqual(out.Depth, expected) {
+		t.Errorf("expected %v, got %v", expected, out.Depth)
+	}
+}
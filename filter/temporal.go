@@ -0,0 +1,213 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filter
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"freenect"
+)
+
+// How a temporal filter combines successive frames.
+type TemporalMode int
+
+const (
+	// Exponential moving average of each pixel.
+	AVERAGE			TemporalMode = iota
+	// Median of each pixel over the last Window frames.
+	MEDIAN
+)
+
+// The default settings of a temporal filter.
+const (
+	DefaultAlpha				= 0.3
+	DefaultPersistence	= 5
+	DefaultWindow				= 5
+	DefaultJump					= 0.1
+)
+
+// A stateful filter smoothing each pixel over successive frames, to suppress flicker at edges and dropouts that last
+// a frame or two.
+//
+// In AVERAGE mode each pixel tracks an exponential moving average, weighting the newest reading by Alpha. A reading
+// differing from the average by more than Jump, as a fraction of the average, restarts it so moving objects do not
+// smear. In MEDIAN mode each pixel is the median of its valid readings over the last Window frames, the nearer of the
+// middle two when there is an even number.
+//
+// In both modes a pixel that loses its reading keeps its last value for up to Persistence frames before it too
+// becomes invalid. Confidence reports how much each output pixel can be trusted.
+//
+// The filter sizes itself on the first frame and starts over when the frame size or format changes. All methods are
+// safe for concurrent use.
+type Temporal struct {
+	Mode				TemporalMode
+	Alpha				float64
+	Persistence	int
+	Window			int
+	Jump				float64
+
+	lock				sync.Mutex
+	size				int
+	format			freenect.DepthFormat
+	average			[]float64
+	age					[]int
+	history			[][]uint16
+	next				int
+	confidence	[]float32
+}
+
+// Creates a temporal filter with the default settings.
+func NewTemporal(mode TemporalMode) *Temporal {
+	return &Temporal{
+		Mode:					mode,
+		Alpha:				DefaultAlpha,
+		Persistence:	DefaultPersistence,
+		Window:				DefaultWindow,
+		Jump:					DefaultJump,
+	}
+}
+
+// Forgets all previous frames.
+func (f *Temporal) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.size = 0
+}
+
+// Returns a copy of the confidence of each pixel of the last filtered frame, from 0 to 1. In AVERAGE mode this is a
+// moving average of how often the pixel had a reading; in MEDIAN mode, the fraction of the window in which it had one.
+func (f *Temporal) Confidence() []float32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]float32(nil), f.confidence...)
+}
+
+// Implements Filter.
+func (f *Temporal) Filter(depth []uint16, width, height int, format freenect.DepthFormat) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	size := width * height
+	if size > len(depth) {
+		size = len(depth)
+	}
+	if size != f.size || format != f.format {
+		f.resize(size, format)
+	}
+
+	if f.Mode == MEDIAN {
+		f.median(depth[:size], Invalid(format))
+	} else {
+		f.smooth(depth[:size], Invalid(format))
+	}
+}
+
+func (f *Temporal) resize(size int, format freenect.DepthFormat) {
+	f.size, f.format = size, format
+	f.average = make([]float64, size)
+	f.age = make([]int, size)
+	f.confidence = make([]float32, size)
+	f.history = nil
+	f.next = 0
+	for i := range f.average {
+		f.average[i] = math.NaN()
+		f.age[i] = math.MaxInt32
+	}
+}
+
+func (f *Temporal) smooth(depth []uint16, invalid uint16) {
+	alpha := f.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = DefaultAlpha
+	}
+
+	for i, v := range depth {
+		avg := f.average[i]
+		if v != invalid {
+			d := float64(v)
+			if math.IsNaN(avg) || math.Abs(d-avg) > f.Jump*avg {
+				avg = d
+			} else {
+				avg += alpha * (d - avg)
+			}
+			f.age[i] = 0
+			f.confidence[i] += float32(alpha) * (1 - f.confidence[i])
+		} else {
+			if f.age[i] < math.MaxInt32 {
+				f.age[i]++
+			}
+			if f.age[i] > f.Persistence {
+				avg = math.NaN()
+			}
+			f.confidence[i] *= float32(1 - alpha)
+		}
+
+		f.average[i] = avg
+		if math.IsNaN(avg) {
+			depth[i] = invalid
+		} else {
+			depth[i] = uint16(math.Round(avg))
+		}
+	}
+}
+
+func (f *Temporal) median(depth []uint16, invalid uint16) {
+	window := f.Window
+	if window < 1 {
+		window = DefaultWindow
+	}
+
+	// keep the last window frames in a ring
+	if cap(f.history) != window {
+		f.history = make([][]uint16, 0, window)
+		f.next = 0
+	}
+	if len(f.history) < window {
+		f.history = append(f.history, append([]uint16(nil), depth...))
+	} else {
+		copy(f.history[f.next], depth)
+	}
+	f.next = (f.next + 1) % window
+
+	samples := make([]int, 0, window)
+	for i := range depth {
+		samples = samples[:0]
+		for _, frame := range f.history {
+			if frame[i] != invalid {
+				samples = append(samples, int(frame[i]))
+			}
+		}
+		f.confidence[i] = float32(len(samples)) / float32(window)
+
+		if len(samples) > 0 {
+			sort.Ints(samples)
+			f.average[i] = float64(samples[(len(samples)-1)/2])
+			f.age[i] = 0
+		} else if f.age[i] < math.MaxInt32 {
+			f.age[i]++
+		}
+
+		if f.age[i] > f.Persistence || math.IsNaN(f.average[i]) {
+			f.average[i] = math.NaN()
+			depth[i] = invalid
+		} else {
+			depth[i] = uint16(f.average[i])
+		}
+	}
+}
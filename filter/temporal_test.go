@@ -0,0 +1,143 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filter_test
+
+import (
+	"testing"
+	"time"
+
+	"freenect"
+	"freenect/filter"
+)
+
+func TestTemporalAverage(t *testing.T) {
+	f := filter.NewTemporal(filter.AVERAGE)
+	f.Persistence = 2
+
+	// a flickering pixel settles between its readings, a dropout is bridged, a jump restarts the average
+	inputs := []uint16{1000, 1040, 1000, 1040, 0, 0, 0, 2000}
+	var outputs []uint16
+	for _, v := range inputs {
+		depth := []uint16{v}
+		f.Filter(depth, 1, 1, freenect.MM)
+		outputs = append(outputs, depth[0])
+	}
+
+	for i := 1; i < 4; i++ {
+		if outputs[i] < 1005 || outputs[i] > 1035 {
+			t.Errorf("frame %d: expected a smoothed reading, got %d", i, outputs[i])
+		}
+	}
+	if outputs[4] != outputs[3] || outputs[5] != outputs[3] {
+		t.Errorf("expected the dropout to hold %d, got %v", outputs[3], outputs[4:6])
+	}
+	if outputs[6] != 0 {
+		t.Errorf("expected the pixel to go invalid after the persistence, got %d", outputs[6])
+	}
+	if outputs[7] != 2000 {
+		t.Errorf("expected a new reading to restart the average, got %d", outputs[7])
+	}
+
+	if c := f.Confidence(); len(c) != 1 || c[0] <= 0 || c[0] >= 1 {
+		t.Errorf("expected a partial confidence, got %v", c)
+	}
+}
+
+func TestTemporalMedian(t *testing.T) {
+	f := filter.NewTemporal(filter.MEDIAN)
+	f.Window = 3
+	f.Persistence = 0
+
+	// the outlier and the dropout never make it through
+	inputs := []uint16{500, 500, 900, 2047, 510}
+	expected := []uint16{500, 500, 500, 500, 510}
+	for i, v := range inputs {
+		depth := []uint16{v}
+		f.Filter(depth, 1, 1, freenect.D11BIT)
+		if depth[0] != expected[i] {
+			t.Errorf("frame %d: expected %d, got %d", i, expected[i], depth[0])
+		}
+	}
+	if c := f.Confidence(); c[0] < 0.6 || c[0] > 0.7 {
+		t.Errorf("expected a confidence of 2/3, got %v", c)
+	}
+
+	for i := 0; i < 3; i++ {
+		f.Filter([]uint16{2047}, 1, 1, freenect.D11BIT)
+	}
+	depth := []uint16{2047}
+	f.Filter(depth, 1, 1, freenect.D11BIT)
+	if depth[0] != 2047 {
+		t.Errorf("expected the pixel to go invalid, got %d", depth[0])
+	}
+}
+
+// Chains a filter onto a simulated depth stream.
+func TestTemporalSink(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+
+	dev := lib.Devices[0]
+	if rc = dev.Open(); rc != 0 {
+		t.Fatalf("Open failed: %d", rc)
+	}
+	defer dev.Close()
+
+	temporal := filter.NewTemporal(filter.AVERAGE)
+	frames := make(chan []uint16, 1)
+	sink := filter.Sink(func(frame []uint16, stamp int32) {
+		select {
+		case frames <- append([]uint16(nil), frame...):
+		default:
+		}
+	}, 640, 480, freenect.MM, temporal)
+
+	depth, rc := dev.DepthCamera(freenect.MEDIUM, freenect.MM, func(bytes int) []uint16 { return make([]uint16, bytes/2) }, sink)
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+	if rc = depth.Start(); rc != 0 {
+		t.Fatalf("Start failed: %d", rc)
+	}
+	defer depth.Stop()
+
+	select {
+	case frame := <-frames:
+		if frame[0] != 3000 {
+			t.Errorf("expected the simulated wall, got %d", frame[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame arrived")
+	}
+	if c := temporal.Confidence(); len(c) != 640*480 || c[0] == 0 {
+		t.Errorf("expected confidence for every pixel")
+	}
+}
+
+func TestApply(t *testing.T) {
+	frame := freenect.Frame{Stream: "depth", Format: int32(freenect.MM), Width: 2, Height: 1, Depth: []uint16{1000, 0}}
+	f := filter.NewTemporal(filter.AVERAGE)
+	f.Filter([]uint16{1000, 1200}, 2, 1, freenect.MM)
+
+	out := filter.Apply(frame, f)
+	if out.Depth[1] != 1200 || frame.Depth[1] != 0 {
+		t.Errorf("expected a filtered copy, got %v from %v", out.Depth, frame.Depth)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+// A copy of a video or depth frame together with the mode it was captured in. Stream is "video" or "depth";
+// Format holds the VideoFormat or DepthFormat accordingly. Video frames carry their bytes in Video and depth frames
+// their values in Depth. Sequence counts the frames of the stream, so a gap means frames were skipped.
+type Frame struct {
+	Stream		string
+	Format		int32
+	Width			int
+	Height		int
+	Timestamp	uint32
+	Sequence	uint64
+	Video			[]byte
+	Depth			[]uint16
+}
+
+// Returns the format of a video frame.
+func (frame *Frame) VideoFormat() VideoFormat {
+	return VideoFormat(frame.Format)
+}
+
+// Returns the format of a depth frame.
+func (frame *Frame) DepthFormat() DepthFormat {
+	return DepthFormat(frame.Format)
+}
+
+// Returns a channel on which a copy of every frame of the stream is delivered, alongside the sink. The channel holds
+// only the most recent frame; a slow reader skips frames rather than holding up the event processing loop. Every
+// subscriber receives the same copy, so its Video and Depth must not be changed.
+func (s *stream) Subscribe() <-chan Frame {
+	ch := make(chan Frame, 1)
+
+	s.lock.Lock()
+	s.subs = append(s.subs, ch)
+	s.lock.Unlock()
+	return ch
+}
+
+// Removes and closes a channel previously returned by Subscribe.
+func (s *stream) Unsubscribe(ch <-chan Frame) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, sub := range s.subs {
+		if sub == ch {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Numbers the frame and, if anyone is subscribed, sends each subscriber a copy made by fill.
+func (s *stream) publish(frame Frame, fill func(frame *Frame)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sequence++
+	if len(s.subs) == 0 {
+		return
+	}
+
+	frame.Stream = s.name
+	frame.Width, frame.Height = s.mode.width, s.mode.height
+	frame.Sequence = s.sequence
+	fill(&frame)
+	for _, sub := range s.subs {
+		// drop the stale frame, if any, so the newest always gets through
+		select {
+		case <-sub:
+		default:
+		}
+		select {
+		case sub <- frame:
+		default:
+		}
+	}
+}
@@ -23,15 +23,17 @@ package freenect
 
 #include <libfreenect/libfreenect.h>
 
-void registerLogCallback(freenect_context* ctx);
-void registerVideoCallback(freenect_device* dev);
-void registerDepthCallback(freenect_device* dev);
-
 */
 import "C"
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -40,6 +42,7 @@ type VideoFormat	int32
 type DepthFormat 	int32
 type Resolution		int32
 type LEDOption		int
+type Flag					int
 
 const (
 	LogFatal 					= LoggerLevel(C.FREENECT_LOG_FATAL)
@@ -86,33 +89,74 @@ const (
 	BLINK_RED_YELLOW	= LEDOption(C.LED_BLINK_RED_YELLOW)
 )
 
+const (
+	AUTO_EXPOSURE				= Flag(C.FREENECT_AUTO_EXPOSURE)
+	AUTO_WHITE_BALANCE	= Flag(C.FREENECT_AUTO_WHITE_BALANCE)
+	RAW_COLOR						= Flag(C.FREENECT_RAW_COLOR)
+	MIRROR_DEPTH				= Flag(C.FREENECT_MIRROR_DEPTH)
+	MIRROR_VIDEO				= Flag(C.FREENECT_MIRROR_VIDEO)
+	NEAR_MODE						= Flag(C.FREENECT_NEAR_MODE)
+)
+
 const (
 	TILT_STOPPED			= int(C.TILT_STATUS_STOPPED)
 	TILT_AT_LIMIT			= int(C.TILT_STATUS_LIMIT)
 	TILT_MOVING				= int(C.TILT_STATUS_MOVING)
 )
 
+// Return code for calls made on a device that is not open, or has been lost and not yet reconnected.
+const (
+	DEVICE_NOT_OPEN		= -995
+)
+
+// The states of a video or depth stream.
+type StreamState int
+
+const (
+	StreamIdle				= StreamState(iota)
+	StreamStarting
+	StreamRunning
+	StreamStopping
+)
+
 // Type definition for the freenect context logger callback.
 type Logger func(level int, message string)
 
 // The freenect library context.  Once initialized, any attached and support devices are available via the Devices member.
+// Devices found later by the watcher are not added to it; they arrive with their DeviceAdded events.
+// All methods are safe for concurrent use.
 type Freenect struct {
-	ctx 			*C.freenect_context
+	backend		backend
+	lock			sync.Mutex
 	logger		Logger
-	Devices		[]Device
+	slog			*slog.Logger
+	errors		ErrorHandler
+	loop			loopStats
+	watcher		*deviceWatcher
+	stop			chan bool
+	done			chan bool
+	known			[]*Device
+	Devices		[]*Device
 }
 
-// A freenect device context.
+// A freenect device context. All methods are safe for concurrent use.
 type Device struct {
+	lock			sync.Mutex
+	// the position among the devices known to the context, in the order found; it never changes
 	index			int
 	freenect 	*Freenect
-	dev				*C.freenect_device
+	dev				deviceBackend
 	video 		*VideoCamera
 	depth 		*DepthCamera
 	tilt			*Tilt
+	leds			*ledSequencer
+	serial		string
+	lost			bool
+	flags			map[Flag]bool
 }
 
 // This type represents the tilt and motor controls.
+// The exported fields are updated by Refresh() on the calling go routine; use Latest() to read the state from others.
 type Tilt struct {
 	device		*Device
 	Angle			float32
@@ -120,121 +164,395 @@ type Tilt struct {
 	AccelX		float32
 	AccelY		float32
 	AccelZ		float32
+	lock			sync.Mutex
+	latest		atomic.Value
+	poller		*tiltPoller
+	gravity		GravityFilter
+	target		float64
+	aimed			bool
 }
 
-var _freenect *Freenect = nil
-
 // This function inititalize the freenect library, selects the motor and camera subdevices and begins the event processing loop.
 // Event processing occurs in a go routine that will be terminated upon a call to Shutdown()
 func Initialize() (*Freenect, int) {
-	if _freenect != nil {
-		return nil, -999
-	}
-
-	var ctx *C.freenect_context
-	rc := int(C.freenect_init(&ctx, nil))
-
+	b, rc := openLibfreenect()
 	if rc != 0 {
 		return nil, rc
 	}
+	return start(b), 0
+}
 
-	C.freenect_select_subdevices(ctx, (C.freenect_device_flags)(C.FREENECT_DEVICE_MOTOR | C.FREENECT_DEVICE_CAMERA))
-
-	d := int(C.freenect_num_devices(ctx))
-	_freenect = &Freenect{ctx, nil, make([]Device, d)}
+// Creates the context for a backend and starts its event processing loop.
+func start(b backend) *Freenect {
+	freenect := &Freenect{backend: b, slog: discard, watcher: &deviceWatcher{}}
+	freenect.stop, freenect.done = make(chan bool), make(chan bool)
 
-	for x := 0; x < d; x++ {
-		_freenect.Devices[x].index = x
-		_freenect.Devices[x].freenect = _freenect
+	serials := b.devices()
+	freenect.Devices = make([]*Device, len(serials))
+	for x, serial := range serials {
+		freenect.Devices[x] = &Device{index: x, freenect: freenect, leds: &ledSequencer{}, serial: serial}
 	}
-
-	go func() {
-		var to C.struct_timeval
-		to.tv_sec = 0
-		to.tv_usec = 0
-		rc := C.int(0)
-		for _freenect != nil && rc >= 0 {
-			rc = C.freenect_process_events_timeout(_freenect.ctx, &to)
+	freenect.known = append([]*Device(nil), freenect.Devices...)
+	b.attach(freenect)
+
+	go func(stop, done chan bool) {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			rc := b.process()
+			freenect.loop.iteration(rc)
+			if rc < 0 {
+				// typically a device went away; keep serving the others, and the watcher if any
+				reportError(freenect, &LoopError{rc})
+				time.Sleep(loopBackoff)
+			}
 		}
-	}()
+	}(freenect.stop, freenect.done)
 
-	return _freenect, 0
+	return freenect
 }
 
-// Shuts down the current [initialized] Freenect context.
+// Shuts down the current [initialized] Freenect context. The event processing loop is stopped before the library is released.
+// Returns 1 if the context has already been shut down.
 func (freenect *Freenect) Shutdown() int {
-	_freenect = nil
-	return int(C.freenect_shutdown(freenect.ctx))
+	freenect.StopWatching()
+
+	freenect.lock.Lock()
+	stop, done := freenect.stop, freenect.done
+	freenect.stop = nil
+	freenect.lock.Unlock()
+	if stop == nil {
+		return 1
+	}
+
+	close(stop)
+	<-done
+	return freenect.backend.shutdown()
 }
 
 // Assigns a new logging callback function.  Only one will be used; provide nil to stop receiving log messages from libfreenect.
 func (freenect *Freenect) Log(logger Logger) {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
 	freenect.logger = logger
 }
 
 // Sets a new log message level to control the verbosity of information coming from libfreenect.
 func (freenect *Freenect) LogLevel(level LoggerLevel) {
-	C.registerLogCallback(freenect.ctx)
-	C.freenect_set_log_level(freenect.ctx, C.freenect_loglevel(level))
+	freenect.backend.setLogLevel(level)
 }
 
-//export logCallback
-func logCallback(ctx unsafe.Pointer, level C.freenect_loglevel, msg *C.char) {
-	if _freenect != nil && _freenect.logger != nil {
-		_freenect.logger(int(level), C.GoString(msg))
+// Routes the library's diagnostics, including the libfreenect log messages, to a structured logger. Messages carry
+// the device index and serial and the stream they relate to. Provide nil to silence them; nothing is written by
+// default. The verbosity of libfreenect itself is still controlled with LogLevel.
+func (freenect *Freenect) StructuredLog(logger *slog.Logger) {
+	if logger == nil {
+		logger = discard
 	}
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	freenect.slog = logger
+}
+
+// Returns the structured logger; never nil.
+func (freenect *Freenect) structured() *slog.Logger {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	return freenect.slog
 }
 
-// Opens the device and prepares it for use. This must be the first call made on the Device.
+// Passes a message from the library to the registered loggers.
+func (freenect *Freenect) libraryLog(level LoggerLevel, message string) {
+	freenect.lock.Lock()
+	logger, structured := freenect.logger, freenect.slog
+	freenect.lock.Unlock()
+
+	if logger != nil {
+		logger(int(level), message)
+	}
+	structured.Log(context.Background(), slogLevel(level), strings.TrimSpace(message), "source", "libfreenect")
+}
+
+// Returns the camera serial number of the device, or an empty string if it could not be read.
+func (device *Device) Serial() string {
+	return device.serial
+}
+
+// Returns every device the context knows of: its Devices and those the watcher has found since.
+func (freenect *Freenect) attached() []*Device {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	return append([]*Device(nil), freenect.known...)
+}
+
+// Returns the device with the serial number, or nil if there is none.
+func (freenect *Freenect) lookup(serial string) *Device {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	return freenect.find(serial)
+}
+
+// Must be called with the context lock held.
+func (freenect *Freenect) find(serial string) *Device {
+	for _, device := range freenect.known {
+		if serial != "" && device.serial == serial {
+			return device
+		}
+	}
+	return nil
+}
+
+// Returns the device with the serial number, creating it if the serial is new.
+func (freenect *Freenect) deviceFor(serial string) *Device {
+	freenect.lock.Lock()
+	defer freenect.lock.Unlock()
+	if device := freenect.find(serial); device != nil {
+		return device
+	}
+	device := &Device{index: len(freenect.known), freenect: freenect, leds: &ledSequencer{}, serial: serial}
+	freenect.known = append(freenect.known, device)
+	return device
+}
+
+// Opens the device and prepares it for use. This must be the first call made on the Device. The device is found by
+// its serial number, as other devices may have come and gone since it was enumerated; by its position in the
+// original enumeration only if its serial number is unknown.
+// Returns 1 if the device is already open.
 func (device *Device) Open() int {
-	rc := int(C.freenect_open_device(device.freenect.ctx, &device.dev, C.int(device.index)))
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if device.dev != nil {
+		return 1
+	}
+
+	index := -1
+	if device.serial == "" {
+		index = device.index
+	}
+	dev, rc := device.freenect.backend.open(index, device.serial, device)
+	if rc == 0 {
+		device.dev = dev
+		device.lost = false
+	}
+	return rc
+}
+
+// Opens the device again by its serial number, after it has been reconnected and its index may have changed.
+func (device *Device) reopen() int {
+	if device.serial == "" {
+		return -998
+	}
+
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if device.dev != nil {
+		return 1
+	}
+
+	dev, rc := device.freenect.backend.open(-1, device.serial, device)
 	if rc == 0 {
-		C.freenect_set_user(device.dev, unsafe.Pointer(device))
+		device.dev = dev
+		device.lost = false
 	}
 	return rc
 }
 
-// Closes the device and releases its resources.
+// Closes the device and releases its resources. Running streams are stopped first.
 func (device *Device) Close() int {
-	C.freenect_set_user(device.dev, nil)
-	return int(C.freenect_close_device(device.dev))
+	device.StopLED()
+	device.freenect.watcher.forget(device)
+
+	if camera := device.videoCamera(); camera != nil {
+		camera.Stop()
+	}
+	if camera := device.depthCamera(); camera != nil {
+		camera.Stop()
+	}
+	return device.release()
+}
+
+// Closes the underlying device handle. Returns DEVICE_NOT_OPEN if there is none.
+func (device *Device) release() int {
+	device.lock.Lock()
+	dev := device.dev
+	device.dev = nil
+	device.lock.Unlock()
+
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+	return dev.close()
+}
+
+// Closes the handle of a device that has disappeared from the bus. Camera states are kept so the streams can be
+// resumed on reconnection.
+func (device *Device) lose() {
+	device.lock.Lock()
+	dev := device.dev
+	device.dev = nil
+	device.lost = true
+	device.lock.Unlock()
+
+	if dev != nil {
+		dev.close()
+	}
+}
+
+// Returns the open device handle, or nil if the device is closed or lost.
+func (device *Device) handle() deviceBackend {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.dev
+}
+
+func (device *Device) videoCamera() *VideoCamera {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.video
+}
+
+func (device *Device) depthCamera() *DepthCamera {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.depth
 }
 
-// Sets the LED option - a combination of color and blink.
+// Sets the LED option - a combination of color and blink. Any pattern playing is stopped first.
 func (device *Device) LED(option LEDOption) int {
-	return int(C.freenect_set_led(device.dev, C.freenect_led_options(option)))
+	leds := device.leds
+	leds.lock.Lock()
+	defer leds.lock.Unlock()
+	leds.halt()
+
+	rc := device.setLED(option)
+	if rc == 0 {
+		leds.current = option
+	}
+	return rc
+}
+
+func (device *Device) setLED(option LEDOption) int {
+	dev := device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+	return dev.setLED(option)
+}
+
+// Turns a camera feature such as auto exposure or mirroring on or off. The setting is reapplied if the device is
+// reconnected.
+func (device *Device) SetFlag(flag Flag, on bool) int {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if device.dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+
+	rc := device.dev.setFlag(flag, on)
+	if rc == 0 {
+		if device.flags == nil {
+			device.flags = map[Flag]bool{}
+		}
+		device.flags[flag] = on
+	}
+	return rc
 }
 
 // Returns a structure that can be used to control or read data from the motor controller.
 // While this function will refresh the tilt state info from the device, if you're going to be reading values off the device,
 // it's really necessary to be calling Refresh() on a draw/game loop or go routine, otherwise the data will be stale.
 func (device *Device) GetTilt() *Tilt {
+	device.lock.Lock()
 	if device.tilt == nil {
-		device.tilt = &Tilt{device, 0, 0, 0, 0, 0}
+		device.tilt = &Tilt{device: device, gravity: GravityFilter{Alpha: gravitySmoothing}}
 	}
+	tilt := device.tilt
+	device.lock.Unlock()
 
-	device.tilt.Refresh()
-	return device.tilt
+	tilt.Refresh()
+	return tilt
 }
 
 // Tells the device to update it's state data. If you're going to be reading values off the device,
 // it's really necessary to be calling this function on a draw/game loop or go routine, otherwise the data will be stale.
+// Alternatively, StartPolling will refresh the state in the background and publish it via Latest() and Subscribe().
 func (tilt *Tilt) Refresh() {
-	C.freenect_update_tilt_state(tilt.device.dev)
-	state := C.freenect_get_tilt_state(tilt.device.dev)
+	state := tilt.refresh()
+
+	tilt.lock.Lock()
+	defer tilt.lock.Unlock()
+	tilt.Angle = state.Angle
+	tilt.Status = state.Status
+	tilt.AccelX = state.AccelX
+	tilt.AccelY = state.AccelY
+	tilt.AccelZ = state.AccelZ
+}
+
+// Reads the current state from the device and records it as the latest snapshot. If the device cannot be read
+// the previous snapshot is returned.
+func (tilt *Tilt) refresh() TiltState {
+	dev := tilt.device.handle()
+	if dev == nil {
+		return tilt.Latest()
+	}
+
+	tilt.lock.Lock()
+	defer tilt.lock.Unlock()
 
-	tilt.Angle = float32(C.freenect_get_tilt_degs(state))
-	tilt.Status = int(C.freenect_get_tilt_status(state))
-	var x, y, z C.double
-	C.freenect_get_mks_accel(state, &x, &y, &z)
-	tilt.AccelX = float32(x)
-	tilt.AccelY = float32(y)
-	tilt.AccelZ = float32(z)
+	snapshot, rc := dev.tiltState()
+	if rc != 0 {
+		snapshot, _ = tilt.latest.Load().(TiltState)
+		return snapshot
+	}
+	snapshot.Gravity = tilt.gravity.Update(snapshot.Accel())
+	snapshot.Time = time.Now()
+	tilt.latest.Store(snapshot)
+	return snapshot
 }
 
 // Sets the desired target angle (in degrees) of the device and starts the motor (if necessary). Note that range is something like +- 27 degrees.
 func (tilt *Tilt) SetAngle(deg float64) int {
-	return int(C.freenect_set_tilt_degs(tilt.device.dev, C.double(deg)))
+	dev := tilt.device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+
+	rc := dev.setTilt(deg)
+	if rc == 0 {
+		tilt.lock.Lock()
+		tilt.target, tilt.aimed = deg, true
+		tilt.lock.Unlock()
+	}
+	return rc
+}
+
+// The mode a stream was set to: the frame size in bytes and pixels.
+type frameMode struct {
+	bytes		int
+	width		int
+	height	int
+}
+
+// The state shared by the video and depth cameras. The lock guards every field but the device, which never changes.
+type stream struct {
+	device		*Device
+	name			string
+	control		interface{ Start() int; Stop() int }
+	lock			sync.Mutex
+	state			StreamState
+	mode			frameMode
+	pinned		*runtime.Pinner
+	inflight	int
+	errors		ErrorHandler
+	policy		ErrorPolicy
+	stats			streamStats
+	subs			[]chan Frame
+	sequence	uint64
 }
 
 // Type definition for function used to provide video buffers to the device.
@@ -242,10 +560,11 @@ type VideoSource 	func(bytes int) []byte
 // Type definition for function used to receive video frames from the device.
 type VideoSink		func(buffer []byte, stamp int32)
 // This type represents the video camera on the device. It can be acquired via the Device function of the same name.
+// All methods are safe for concurrent use.
 type VideoCamera struct {
-	device  *Device
-	on 			bool
-	bytes 	int
+	stream
+	res			Resolution
+	format	VideoFormat
 	source 	VideoSource
 	sink		VideoSink
 	current []byte
@@ -256,10 +575,11 @@ type DepthSource 	func(bytes int) []uint16
 // Type definition for function used to receive depth frames from the device.
 type DepthSink		func(buffer []uint16, stamp int32)
 // This type represents the depth camera on the device. It can be acquired via the Device function of the same name.
+// All methods are safe for concurrent use.
 type DepthCamera struct {
-	device  *Device
-	on 			bool
-	bytes 	int
+	stream
+	res			Resolution
+	format	DepthFormat
 	source  DepthSource
 	sink		DepthSink
 	current []uint16
@@ -274,20 +594,35 @@ func (device *Device) VideoCamera(res Resolution, fmt VideoFormat, source VideoS
 		return nil, -998
 	}
 
-	mode := C.freenect_find_video_mode(C.freenect_resolution(res), C.freenect_video_format(fmt))
-	if mode.is_valid == 0 {
-		return nil, -999
-	}
-
-	rc := int(C.freenect_set_video_mode(device.dev, mode))
+	camera := &VideoCamera{stream: stream{device: device, name: "video"}, res: res, format: fmt, source: source, sink: sink}
+	camera.control = camera
+	rc := camera.setMode()
 	if rc != 0 {
 		return nil, rc
 	}
 
-	C.registerVideoCallback(device.dev)
+	device.lock.Lock()
+	device.video = camera
+	device.lock.Unlock()
+	return camera, 0
+}
 
-	device.video = &VideoCamera{device, false, int(mode.bytes), source, sink, nil}
-	return device.video, 0
+// Sets the video mode on the device and registers the frame callback.
+func (camera *VideoCamera) setMode() int {
+	dev := camera.device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+
+	mode, rc := dev.setVideoMode(camera.res, camera.format)
+	if rc != 0 {
+		return rc
+	}
+
+	camera.lock.Lock()
+	camera.mode = mode
+	camera.lock.Unlock()
+	return 0
 }
 
 // This function creates a new structure representing a fixed format and resolution depth stream.
@@ -295,144 +630,396 @@ func (device *Device) VideoCamera(res Resolution, fmt VideoFormat, source VideoS
 // will not be started.
 // BUG(g): The depth mode is set here instead of on Start() which means we can't reset the camera...
 func (device *Device) DepthCamera(res Resolution, fmt DepthFormat, source DepthSource, sink DepthSink) (*DepthCamera, int) {
-	mode := C.freenect_find_depth_mode(C.freenect_resolution(res), C.freenect_depth_format(fmt))
-	if mode.is_valid == 0 {
-		return nil, -999
+	camera := &DepthCamera{stream: stream{device: device, name: "depth"}, res: res, format: fmt, source: source, sink: sink}
+	camera.control = camera
+	rc := camera.setMode()
+	if rc != 0 {
+		return nil, rc
+	}
+
+	device.lock.Lock()
+	device.depth = camera
+	device.lock.Unlock()
+	return camera, 0
+}
+
+// Sets the depth mode on the device and registers the frame callback.
+func (camera *DepthCamera) setMode() int {
+	dev := camera.device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
 	}
 
-	rc := int(C.freenect_set_depth_mode(device.dev, mode))
+	mode, rc := dev.setDepthMode(camera.res, camera.format)
 	if rc != 0 {
-		return nil, rc
+		return rc
 	}
 
-	C.registerDepthCallback(device.dev)
+	camera.lock.Lock()
+	camera.mode = mode
+	camera.lock.Unlock()
+	return 0
+}
 
-	device.depth = &DepthCamera{device, false, int(mode.bytes), source, sink, nil}
-	return device.depth, 0
+// Returns the current state of the stream.
+func (s *stream) State() StreamState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Moves the stream from one state to another. Returns false if the stream was not in the expected state.
+func (s *stream) transition(from, to StreamState) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != from {
+		return false
+	}
+	s.state = to
+	return true
+}
+
+// Marks the end of a callback, unpinning the buffer if the stream was stopped while the frame was being delivered.
+func (s *stream) settle() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inflight--
+	if s.state == StreamIdle && s.inflight == 0 {
+		s.unpin()
+	}
+}
+
+// Marks the stream stopped. The buffer stays pinned until any callback in flight has finished with it.
+func (s *stream) stopped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = StreamIdle
+	if s.inflight == 0 {
+		s.unpin()
+	}
+}
+
+// Must be called with the lock held.
+func (s *stream) unpin() {
+	if s.pinned != nil {
+		s.pinned.Unpin()
+		s.pinned = nil
+	}
 }
 
 // Starts the acquisition of the video stream. The source function will be invoked to obtain the first frame buffer.
+// Returns 1 if the stream is not idle.
 func (camera *VideoCamera) Start() int {
-	if camera.on == true {
+	if !camera.transition(StreamIdle, StreamStarting) {
 		return 1
 	}
 
-	buffer := camera.source(camera.bytes)
-	rc := int(C.freenect_set_video_buffer(camera.device.dev, unsafe.Pointer(&buffer[0])))
+	rc := camera.begin()
 	if rc != 0 {
-		fmt.Printf("Failed to set video buffer: %d\n", rc)
+		camera.stopped()
 		return rc
 	}
-	camera.current = buffer
 
-	rc = int(C.freenect_start_video(camera.device.dev))
+	camera.transition(StreamStarting, StreamRunning)
+	camera.log().Info("stream started")
+	return 0
+}
+
+func (camera *VideoCamera) begin() int {
+	dev := camera.device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+
+	camera.lock.Lock()
+	bytes, current := camera.mode.bytes, camera.current
+	camera.lock.Unlock()
+
+	// as with later frames, a nil buffer means carry on with the previous one
+	buffer := camera.source(bytes)
+	if buffer == nil {
+		buffer = current
+	}
+	rc := camera.setBuffer(dev, buffer)
 	if rc != 0 {
-		fmt.Printf("Failed to start video stream: %d\n", rc)
+		camera.log().Error("failed to set frame buffer", "rc", rc)
 		return rc
 	}
 
-	fmt.Printf("Video stream started\n")
-	camera.on = true
-	return 0
+	rc = dev.startVideo()
+	if rc != 0 {
+		camera.log().Error("failed to start stream", "rc", rc)
+	}
+	return rc
 }
 
 // Starts the acquisition of the depth stream. The source function will be invoked to obtain the first frame buffer.
+// Returns 1 if the stream is not idle.
 func (camera *DepthCamera) Start() int {
-	if camera.on == true {
+	if !camera.transition(StreamIdle, StreamStarting) {
 		return 1
 	}
 
-	buffer := camera.source(camera.bytes)
-	rc := int(C.freenect_set_depth_buffer(camera.device.dev, unsafe.Pointer(&buffer[0])))
+	rc := camera.begin()
 	if rc != 0 {
-		fmt.Printf("Failed to set depth buffer: %d\n", rc)
+		camera.stopped()
 		return rc
 	}
-	camera.current = buffer
 
-	rc = int(C.freenect_start_depth(camera.device.dev))
+	camera.transition(StreamStarting, StreamRunning)
+	camera.log().Info("stream started")
+	return 0
+}
+
+func (camera *DepthCamera) begin() int {
+	dev := camera.device.handle()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+
+	camera.lock.Lock()
+	bytes, current := camera.mode.bytes, camera.current
+	camera.lock.Unlock()
+
+	// as with later frames, a nil buffer means carry on with the previous one
+	buffer := camera.source(bytes)
+	if buffer == nil {
+		buffer = current
+	}
+	rc := camera.setBuffer(dev, buffer)
 	if rc != 0 {
-		fmt.Printf("Failed to start depth stream: %d\n", rc)
+		camera.log().Error("failed to set frame buffer", "rc", rc)
 		return rc
 	}
 
-	fmt.Printf("Depth stream started\n")
-	camera.on = true
-	return 0
+	rc = dev.startDepth()
+	if rc != 0 {
+		camera.log().Error("failed to start stream", "rc", rc)
+	}
+	return rc
 }
 
-// Stops the acquisition of the video stream.
+// Stops the acquisition of the video stream. Returns 1 if the stream is not running.
 func (camera *VideoCamera) Stop() int {
-	if camera.on == false {
+	if !camera.transition(StreamRunning, StreamStopping) {
 		return 1
 	}
 
-	C.freenect_stop_video(camera.device.dev)
-	fmt.Printf("Video stream stopped\n")
+	if dev := camera.device.handle(); dev != nil {
+		dev.stopVideo()
+	}
+	camera.stopped()
+	camera.log().Info("stream stopped")
 	return 0
 }
 
-// Stops the acquisition of the depth stream.
+// Stops the acquisition of the depth stream. Returns 1 if the stream is not running.
 func (camera *DepthCamera) Stop() int {
-	if camera.on == false {
+	if !camera.transition(StreamRunning, StreamStopping) {
 		return 1
 	}
 
-	C.freenect_stop_depth(camera.device.dev)
-	fmt.Printf("Depth stream stopped\n")
+	if dev := camera.device.handle(); dev != nil {
+		dev.stopDepth()
+	}
+	camera.stopped()
+	camera.log().Info("stream stopped")
 	return 0
 }
 
-//export videoCallback
-func videoCallback(dev unsafe.Pointer, frame unsafe.Pointer, timestamp C.uint32_t) {
-	device := (*Device)(C.freenect_get_user((*C.freenect_device)(dev)))
-	if device == nil || device.video == nil {
-		panic("No video camera found")
+// Restores the mode and, if it was running, the stream after the device has been reopened.
+func (camera *VideoCamera) resume() int {
+	rc := camera.setMode()
+	if rc != 0 || camera.State() != StreamRunning {
+		return rc
 	}
 
-	camera := device.video
+	dev := camera.device.handle()
+	camera.lock.Lock()
+	current := camera.current
+	camera.lock.Unlock()
+
+	rc = camera.setBuffer(dev, current)
+	if rc != 0 {
+		return rc
+	}
+	return dev.startVideo()
+}
 
-	if frame != unsafe.Pointer(&camera.current[0]) {
-		panic("Unexpected video frame buffer pointer")
+// Restores the mode and, if it was running, the stream after the device has been reopened.
+func (camera *DepthCamera) resume() int {
+	rc := camera.setMode()
+	if rc != 0 || camera.State() != StreamRunning {
+		return rc
 	}
 
-	camera.sink(camera.current, int32(timestamp))
+	dev := camera.device.handle()
+	camera.lock.Lock()
+	current := camera.current
+	camera.lock.Unlock()
 
-		// source can return nil to reuse same buffer
-	buffer := camera.source(camera.bytes)
-	if buffer != nil {
-		rc := int(C.freenect_set_video_buffer(camera.device.dev, unsafe.Pointer(&buffer[0])))
-		if rc != 0 {
-			fmt.Printf("Failed to set video buffer: %d\n", rc)
-			panic("Failed to set video buffer")
-		}
-		camera.current = buffer
+	rc = camera.setBuffer(dev, current)
+	if rc != 0 {
+		return rc
 	}
+	return dev.startDepth()
 }
 
-//export depthCallback
-func depthCallback(dev unsafe.Pointer, frame unsafe.Pointer, timestamp C.uint32_t) {
-	device := (*Device)(C.freenect_get_user((*C.freenect_device)(dev)))
-	if device == nil || device.depth == nil {
-		panic("No depth camera found")
+// Hands a frame buffer to libfreenect. The buffer is pinned for as long as libfreenect holds it, since the
+// library keeps writing to it after the call returns.
+func (camera *VideoCamera) setBuffer(dev deviceBackend, buffer []byte) int {
+	camera.lock.Lock()
+	bytes := camera.mode.bytes
+	camera.lock.Unlock()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+	if len(buffer) < bytes {
+		return -998
 	}
 
-	camera := device.depth
+	pinned := &runtime.Pinner{}
+	pinned.Pin(&buffer[0])
+	rc := dev.setVideoBuffer(unsafe.Pointer(&buffer[0]))
+	if rc != 0 {
+		pinned.Unpin()
+		return rc
+	}
+
+	camera.lock.Lock()
+	camera.unpin()
+	camera.pinned = pinned
+	camera.current = buffer
+	camera.lock.Unlock()
+	return 0
+}
 
-	if frame != unsafe.Pointer(&camera.current[0]) {
-		panic("Unexpected depth frame buffer pointer")
+// See VideoCamera.setBuffer.
+func (camera *DepthCamera) setBuffer(dev deviceBackend, buffer []uint16) int {
+	camera.lock.Lock()
+	bytes := camera.mode.bytes
+	camera.lock.Unlock()
+	if dev == nil {
+		return DEVICE_NOT_OPEN
+	}
+	if len(buffer)*2 < bytes {
+		return -998
 	}
 
-	camera.sink(camera.current, int32(timestamp))
+	pinned := &runtime.Pinner{}
+	pinned.Pin(&buffer[0])
+	rc := dev.setDepthBuffer(unsafe.Pointer(&buffer[0]))
+	if rc != 0 {
+		pinned.Unpin()
+		return rc
+	}
 
-		// source can return nil to reuse same buffer
-	buffer := camera.source(camera.bytes)
-	if buffer != nil {
-		rc := int(C.freenect_set_depth_buffer(camera.device.dev, unsafe.Pointer(&buffer[0])))
+	camera.lock.Lock()
+	camera.unpin()
+	camera.pinned = pinned
+	camera.current = buffer
+	camera.lock.Unlock()
+	return 0
+}
+
+// Called by the backend on the event processing go routine when a video frame has been written to the current buffer.
+func (device *Device) videoFrame(frame unsafe.Pointer, timestamp uint32) {
+	camera := device.videoCamera()
+	if camera == nil {
+		reportError(device.freenect, &StreamError{Stream: "video", Err: ErrNoCamera})
+		return
+	}
+
+	camera.lock.Lock()
+	if camera.state != StreamStarting && camera.state != StreamRunning {
+		camera.lock.Unlock()
+		return
+	}
+	if len(camera.current) == 0 || frame != unsafe.Pointer(&camera.current[0]) {
+		camera.lock.Unlock()
+		camera.fail(&StreamError{Stream: "video", Err: ErrUnexpectedBuffer})
+		return
+	}
+	current, bytes := camera.current, camera.mode.bytes
+	camera.inflight++
+	camera.lock.Unlock()
+	defer camera.settle()
+
+	// the next buffer is set before the frame is delivered, so a sink may keep the frame. The source can return nil
+	// to reuse the same buffer; when it does because its pool ran dry the frame is dropped, so the buffer is refilled
+	// rather than handed to the sink while the camera writes to it
+	arrived := time.Now()
+	buffer := camera.source(bytes)
+	switch {
+	case buffer == nil && exhausted(unsafe.Pointer(&current[0])):
+		camera.stats.dropped()
+		return
+	case buffer == nil:
+		camera.stats.dropped()
+	default:
+		rc := camera.setBuffer(device.handle(), buffer)
 		if rc != 0 {
-			fmt.Printf("Failed to set depth buffer: %d\n", rc)
-			panic("Failed to set depth buffer")
+			camera.fail(&StreamError{Stream: "video", Err: ErrSetBuffer, Code: rc})
 		}
-		camera.current = buffer
+	}
+
+	camera.publish(Frame{Format: int32(camera.format), Timestamp: timestamp}, func(frame *Frame) {
+		frame.Video = append([]byte(nil), current[:bytes]...)
+	})
+	err := camera.deliver(current, int32(timestamp))
+	camera.stats.frame(arrived, time.Since(arrived))
+	if err != nil {
+		camera.fail(err)
+	}
+}
+
+// Called by the backend on the event processing go routine when a depth frame has been written to the current buffer.
+func (device *Device) depthFrame(frame unsafe.Pointer, timestamp uint32) {
+	camera := device.depthCamera()
+	if camera == nil {
+		reportError(device.freenect, &StreamError{Stream: "depth", Err: ErrNoCamera})
+		return
+	}
+
+	camera.lock.Lock()
+	if camera.state != StreamStarting && camera.state != StreamRunning {
+		camera.lock.Unlock()
+		return
+	}
+	if len(camera.current) == 0 || frame != unsafe.Pointer(&camera.current[0]) {
+		camera.lock.Unlock()
+		camera.fail(&StreamError{Stream: "depth", Err: ErrUnexpectedBuffer})
+		return
+	}
+	current, bytes := camera.current, camera.mode.bytes
+	camera.inflight++
+	camera.lock.Unlock()
+	defer camera.settle()
+
+	// the next buffer is set before the frame is delivered, so a sink may keep the frame. The source can return nil
+	// to reuse the same buffer; when it does because its pool ran dry the frame is dropped, so the buffer is refilled
+	// rather than handed to the sink while the camera writes to it
+	arrived := time.Now()
+	buffer := camera.source(bytes)
+	switch {
+	case buffer == nil && exhausted(unsafe.Pointer(&current[0])):
+		camera.stats.dropped()
+		return
+	case buffer == nil:
+		camera.stats.dropped()
+	default:
+		rc := camera.setBuffer(device.handle(), buffer)
+		if rc != 0 {
+			camera.fail(&StreamError{Stream: "depth", Err: ErrSetBuffer, Code: rc})
+		}
+	}
+
+	camera.publish(Frame{Format: int32(camera.format), Timestamp: timestamp}, func(frame *Frame) {
+		frame.Depth = append([]uint16(nil), current[:bytes/2]...)
+	})
+	err := camera.deliver(current, int32(timestamp))
+	camera.stats.frame(arrived, time.Since(arrived))
+	if err != nil {
+		camera.fail(err)
 	}
 }
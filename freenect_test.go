@@ -17,16 +17,23 @@
 package freenect_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"time"
 	"hash/crc32"
-	//"math"
+	"math"
 	"os"
 	"image"
 	"image/color"
   "image/png"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"freenect"
+	"freenect/colormap"
 )
 
 func TestOpenCloseLib(t *testing.T) {
@@ -306,14 +313,7 @@ func TestDepthOnly(t *testing.T) {
 		return nil
 	}
 
-	gamma := make([]float64, 2048)
-	for i := 0; i <2048; i++ {
-		v := float64(i)/2048.0
-		v = v*v*v*6.0
-		gamma[i] = v*6.0*256.0;
-		//gamma[i] = 0.1236 * math.Tan((float64(i)/2842.5) + 1.1863)
-	}
-	fmt.Printf("%f %f\n",gamma[0],gamma[2047])
+	colors := colormap.New(colormap.Glview)
 
 	var recvd = 0
 	var sink = func(frame []uint16, stamp int32) {
@@ -325,40 +325,7 @@ func TestDepthOnly(t *testing.T) {
 		fname := fmt.Sprintf("depthtest-%d.png",recvd)
 		f, err := os.OpenFile(fname, os.O_CREATE | os.O_WRONLY, 0666)
     if err == nil {
-      m := image.NewNRGBA(image.Rect(0,0, 640, 480))
-      for y := 0; y < 480; y++ {
-      	for x := 0; x < 640; x++ {
-      		d := buffer[x+(y*640)]
-      		mm := uint16(gamma[d])
-      		var rgba color.NRGBA
-
-					lb := uint8(mm & 0xff)
-					switch (mm>>8) {
-						case 0:
-							rgba = color.NRGBA{255, 255-lb, 255-lb, 255}
-							break
-						case 1:
-							rgba = color.NRGBA{255, lb, 0, 255}
-							break
-						case 2:
-							rgba = color.NRGBA{255-lb, 255, 0, 255}
-							break
-						case 3:
-							rgba = color.NRGBA{0, 255, lb, 255}
-							break
-						case 4:
-							rgba = color.NRGBA{0, 255-lb, 255, 255}
-							break
-						case 5:
-							rgba = color.NRGBA{0, 0, 255-lb, 255}
-							break
-						default:
-							rgba = color.NRGBA{0, 0, 0, 255}
-							break;
-					}
-          m.Set(x, y, rgba)
-        }
-    	}
+      m, _ := colors.Render(frame, 640, 480, freenect.D11BIT)
     	png.Encode(f, m)
 		}
 
@@ -407,12 +374,7 @@ func TestVideoAndDepth(t *testing.T) {
 	ready := true
 	recvd := 0
 
-	gamma := make([]float64, 2048)
-	for i := 0; i <2048; i++ {
-		v := float64(i)/2048.0
-		v = v*v*v*6.0
-		gamma[i] = v*6.0*256.0;
-	}
+	colors := colormap.New(colormap.Glview)
 
 	go func(){
 		fmt.Printf("Waiting to process frames\n")
@@ -424,39 +386,12 @@ func TestVideoAndDepth(t *testing.T) {
 			f, err := os.OpenFile(fname, os.O_CREATE | os.O_WRONLY, 0666)
       if err == nil {
         m := image.NewNRGBA(image.Rect(0,0, 1280, 480))
+        dm, _ := colors.Render(depth, 640, 480, freenect.D11BIT)
           for y := 0; y < 480; y++ {
 	        	for x := 0; x < 640; x++ {
               m.Set(x, y, color.NRGBA{uint8(video[(y*640*3)+(3*x)]), uint8(video[(y*640*3)+((3*x)+1)]), uint8(video[(y*640*3)+((3*x)+2)]), 255})
 
-		      		d := depth[x+(y*640)]
-		      		mm := uint16(gamma[d])
-		      		var rgba color.NRGBA
-
-							lb := uint8(mm & 0xff)
-							switch (mm>>8) {
-								case 0:
-									rgba = color.NRGBA{255, 255-lb, 255-lb, 255}
-									break
-								case 1:
-									rgba = color.NRGBA{255, lb, 0, 255}
-									break
-								case 2:
-									rgba = color.NRGBA{255-lb, 255, 0, 255}
-									break
-								case 3:
-									rgba = color.NRGBA{0, 255, lb, 255}
-									break
-								case 4:
-									rgba = color.NRGBA{0, 255-lb, 255, 255}
-									break
-								case 5:
-									rgba = color.NRGBA{0, 0, 255-lb, 255}
-									break
-								default:
-									rgba = color.NRGBA{0, 0, 0, 255}
-									break;
-							}
-		          m.Set(x+640, y, rgba)
+		          m.Set(x+640, y, dm.At(x, y))
             }
       	}
       	png.Encode(f, m)
@@ -580,11 +515,7 @@ func TestTilt(t *testing.T) {
 
 			dev.LED(freenect.OFF)
 			tilt := dev.GetTilt()
-
-			run := true
-			go func(){
-				for run { tilt.Refresh() }
-			}()
+			ctx := context.Background()
 
 			dump := func() {
 				motor := ""
@@ -599,38 +530,483 @@ func TestTilt(t *testing.T) {
 			dev.LED(freenect.BLINK_GREEN)
 			dump()
 			fmt.Printf("Leveling...\n")
-			tilt.SetAngle(0.0)
-			for tilt.Angle != 0.0 {
+			if rc = tilt.MoveTo(ctx, 0.0); rc != 0 {
+				t.Errorf("Failed to level. Returned %d", rc)
 			}
 			dump()
 			time.Sleep(1e9)
 
 			dev.LED(freenect.RED)
 			fmt.Printf("27 degrees\n")
-			tilt.SetAngle(27.0)
-			for tilt.Status == freenect.TILT_MOVING {
+			if rc = tilt.MoveTo(ctx, 27.0); rc != 0 {
+				t.Errorf("Failed to tilt up. Returned %d", rc)
 			}
 			dump()
 			time.Sleep(1e9)
 
 			dev.LED(freenect.YELLOW)
 			fmt.Printf("-27 degrees\n")
-			tilt.SetAngle(-27.0)
-			for tilt.Status == freenect.TILT_MOVING {
+			if rc = tilt.MoveTo(ctx, -27.0); rc != 0 {
+				t.Errorf("Failed to tilt down. Returned %d", rc)
 			}
 			dump()
 			time.Sleep(1e9)
 
 			fmt.Printf("Relevel\n")
 			dev.LED(freenect.BLINK_RED_YELLOW)
-			tilt.SetAngle(0.0)
-			for tilt.Angle != 0.0 {
+			if rc = tilt.MoveTo(ctx, 0.0); rc != 0 {
+				t.Errorf("Failed to relevel. Returned %d", rc)
 			}
 			dump()
 			time.Sleep(1e9)
+		}
+	}
+}
 
-			run = false
+func TestTiltSweep(t *testing.T) {
+	lib, rc := freenect.Initialize()
+
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+
+			stops := 0
+			tilt := dev.GetTilt()
+			rc = tilt.Sweep(ctx, -20.0, 20.0, 10.0, func(tilt *freenect.Tilt, deg float64) bool {
+				fmt.Printf("Stopped at %f degrees (target %f)\n", tilt.Angle, deg)
+				stops++
+				return true
+			})
+			if rc != 0 {
+				t.Errorf("Sweep failed. Returned %d", rc)
+			}
+			if stops != 5 {
+				t.Errorf("Expected 5 stops, got %d", stops)
+			}
+
+			tilt.MoveTo(ctx, 0.0)
+		}
+	}
+}
+
+func TestTiltPolling(t *testing.T) {
+	lib, rc := freenect.Initialize()
+
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			tilt := dev.GetTilt()
+			states := tilt.Subscribe()
+			defer tilt.Unsubscribe(states)
+
+			if rc = tilt.StartPolling(20 * time.Millisecond); rc != 0 {
+				t.Errorf("Failed to start polling. Returned %d", rc)
+			}
+			if rc = tilt.StartPolling(20 * time.Millisecond); rc != 1 {
+				t.Errorf("Expected poller to be running already. Returned %d", rc)
+			}
+
+			var last time.Time
+			for n := 0; n < 10; n++ {
+				state := <-states
+				if !state.Time.After(last) {
+					t.Errorf("Tilt snapshot out of order")
+				}
+				last = state.Time
+				fmt.Printf("Polled angle %f degrees, status %d, accel (%f, %f, %f)\n", state.Angle, state.Status, state.AccelX, state.AccelY, state.AccelZ)
+			}
+
+			if rc = tilt.StopPolling(); rc != 0 {
+				t.Errorf("Failed to stop polling. Returned %d", rc)
+			}
+			if tilt.Latest().Time.Before(last) {
+				t.Errorf("Latest tilt state is older than the last published")
+			}
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	level := freenect.Vector{0, 9.81, 0}.Orientation()
+	if level.Roll != 0 || level.Pitch != 0 {
+		t.Errorf("Expected a level orientation, got %v", level)
+	}
+
+	up := freenect.Vector{0, 9.81 * math.Cos(math.Pi/6), 9.81 * math.Sin(math.Pi/6)}.Orientation()
+	if math.Abs(up.Pitch-30) > 1e-9 || up.Roll != 0 {
+		t.Errorf("Expected 30 degrees pitch, got %v", up)
+	}
+
+	filter := freenect.GravityFilter{Alpha: 0.5}
+	filter.Update(freenect.Vector{0, 10, 0})
+	g := filter.Update(freenect.Vector{0, 8, 2})
+	if g != (freenect.Vector{0, 9, 1}) {
+		t.Errorf("Unexpected filtered gravity %v", g)
+	}
+
+	lib, rc := freenect.Initialize()
+
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			tilt := dev.GetTilt()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if rc = tilt.Level(ctx); rc != 0 {
+				t.Errorf("Failed to level. Returned %d", rc)
+			}
+			o := tilt.Orientation()
+			fmt.Printf("Leveled at %f degrees -- roll %f, pitch %f\n", tilt.Angle, o.Roll, o.Pitch)
+		}
+	}
+}
+
+func TestLEDPatterns(t *testing.T) {
+	lib, rc := freenect.Initialize()
+
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			dev.LED(freenect.GREEN)
+			if rc = dev.PlayLED("no such pattern"); rc == 0 {
+				t.Errorf("Unknown pattern should not play")
+			}
+
+			for _, name := range []string{"recording", "error", "calibrating"} {
+				fmt.Printf("Playing %s\n", name)
+				if rc = dev.PlayLED(name); rc != 0 {
+					t.Errorf("Failed to play %s. Returned %d", name, rc)
+				}
+				time.Sleep(3e9)
+			}
+
+			if rc = dev.StopLED(); rc != 0 {
+				t.Errorf("Failed to stop pattern. Returned %d", rc)
+			}
+			if rc = dev.StopLED(); rc != 1 {
+				t.Errorf("Expected no pattern to be playing. Returned %d", rc)
+			}
+			fmt.Printf("LED should be green again\n")
+			time.Sleep(1e9)
+		}
+	}
+}
+
+func TestFramePools(t *testing.T) {
+	if _, err := freenect.NewDepthPool(1); err != freenect.ErrPoolSize {
+		t.Errorf("Expected a single buffer pool to be refused, got %v", err)
+	}
+	pool, err := freenect.NewDepthPool(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Free()
+
+	source := pool.Source()
+	a, b := source(640*480*2), source(640*480*2)
+	if len(a) != 640*480 || len(b) != 640*480 || &a[0] == &b[0] {
+		t.Errorf("Expected two distinct depth buffers")
+	}
+	if source(640*480*2) != nil {
+		t.Errorf("Exhausted pool should return nil")
+	}
+
+	pool.Return(a)
+	pool.Return(a)
+	if c := source(640*480*2); c == nil || &c[0] != &a[0] {
+		t.Errorf("Expected the returned buffer back")
+	}
+	pool.Return(b)
+	if c := source(640*480*2); c == nil || &c[0] != &b[0] {
+		t.Errorf("Expected the returned buffer back")
+	}
+	if source(640*480*2) != nil {
+		t.Errorf("Returning a buffer twice should not duplicate it")
+	}
+	if source(320*240*2) != nil {
+		t.Errorf("Pool should not hand out buffers of a different size")
+	}
+}
+
+// video frames borrowed from a C allocated pool and returned after processing on another goroutine
+func TestVideoPool(t *testing.T) {
+	var logger = func(level int, message string) {
+		fmt.Printf("LEVEL: %d  MSG: %s", level, message)
+	}
+
+	pool, err := freenect.NewVideoPool(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Free()
+
+	frames := make(chan []byte, 3)
+	var sink = func(frame []byte, stamp int32) {
+		select {
+		case frames <- frame:
+		default:
+			pool.Return(frame)
+		}
+	}
+
+	lib, rc := freenect.Initialize()
+	if rc == 0 {
+		defer lib.Shutdown()
+		lib.Log(logger)
+		lib.LogLevel(freenect.LogWarning)
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			cam, rc := dev.VideoCamera(freenect.MEDIUM, freenect.RGB, pool.Source(), sink)
+			if rc != 0 {
+				t.Errorf("No camera. Returned %d", rc)
+			}
+
+			cam.Start()
+			for recvd := 0; recvd < 30; recvd++ {
+				frame := <-frames
+				fmt.Printf("Got frame %d crc32: %x\n", recvd, crc32.ChecksumIEEE(frame))
+				pool.Return(frame)
+			}
+			cam.Stop()
 		}
 	}
 }
 
+func TestStreamErrors(t *testing.T) {
+	err := error(&freenect.StreamError{Stream: "depth", Err: freenect.ErrSetBuffer, Code: -1})
+	if !errors.Is(err, freenect.ErrSetBuffer) {
+		t.Errorf("StreamError should unwrap to its cause")
+	}
+	if err.Error() != "depth stream: freenect: failed to set frame buffer (-1)" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+
+	lib, rc := freenect.Initialize()
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			var buffer []byte = nil
+			var source = func(bytes int) []byte {
+				if buffer == nil {
+					buffer = make([]byte, bytes)
+				}
+				return buffer
+			}
+
+			// a sink that blows up must not take the process with it
+			var sink = func(frame []byte, stamp int32) {
+				panic("bad frame")
+			}
+
+			cam, rc := dev.VideoCamera(freenect.MEDIUM, freenect.RGB, source, sink)
+			if rc != 0 {
+				t.Errorf("No camera. Returned %d", rc)
+			}
+
+			errs := make(chan error, 1)
+			cam.OnError(func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}, freenect.StopOnError)
+
+			cam.Start()
+			err := <-errs
+			fmt.Printf("Stream failed: %v\n", err)
+			if !errors.Is(err, freenect.ErrSinkPanic) {
+				t.Errorf("Expected a sink panic, got %v", err)
+			}
+			cam.Stop()
+		}
+	}
+}
+
+func TestStructuredLog(t *testing.T) {
+	lib, rc := freenect.Initialize()
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		var out bytes.Buffer
+		lib.StructuredLog(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		lib.LogLevel(freenect.LogWarning)
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			var buffer []uint16 = nil
+			var source = func(bytes int) []uint16 {
+				if buffer == nil {
+					buffer = make([]uint16, bytes)
+				}
+				return buffer
+			}
+
+			cam, rc := dev.DepthCamera(freenect.MEDIUM, freenect.D11BIT, source, func(frame []uint16, stamp int32) {})
+			if rc != 0 {
+				t.Errorf("No camera. Returned %d", rc)
+			}
+
+			cam.Start()
+			time.Sleep(5e8)
+			cam.Stop()
+
+			want := fmt.Sprintf("msg=\"stream started\" device=%d serial=%s stream=depth", i, dev.Serial())
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Expected %q in log output:\n%s", want, out.String())
+			}
+		}
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	lib, rc := freenect.Initialize()
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			// one buffer, never swapped: every frame after the first counts as dropped
+			var buffer []byte = nil
+			var source = func(bytes int) []byte {
+				if buffer == nil {
+					buffer = make([]byte, bytes)
+					return buffer
+				}
+				return nil
+			}
+
+			cam, rc := dev.VideoCamera(freenect.MEDIUM, freenect.RGB, source, func(frame []byte, stamp int32) {})
+			if rc != 0 {
+				t.Errorf("No camera. Returned %d", rc)
+			}
+
+			cam.Start()
+			time.Sleep(2e9)
+			cam.Stop()
+
+			stats := cam.Stats()
+			fmt.Printf("Received %d, dropped %d, %.1f fps, jitter %v, sink latency %v\n", stats.Received, stats.Dropped, stats.FPS, stats.Jitter, stats.SinkLatency)
+			if stats.Received == 0 || stats.Dropped == 0 {
+				t.Errorf("Expected frames to be received and dropped")
+			}
+		}
+
+		w := httptest.NewRecorder()
+		lib.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "# TYPE freenect_frames_received_total counter") {
+			t.Errorf("Unexpected metrics output:\n%s", w.Body.String())
+		}
+	}
+}
+
+// unplug and replug the device while this runs to see the events
+func TestHotplug(t *testing.T) {
+	lib, rc := freenect.Initialize()
+	if rc == 0 {
+		defer lib.Shutdown()
+
+		events := lib.Watch(250 * time.Millisecond)
+		if lib.Watch(time.Second) != events {
+			t.Errorf("Expected the running watcher's channel")
+		}
+
+		for i := 0; i < len(lib.Devices); i++ {
+			dev := lib.Devices[i]
+			rc = dev.Open()
+			if rc != 0 {
+				t.Errorf("Failed to open device. Returned %d", rc)
+			}
+
+			defer dev.Close()
+
+			dev.LED(freenect.GREEN)
+			if rc = dev.AutoReconnect(true); rc != 0 {
+				t.Errorf("Failed to enable reconnection. Returned %d", rc)
+			}
+		}
+
+		timeout := time.After(3 * time.Second)
+		for done := false; !done; {
+			select {
+			case event := <-events:
+				fmt.Printf("Device event %d for serial %s\n", event.Type, event.Serial)
+			case <-timeout:
+				done = true
+			}
+		}
+
+		if rc = lib.StopWatching(); rc != 0 {
+			t.Errorf("Failed to stop watching. Returned %d", rc)
+		}
+	}
+}
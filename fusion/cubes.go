@@ -0,0 +1,232 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fusion
+
+import (
+	"freenect"
+	"freenect/mesh"
+)
+
+// Marching cubes visits each cube of eight neighboring voxels and, from which corners lie behind the surface, places
+// polygons on the cube's edges where the distance crosses zero. Corner i of a cube is offset by bit 0 of i in x, bit
+// 1 in y and bit 2 in z; a cube's configuration has bit i set when corner i is behind the surface.
+//
+// Rather than the usual hand made tables, the polygons of every configuration are worked out once: on each face of
+// the cube the crossings pair up into segments, and the segments of all six faces join up into closed loops. A face
+// with crossings on all four edges is ambiguous; it is always split so that its corners behind the surface are cut
+// off, and as neighboring cubes share the face they agree, so the surface has no cracks.
+
+// The two corners of each of the cube's twelve edges.
+var cubeEdges [12][2]int
+
+// The polygons, as loops of edges, of each configuration.
+var cubePolygons [256][][]int
+
+func init() {
+	edge := map[[2]int]int{}
+	for a := 0; a < 8; a++ {
+		for d := 0; d < 3; d++ {
+			if a&(1<<d) == 0 {
+				edge[[2]int{a, a | 1<<d}] = len(edge)
+				cubeEdges[len(edge)-1] = [2]int{a, a | 1<<d}
+			}
+		}
+	}
+	edgeOf := func(a, b int) int {
+		if a > b {
+			a, b = b, a
+		}
+		return edge[[2]int{a, b}]
+	}
+
+	// the corners of each face, in order around it
+	var faces [][4]int
+	for d := 0; d < 3; d++ {
+		u, v := (d+1)%3, (d+2)%3
+		for s := 0; s < 2; s++ {
+			var corners [4]int
+			for k, uv := range [4][2]int{{0, 0}, {1, 0}, {1, 1}, {0, 1}} {
+				corners[k] = s<<d | uv[0]<<u | uv[1]<<v
+			}
+			faces = append(faces, corners)
+		}
+	}
+
+	for config := 1; config < 255; config++ {
+		behind := func(c int) bool { return config&(1<<c) != 0 }
+
+		// pair the crossings of each face
+		links := map[int][]int{}
+		link := func(a, b int) {
+			links[a] = append(links[a], b)
+			links[b] = append(links[b], a)
+		}
+		for _, f := range faces {
+			var crossings []int
+			for k := 0; k < 4; k++ {
+				if behind(f[k]) != behind(f[(k+1)%4]) {
+					crossings = append(crossings, k)
+				}
+			}
+			switch len(crossings) {
+			case 2:
+				link(edgeOf(f[crossings[0]], f[(crossings[0]+1)%4]), edgeOf(f[crossings[1]], f[(crossings[1]+1)%4]))
+			case 4:
+				// cut off each corner behind the surface: the edges either side of it
+				for k := 0; k < 4; k++ {
+					if behind(f[k]) {
+						link(edgeOf(f[(k+3)%4], f[k]), edgeOf(f[k], f[(k+1)%4]))
+					}
+				}
+			}
+		}
+
+		// every crossed edge lies on two faces, so the segments close into loops
+		seen := map[int]bool{}
+		for e := 0; e < 12; e++ {
+			if len(links[e]) == 0 || seen[e] {
+				continue
+			}
+			loop := []int{e}
+			seen[e] = true
+			prev, cur := -1, e
+			for {
+				next := links[cur][0]
+				if next == prev || seen[next] {
+					next = links[cur][1]
+				}
+				if seen[next] {
+					break
+				}
+				loop = append(loop, next)
+				seen[next] = true
+				prev, cur = cur, next
+			}
+			cubePolygons[config] = append(cubePolygons[config], loop)
+		}
+	}
+}
+
+// Extracts the surface of the volume as a triangle mesh in the world frame, with normals, wound to face the side the
+// surface was seen from. Cubes with a corner that was never observed are skipped.
+func (v *Volume) Mesh() *mesh.Mesh {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	m := &mesh.Mesh{}
+	vertices := map[int]int{}
+	nx, ny, nz := v.Dims[0], v.Dims[1], v.Dims[2]
+
+	// the gradient of the distance at a voxel, pointing away from the surface towards the sensor, from the observed
+	// voxels either side of it
+	gradient := func(x, y, z int) freenect.Vector {
+		axis := func(c, n int, at func(int) int) float64 {
+			lo, hi := c, c
+			if c > 0 && v.weight[at(c-1)] > 0 {
+				lo = c - 1
+			}
+			if c+1 < n && v.weight[at(c+1)] > 0 {
+				hi = c + 1
+			}
+			if lo == hi {
+				return 0
+			}
+			return float64(v.tsdf[at(hi)]-v.tsdf[at(lo)]) / float64(hi-lo)
+		}
+		return freenect.Vector{
+			X:	axis(x, nx, func(c int) int { return v.index(c, y, z) }),
+			Y:	axis(y, ny, func(c int) int { return v.index(x, c, z) }),
+			Z:	axis(z, nz, func(c int) int { return v.index(x, y, c) }),
+		}
+	}
+
+	var values [8]float64
+	var corners [8][3]int
+	for z := 0; z+1 < nz; z++ {
+		for y := 0; y+1 < ny; y++ {
+			for x := 0; x+1 < nx; x++ {
+				config, observed := 0, true
+				for c := 0; c < 8; c++ {
+					corners[c] = [3]int{x + c&1, y + c>>1&1, z + c>>2&1}
+					i := v.index(corners[c][0], corners[c][1], corners[c][2])
+					if v.weight[i] == 0 {
+						observed = false
+						break
+					}
+					values[c] = float64(v.tsdf[i])
+					if values[c] < 0 {
+						config |= 1 << c
+					}
+				}
+				if !observed || config == 0 || config == 255 {
+					continue
+				}
+
+				// the vertex where the distance crosses zero on an edge, shared with the neighboring cubes
+				vertex := func(e int) int {
+					a, b := cubeEdges[e][0], cubeEdges[e][1]
+					ca, cb := corners[a], corners[b]
+					axis := 0
+					for ca[axis] == cb[axis] {
+						axis++
+					}
+					key := v.index(ca[0], ca[1], ca[2])*3 + axis
+					if id, ok := vertices[key]; ok {
+						return id
+					}
+
+					t := values[a] / (values[a] - values[b])
+					pa, pb := v.center(ca[0], ca[1], ca[2]), v.center(cb[0], cb[1], cb[2])
+					ga, gb := gradient(ca[0], ca[1], ca[2]), gradient(cb[0], cb[1], cb[2])
+					id := len(m.Vertices)
+					vertices[key] = id
+					m.Vertices = append(m.Vertices, pa.Add(pb.Sub(pa).Scale(t)))
+					m.Normals = append(m.Normals, ga.Add(gb.Sub(ga).Scale(t)).Unit())
+					return id
+				}
+
+				// the cube's gradient decides which way its polygons face
+				var g freenect.Vector
+				for c := 0; c < 8; c++ {
+					s := func(bit int) float64 { return float64(2*(c>>bit&1) - 1) }
+					g = g.Add(freenect.Vector{X: s(0), Y: s(1), Z: s(2)}.Scale(values[c]))
+				}
+
+				for _, loop := range cubePolygons[config] {
+					ids := make([]int, len(loop))
+					var normal freenect.Vector
+					for i, e := range loop {
+						ids[i] = vertex(e)
+					}
+					for i := 1; i+1 < len(ids); i++ {
+						a, b, c := m.Vertices[ids[0]], m.Vertices[ids[i]], m.Vertices[ids[i+1]]
+						normal = normal.Add(b.Sub(a).Cross(c.Sub(a)))
+					}
+					flip := normal.Dot(g) < 0
+					for i := 1; i+1 < len(ids); i++ {
+						if flip {
+							m.Faces = append(m.Faces, [3]int{ids[0], ids[i+1], ids[i]})
+						} else {
+							m.Faces = append(m.Faces, [3]int{ids[0], ids[i], ids[i+1]})
+						}
+					}
+				}
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fusion_test
+
+import (
+	"math"
+	"testing"
+
+	"freenect"
+	"freenect/fusion"
+)
+
+// Renders the depth, in millimeters, of a ball of the given radius and center in the world, seen from the pose.
+func ball(center freenect.Vector, radius float64, pose freenect.Transform) []uint16 {
+	intr := freenect.DefaultIntrinsics
+	eye := pose.Apply(freenect.Vector{})
+	rotate := freenect.Transform{R: pose.R}
+
+	depth := make([]uint16, 640*480)
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			// the ray through the pixel, in the world, scaled so its camera Z is 1
+			ray := rotate.Apply(freenect.Vector{X: (float64(x) - intr.Cx) / intr.Fx, Y: -(float64(y) - intr.Cy) / intr.Fy, Z: 1})
+			oc := eye.Sub(center)
+			a, b, c := ray.Dot(ray), 2*ray.Dot(oc), oc.Dot(oc)-radius*radius
+			disc := b*b - 4*a*c
+			if disc < 0 {
+				continue
+			}
+			if t := (-b - math.Sqrt(disc)) / (2 * a); t > 0 {
+				depth[y*640+x] = uint16(math.Round(t * 1000))
+			}
+		}
+	}
+	return depth
+}
+
+func TestFusion(t *testing.T) {
+	center := freenect.Vector{X: 0, Y: 0.2, Z: 1.5}
+	radius := 0.3
+	volume := fusion.NewVolume(freenect.Vector{X: -0.5, Y: -0.3, Z: 1}, freenect.Vector{X: 1, Y: 1, Z: 1}, 0.01)
+
+	// sweep the sensor up as a scanning rig would
+	for _, angle := range []float64{-10, 0, 10, 20} {
+		pose := fusion.TiltPose(angle)
+		if err := volume.Integrate(ball(center, radius, pose), 640, 480, freenect.MM, pose); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := volume.Mesh()
+	if len(m.Faces) < 1000 || len(m.Normals) != len(m.Vertices) {
+		t.Fatalf("expected a mesh of the ball, got %d faces", len(m.Faces))
+	}
+	for i, p := range m.Vertices {
+		if d := p.Sub(center).Norm(); math.Abs(d-radius) > 0.01 {
+			t.Fatalf("vertex %d: expected it on the ball, got %f from the center", i, d)
+		}
+		// the normals point out of the ball
+		if n := m.Normals[i]; n.Dot(p.Sub(center).Unit()) < 0.8 {
+			t.Fatalf("vertex %d: expected an outward normal, got %v", i, n)
+		}
+	}
+	for _, f := range m.Faces {
+		a, b, c := m.Vertices[f[0]], m.Vertices[f[1]], m.Vertices[f[2]]
+		if n := b.Sub(a).Cross(c.Sub(a)); n.Norm() > 1e-12 && n.Dot(a.Sub(center)) < 0 {
+			t.Fatalf("expected face %v to face out of the ball", f)
+		}
+	}
+
+	// the side of the ball facing the sensor was seen, the far side was not
+	if d, ok := volume.Distance(50, 50, 19); !ok || d < 0 {
+		t.Errorf("expected free space in front of the ball, got %f", d)
+	}
+	if _, ok := volume.Distance(50, 50, 75); ok {
+		t.Errorf("expected the inside of the ball unobserved")
+	}
+
+	volume.Reset()
+	if m = volume.Mesh(); len(m.Faces) != 0 {
+		t.Errorf("expected an empty volume to have no surface")
+	}
+	if err := volume.Integrate(nil, 640, 480, freenect.MM, freenect.Identity); err != fusion.ErrUnsupportedFormat {
+		t.Errorf("expected a short frame to be refused, got %v", err)
+	}
+}
+
+func TestTiltPose(t *testing.T) {
+	// tilted up, the sensor looks up
+	forward := fusion.TiltPose(30).Apply(freenect.Vector{Z: 1})
+	if math.Abs(forward.Y-0.5) > 1e-9 || math.Abs(forward.Z-math.Sqrt(3)/2) > 1e-9 {
+		t.Errorf("expected the sensor to look 30 degrees up, got %v", forward)
+	}
+	if back := fusion.TiltPose(30).Inverse().Apply(forward); math.Abs(back.Z-1) > 1e-9 {
+		t.Errorf("expected the inverse to undo the pose, got %v", back)
+	}
+}
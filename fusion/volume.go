@@ -0,0 +1,181 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fusion builds a 3D model of a static scene from many depth frames, by integrating them into a truncated
+// signed distance volume and extracting its surface with marching cubes.
+package fusion
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+
+	"freenect"
+)
+
+// Returned for depth in a format that cannot be converted to meters.
+var ErrUnsupportedFormat = errors.New("fusion: unsupported depth format")
+
+// The default settings of a volume.
+const (
+	DefaultTruncation	= 4.0
+	DefaultMaxWeight	= 64.0
+)
+
+// A truncated signed distance volume: a grid of cubic voxels, each holding the distance to the nearest surface seen
+// along the sensor's rays, positive in front of the surface and negative behind it. Distances are truncated to
+// Truncation voxels, and each voxel keeps a weighted average of its measurements, the weight capped at MaxWeight so
+// the model can still follow changes. Intrinsics describe the depth camera; they are scaled to the frame width.
+//
+// The volume covers the box from Origin to Origin plus Dims times VoxelSize, in the world frame the poses of the
+// frames map into. All methods are safe for concurrent use.
+type Volume struct {
+	Origin			freenect.Vector
+	VoxelSize		float64
+	Dims				[3]int
+	Truncation	float64
+	MaxWeight		float64
+	Intrinsics	freenect.Intrinsics
+
+	lock				sync.RWMutex
+	tsdf				[]float32
+	weight			[]float32
+}
+
+// Creates an empty volume covering the box of the given size from the origin, in voxels of the given size, all in
+// meters.
+func NewVolume(origin, size freenect.Vector, voxel float64) *Volume {
+	dims := [3]int{
+		int(math.Ceil(size.X / voxel)),
+		int(math.Ceil(size.Y / voxel)),
+		int(math.Ceil(size.Z / voxel)),
+	}
+	n := dims[0] * dims[1] * dims[2]
+	return &Volume{
+		Origin:			origin,
+		VoxelSize:	voxel,
+		Dims:				dims,
+		Truncation:	DefaultTruncation,
+		MaxWeight:	DefaultMaxWeight,
+		Intrinsics:	freenect.DefaultIntrinsics,
+		tsdf:				make([]float32, n),
+		weight:			make([]float32, n),
+	}
+}
+
+// Empties the volume.
+func (v *Volume) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	clear(v.tsdf)
+	clear(v.weight)
+}
+
+func (v *Volume) index(x, y, z int) int {
+	return (z*v.Dims[1]+y)*v.Dims[0] + x
+}
+
+// Returns the world position of the center of a voxel.
+func (v *Volume) center(x, y, z int) freenect.Vector {
+	return v.Origin.Add(freenect.Vector{X: float64(x) + 0.5, Y: float64(y) + 0.5, Z: float64(z) + 0.5}.Scale(v.VoxelSize))
+}
+
+// Returns the pose of the sensor tilted by the motor to the given angle in degrees, as a transform from the camera
+// frame into a world frame level with the motor's zero position. The few centimeters between the motor axis and the
+// camera are ignored. For the sensor's attitude relative to gravity use Tilt.WorldTransform instead.
+func TiltPose(degrees float64) freenect.Transform {
+	s, c := math.Sincos(degrees * math.Pi / 180)
+	return freenect.Transform{R: [3][3]float64{{1, 0, 0}, {0, c, s}, {0, -s, c}}}
+}
+
+// Integrates a depth image of the given size and format, taken by the sensor at the pose: the transform from the
+// camera frame into the world frame.
+func (v *Volume) Integrate(depth []uint16, width, height int, format freenect.DepthFormat, pose freenect.Transform) error {
+	convert := freenect.MetersConverter(format)
+	if convert == nil || len(depth) < width*height {
+		return ErrUnsupportedFormat
+	}
+	meters := make([]float64, width*height)
+	for i := range meters {
+		meters[i] = convert(depth[i])
+	}
+
+	scale := float64(width) / 640
+	intr := freenect.Intrinsics{Fx: v.Intrinsics.Fx * scale, Fy: v.Intrinsics.Fy * scale, Cx: v.Intrinsics.Cx * scale, Cy: v.Intrinsics.Cy * scale}
+	toCamera := pose.Inverse()
+	trunc := v.Truncation * v.VoxelSize
+	maxWeight := float32(v.MaxWeight)
+	if maxWeight <= 0 {
+		maxWeight = DefaultMaxWeight
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// each worker takes every n-th slice of the volume
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			for z := first; z < v.Dims[2]; z += workers {
+				for y := 0; y < v.Dims[1]; y++ {
+					for x := 0; x < v.Dims[0]; x++ {
+						p := toCamera.Apply(v.center(x, y, z))
+						if p.Z <= 0 {
+							continue
+						}
+						u := int(math.Round(intr.Fx*p.X/p.Z + intr.Cx))
+						r := int(math.Round(intr.Cy - intr.Fy*p.Y/p.Z))
+						if u < 0 || u >= width || r < 0 || r >= height {
+							continue
+						}
+						d := meters[r*width+u]
+						if math.IsNaN(d) {
+							continue
+						}
+
+						// the distance along the ray, unseen beyond the truncation behind the surface
+						sdf := d - p.Z
+						if sdf < -trunc {
+							continue
+						}
+						value := float32(math.Min(1, sdf/trunc))
+						i := v.index(x, y, z)
+						wt := v.weight[i]
+						v.tsdf[i] = (v.tsdf[i]*wt + value) / (wt + 1)
+						v.weight[i] = min(wt+1, maxWeight)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Returns the distance stored in a voxel, in meters, and whether the voxel has been observed.
+func (v *Volume) Distance(x, y, z int) (float64, bool) {
+	if x < 0 || x >= v.Dims[0] || y < 0 || y >= v.Dims[1] || z < 0 || z >= v.Dims[2] {
+		return 0, false
+	}
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	i := v.index(x, y, z)
+	return float64(v.tsdf[i]) * v.Truncation * v.VoxelSize, v.weight[i] > 0
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"sync"
+	"time"
+)
+
+// The kinds of device event published by the watcher.
+type DeviceEventType int
+
+const (
+	DeviceAdded					= DeviceEventType(iota)
+	DeviceRemoved
+	DeviceReconnected
+)
+
+// A change in the attached devices. Device is the context's device with the serial number; for an addition of a
+// serial number not seen before it is a new device, ready to Open. It is nil for the removal of an unknown device.
+type DeviceEvent struct {
+	Type		DeviceEventType
+	Serial	string
+	Device	*Device
+}
+
+const (
+	watchInterval		= time.Second
+	watchBacklog		= 64
+	loopBackoff			= 100 * time.Millisecond
+)
+
+type deviceWatcher struct {
+	lock			sync.Mutex
+	stop			chan bool
+	done			chan bool
+	events		chan DeviceEvent
+	serials		[]string
+	reconnect	map[*Device]bool
+}
+
+// Starts re-enumerating the attached devices every interval and returns the channel on which additions and removals
+// are published. If the watcher is already running the interval is ignored and the same channel is returned.
+// Events are dropped if the channel is not being read. StopWatching closes the channel.
+func (freenect *Freenect) Watch(interval time.Duration) <-chan DeviceEvent {
+	if interval <= 0 {
+		interval = watchInterval
+	}
+
+	w := freenect.watcher
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.stop != nil {
+		return w.events
+	}
+
+	w.serials = freenect.backend.devices()
+	w.stop, w.done = make(chan bool), make(chan bool)
+	w.events = make(chan DeviceEvent, watchBacklog)
+	go func(stop, done chan bool, events chan DeviceEvent) {
+		defer close(done)
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.poll(freenect, events)
+			}
+		}
+	}(w.stop, w.done, w.events)
+
+	return w.events
+}
+
+// Stops the watcher and closes its channel. Devices with AutoReconnect enabled are no longer reconnected.
+// Returns 1 if it was not running.
+func (freenect *Freenect) StopWatching() int {
+	w := freenect.watcher
+	w.lock.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done, w.events = nil, nil, nil
+	w.lock.Unlock()
+
+	if stop == nil {
+		return 1
+	}
+	close(stop)
+	<-done
+	return 0
+}
+
+// Enables or disables automatic reconnection of an opened device. When the device disappears from the bus it is
+// closed, and once a device with the same serial number is seen again it is reopened with its camera modes, running
+// streams, LED, flags and tilt angle restored. Starts the watcher with a default interval if it is not already running.
+// Returns -998 if the device serial number is unknown.
+func (device *Device) AutoReconnect(enable bool) int {
+	if device.serial == "" {
+		return -998
+	}
+
+	w := device.freenect.watcher
+	w.lock.Lock()
+	if w.reconnect == nil {
+		w.reconnect = map[*Device]bool{}
+	}
+	if enable {
+		w.reconnect[device] = true
+	} else {
+		delete(w.reconnect, device)
+	}
+	w.lock.Unlock()
+
+	if enable {
+		device.freenect.Watch(watchInterval)
+	}
+	return 0
+}
+
+func (w *deviceWatcher) forget(device *Device) {
+	w.lock.Lock()
+	delete(w.reconnect, device)
+	w.lock.Unlock()
+}
+
+// Compares the attached devices with the previous enumeration, publishes the differences and handles reconnection.
+func (w *deviceWatcher) poll(freenect *Freenect, events chan DeviceEvent) {
+	current := freenect.backend.devices()
+
+	w.lock.Lock()
+	previous := w.serials
+	w.serials = current
+	devices := []*Device{}
+	for device := range w.reconnect {
+		devices = append(devices, device)
+	}
+	w.lock.Unlock()
+
+	for _, serial := range missing(previous, current) {
+		device := freenect.lookup(serial)
+		freenect.structured().Info("device removed", "serial", serial)
+		publish(events, DeviceEvent{Type: DeviceRemoved, Serial: serial, Device: device})
+	}
+	for _, serial := range missing(current, previous) {
+		device := freenect.deviceFor(serial)
+		freenect.structured().Info("device added", "serial", serial, "device", device.index)
+		publish(events, DeviceEvent{Type: DeviceAdded, Serial: serial, Device: device})
+	}
+
+	for _, device := range devices {
+		present := false
+		for _, serial := range current {
+			present = present || serial == device.serial
+		}
+
+		device.lock.Lock()
+		lost := device.lost
+		device.lock.Unlock()
+
+		switch {
+		case !present && !lost:
+			device.log().Warn("device lost")
+			device.lose()
+		case present && lost:
+			rc := device.reconnect()
+			if rc != 0 {
+				// try again on the next poll
+				device.log().Warn("failed to reconnect device", "rc", rc)
+				continue
+			}
+			device.log().Info("device reconnected")
+			publish(events, DeviceEvent{Type: DeviceReconnected, Serial: device.serial, Device: device})
+		}
+	}
+}
+
+func publish(events chan DeviceEvent, event DeviceEvent) {
+	select {
+	case events <- event:
+	default:
+	}
+}
+
+// Reopens a lost device and restores the state it had.
+func (device *Device) reconnect() int {
+	rc := device.reopen()
+	if rc != 0 {
+		return rc
+	}
+
+	if camera := device.videoCamera(); camera != nil {
+		if rc = camera.resume(); rc != 0 {
+			device.log().Warn("failed to restore video stream", "rc", rc)
+		}
+	}
+	if camera := device.depthCamera(); camera != nil {
+		if rc = camera.resume(); rc != 0 {
+			device.log().Warn("failed to restore depth stream", "rc", rc)
+		}
+	}
+
+	device.leds.lock.Lock()
+	device.setLED(device.leds.current)
+	device.leds.lock.Unlock()
+
+	device.lock.Lock()
+	for flag, on := range device.flags {
+		if device.dev != nil {
+			device.dev.setFlag(flag, on)
+		}
+	}
+	device.lock.Unlock()
+
+	device.lock.Lock()
+	tilt := device.tilt
+	device.lock.Unlock()
+	if tilt != nil {
+		tilt.lock.Lock()
+		target, aimed := tilt.target, tilt.aimed
+		tilt.lock.Unlock()
+		if aimed {
+			tilt.SetAngle(target)
+		}
+	}
+	return 0
+}
+
+// Returns the serial numbers in a that are not in b, counting duplicates.
+func missing(a, b []string) []string {
+	count := map[string]int{}
+	for _, s := range b {
+		count[s]++
+	}
+	result := []string{}
+	for _, s := range a {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"sync"
+	"time"
+)
+
+// A single step of an LED pattern: the option to show and how long to hold it.
+type LEDStep struct {
+	Option		LEDOption
+	Duration	time.Duration
+}
+
+// A sequence of LED steps. A repeating pattern plays until stopped; otherwise the LED returns to its previous
+// state once the last step has elapsed.
+type LEDPattern struct {
+	Steps		[]LEDStep
+	Repeat	bool
+}
+
+// The named patterns available to PlayLED. Use RegisterLEDPattern to define your own.
+var ledPatterns = map[string]LEDPattern{
+	"recording": {
+		Steps:	[]LEDStep{{RED, 500 * time.Millisecond}, {OFF, 500 * time.Millisecond}},
+		Repeat:	true,
+	},
+	"error": {
+		Steps:	[]LEDStep{{RED, 150 * time.Millisecond}, {OFF, 150 * time.Millisecond}, {RED, 150 * time.Millisecond}, {OFF, 800 * time.Millisecond}},
+		Repeat:	true,
+	},
+	"calibrating": {
+		Steps:	[]LEDStep{{YELLOW, 300 * time.Millisecond}, {GREEN, 300 * time.Millisecond}},
+		Repeat:	true,
+	},
+	"ready": {
+		Steps:	[]LEDStep{{GREEN, 2 * time.Second}},
+	},
+}
+
+var ledPatternsLock sync.RWMutex
+
+// Adds a named pattern for PlayLED, or replaces the one of that name, such as the built in "recording", "error",
+// "calibrating" and "ready". Safe to call while patterns are playing. Returns ErrLEDPattern if the pattern has no
+// steps or a step of zero or negative duration.
+func RegisterLEDPattern(name string, pattern LEDPattern) error {
+	if !pattern.valid() {
+		return ErrLEDPattern
+	}
+	pattern.Steps = append([]LEDStep(nil), pattern.Steps...)
+	ledPatternsLock.Lock()
+	defer ledPatternsLock.Unlock()
+	ledPatterns[name] = pattern
+	return nil
+}
+
+// Reports whether the pattern can be played: it has steps, and each is held for some time, so a repeating pattern
+// does not spin on the LED.
+func (pattern LEDPattern) valid() bool {
+	for _, step := range pattern.Steps {
+		if step.Duration <= 0 {
+			return false
+		}
+	}
+	return len(pattern.Steps) > 0
+}
+
+type ledSequencer struct {
+	lock		sync.Mutex
+	current	LEDOption
+	stop		chan bool
+	done		chan bool
+}
+
+// Plays the named pattern, built in or registered with RegisterLEDPattern, in the background, replacing any pattern
+// already playing. The LED state in effect before the first pattern started is restored when the pattern ends or StopLED is called.
+func (device *Device) PlayLED(name string) int {
+	ledPatternsLock.RLock()
+	pattern, ok := ledPatterns[name]
+	ledPatternsLock.RUnlock()
+	if !ok {
+		return -998
+	}
+	return device.PlayLEDPattern(pattern)
+}
+
+// Plays an arbitrary pattern in the background. See PlayLED. The steps are copied, so the pattern may be changed
+// while it plays. Returns -998 if the pattern has no steps or a step of zero or negative duration.
+func (device *Device) PlayLEDPattern(pattern LEDPattern) int {
+	if !pattern.valid() {
+		return -998
+	}
+	steps := append([]LEDStep(nil), pattern.Steps...)
+
+	leds := device.leds
+	leds.lock.Lock()
+	defer leds.lock.Unlock()
+	leds.halt()
+
+	stop, done := make(chan bool), make(chan bool)
+	leds.stop, leds.done = stop, done
+	restore := leds.current
+
+	go func() {
+		defer close(done)
+		for {
+			for _, step := range steps {
+				device.setLED(step.Option)
+				select {
+				case <-stop:
+					device.setLED(restore)
+					return
+				case <-time.After(step.Duration):
+				}
+			}
+			if !pattern.Repeat {
+				device.setLED(restore)
+				return
+			}
+		}
+	}()
+	return 0
+}
+
+// Stops the playing pattern and restores the LED to the state it had before. Returns 1 if no pattern is playing.
+func (device *Device) StopLED() int {
+	leds := device.leds
+	leds.lock.Lock()
+	defer leds.lock.Unlock()
+	if !leds.halt() {
+		return 1
+	}
+	return 0
+}
+
+// Stops the playing pattern, if any, and waits for it to restore the LED. Must be called with the lock held.
+func (leds *ledSequencer) halt() bool {
+	if leds.stop == nil {
+		return false
+	}
+
+	playing := true
+	select {
+	case <-leds.done:
+		playing = false
+	default:
+	}
+
+	close(leds.stop)
+	<-leds.done
+	leds.stop, leds.done = nil, nil
+	return playing
+}
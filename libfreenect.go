@@ -0,0 +1,281 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+/*
+#include <stdlib.h>
+#include <libfreenect/libfreenect.h>
+
+void registerLogCallback(freenect_context* ctx);
+void registerVideoCallback(freenect_device* dev);
+void registerDepthCallback(freenect_device* dev);
+
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// The backend driving real hardware through libfreenect. Only one may exist at a time.
+type libfreenect struct {
+	ctx 			*C.freenect_context
+	freenect	*Freenect
+}
+
+type libfreenectDevice struct {
+	dev				*C.freenect_device
+}
+
+// The libfreenect context in use, which receives the library's log messages.
+var _freenect *libfreenect = nil
+
+// Opened devices keyed by their libfreenect handle, used to route callbacks. Storing Go pointers in libfreenect's
+// user data would violate the cgo pointer passing rules.
+var _devices = map[*C.freenect_device]*Device{}
+var _lock sync.Mutex
+
+// Timeout of each round of event processing, so Shutdown is noticed promptly.
+const eventTimeout = 10000
+
+func openLibfreenect() (*libfreenect, int) {
+	_lock.Lock()
+	defer _lock.Unlock()
+	if _freenect != nil {
+		return nil, -999
+	}
+
+	var ctx *C.freenect_context
+	rc := int(C.freenect_init(&ctx, nil))
+	if rc != 0 {
+		return nil, rc
+	}
+
+	C.freenect_select_subdevices(ctx, (C.freenect_device_flags)(C.FREENECT_DEVICE_MOTOR | C.FREENECT_DEVICE_CAMERA))
+	C.registerLogCallback(ctx)
+
+	_freenect = &libfreenect{ctx: ctx}
+	return _freenect, 0
+}
+
+func (lib *libfreenect) attach(freenect *Freenect) {
+	_lock.Lock()
+	defer _lock.Unlock()
+	lib.freenect = freenect
+}
+
+// Reads the camera serial numbers of the attached devices, in device index order.
+func (lib *libfreenect) devices() []string {
+	serials := make([]string, int(C.freenect_num_devices(lib.ctx)))
+
+	var list *C.struct_freenect_device_attributes
+	if C.freenect_list_device_attributes(lib.ctx, &list) < 0 {
+		return serials
+	}
+	defer C.freenect_free_device_attributes(list)
+
+	x := 0
+	for attr := list; attr != nil; attr = attr.next {
+		if x < len(serials) {
+			serials[x] = C.GoString(attr.camera_serial)
+		} else {
+			serials = append(serials, C.GoString(attr.camera_serial))
+		}
+		x++
+	}
+	return serials[:x]
+}
+
+func (lib *libfreenect) open(index int, serial string, owner *Device) (deviceBackend, int) {
+	var dev *C.freenect_device
+	var rc int
+	if index >= 0 {
+		rc = int(C.freenect_open_device(lib.ctx, &dev, C.int(index)))
+	} else {
+		s := C.CString(serial)
+		defer C.free(unsafe.Pointer(s))
+		rc = int(C.freenect_open_device_by_camera_serial(lib.ctx, &dev, s))
+	}
+	if rc != 0 {
+		return nil, rc
+	}
+
+	_lock.Lock()
+	_devices[dev] = owner
+	_lock.Unlock()
+	return &libfreenectDevice{dev}, 0
+}
+
+func (lib *libfreenect) process() int {
+	var to C.struct_timeval
+	to.tv_sec = 0
+	to.tv_usec = eventTimeout
+	return int(C.freenect_process_events_timeout(lib.ctx, &to))
+}
+
+func (lib *libfreenect) setLogLevel(level LoggerLevel) {
+	C.freenect_set_log_level(lib.ctx, C.freenect_loglevel(level))
+}
+
+func (lib *libfreenect) shutdown() int {
+	_lock.Lock()
+	_freenect = nil
+	_lock.Unlock()
+	return int(C.freenect_shutdown(lib.ctx))
+}
+
+func (d *libfreenectDevice) close() int {
+	_lock.Lock()
+	delete(_devices, d.dev)
+	_lock.Unlock()
+	return int(C.freenect_close_device(d.dev))
+}
+
+func (d *libfreenectDevice) setLED(option LEDOption) int {
+	return int(C.freenect_set_led(d.dev, C.freenect_led_options(option)))
+}
+
+func (d *libfreenectDevice) setFlag(flag Flag, on bool) int {
+	value := C.FREENECT_OFF
+	if on {
+		value = C.FREENECT_ON
+	}
+	return int(C.freenect_set_flag(d.dev, C.freenect_flag(flag), C.freenect_flag_value(value)))
+}
+
+func (d *libfreenectDevice) tiltState() (TiltState, int) {
+	rc := int(C.freenect_update_tilt_state(d.dev))
+	if rc < 0 {
+		return TiltState{}, rc
+	}
+	state := C.freenect_get_tilt_state(d.dev)
+
+	var x, y, z C.double
+	C.freenect_get_mks_accel(state, &x, &y, &z)
+	return TiltState{
+		Angle:		float32(C.freenect_get_tilt_degs(state)),
+		Status:		int(C.freenect_get_tilt_status(state)),
+		AccelX:		float32(x),
+		AccelY:		float32(y),
+		AccelZ:		float32(z),
+	}, 0
+}
+
+func (d *libfreenectDevice) setTilt(deg float64) int {
+	return int(C.freenect_set_tilt_degs(d.dev, C.double(deg)))
+}
+
+func (d *libfreenectDevice) setVideoMode(res Resolution, format VideoFormat) (frameMode, int) {
+	mode := C.freenect_find_video_mode(C.freenect_resolution(res), C.freenect_video_format(format))
+	if mode.is_valid == 0 {
+		return frameMode{}, -999
+	}
+
+	rc := int(C.freenect_set_video_mode(d.dev, mode))
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+
+	C.registerVideoCallback(d.dev)
+	return frameMode{int(mode.bytes), int(mode.width), int(mode.height)}, 0
+}
+
+func (d *libfreenectDevice) setDepthMode(res Resolution, format DepthFormat) (frameMode, int) {
+	mode := C.freenect_find_depth_mode(C.freenect_resolution(res), C.freenect_depth_format(format))
+	if mode.is_valid == 0 {
+		return frameMode{}, -999
+	}
+
+	rc := int(C.freenect_set_depth_mode(d.dev, mode))
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+
+	C.registerDepthCallback(d.dev)
+	return frameMode{int(mode.bytes), int(mode.width), int(mode.height)}, 0
+}
+
+func (d *libfreenectDevice) setVideoBuffer(buffer unsafe.Pointer) int {
+	return int(C.freenect_set_video_buffer(d.dev, buffer))
+}
+
+func (d *libfreenectDevice) setDepthBuffer(buffer unsafe.Pointer) int {
+	return int(C.freenect_set_depth_buffer(d.dev, buffer))
+}
+
+func (d *libfreenectDevice) startVideo() int {
+	return int(C.freenect_start_video(d.dev))
+}
+
+func (d *libfreenectDevice) stopVideo() int {
+	return int(C.freenect_stop_video(d.dev))
+}
+
+func (d *libfreenectDevice) startDepth() int {
+	return int(C.freenect_start_depth(d.dev))
+}
+
+func (d *libfreenectDevice) stopDepth() int {
+	return int(C.freenect_stop_depth(d.dev))
+}
+
+// Returns the device owning a libfreenect handle, and the context to report to if there is none.
+func lookupDevice(dev unsafe.Pointer) (*Device, *Freenect) {
+	_lock.Lock()
+	defer _lock.Unlock()
+
+	var freenect *Freenect
+	if _freenect != nil {
+		freenect = _freenect.freenect
+	}
+	return _devices[(*C.freenect_device)(dev)], freenect
+}
+
+//export logCallback
+func logCallback(ctx unsafe.Pointer, level C.freenect_loglevel, msg *C.char) {
+	_lock.Lock()
+	var freenect *Freenect
+	if _freenect != nil {
+		freenect = _freenect.freenect
+	}
+	_lock.Unlock()
+
+	if freenect != nil {
+		freenect.libraryLog(LoggerLevel(level), C.GoString(msg))
+	}
+}
+
+//export videoCallback
+func videoCallback(dev unsafe.Pointer, frame unsafe.Pointer, timestamp C.uint32_t) {
+	device, freenect := lookupDevice(dev)
+	if device == nil {
+		reportError(freenect, &StreamError{Stream: "video", Err: ErrNoCamera})
+		return
+	}
+	device.videoFrame(frame, uint32(timestamp))
+}
+
+//export depthCallback
+func depthCallback(dev unsafe.Pointer, frame unsafe.Pointer, timestamp C.uint32_t) {
+	device, freenect := lookupDevice(dev)
+	if device == nil {
+		reportError(freenect, &StreamError{Stream: "depth", Err: ErrNoCamera})
+		return
+	}
+	device.depthFrame(frame, uint32(timestamp))
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"log/slog"
+)
+
+var discard = slog.New(slog.DiscardHandler)
+
+// Maps a libfreenect log level onto the closest slog level. The levels below debug are mapped below slog's debug level.
+func slogLevel(level LoggerLevel) slog.Level {
+	switch level {
+	case LogFatal:
+		return slog.LevelError + 4
+	case LogError:
+		return slog.LevelError
+	case LogWarning:
+		return slog.LevelWarn
+	case LogNotice:
+		return slog.LevelInfo + 2
+	case LogInfo:
+		return slog.LevelInfo
+	case LogDebug:
+		return slog.LevelDebug
+	case LogSpew:
+		return slog.LevelDebug - 2
+	}
+	return slog.LevelDebug - 4
+}
+
+func (device *Device) log() *slog.Logger {
+	logger := device.freenect.structured()
+	if logger == discard {
+		return discard
+	}
+	return logger.With("device", device.index, "serial", device.serial)
+}
+
+func (s *stream) log() *slog.Logger {
+	logger := s.device.log()
+	if logger == discard {
+		return discard
+	}
+	return logger.With("stream", s.name)
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mesh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"freenect"
+)
+
+// The name of the material written to MTL files.
+const material = "scan"
+
+// Writes the mesh in Wavefront OBJ format. If mtl is not empty the OBJ refers to the material library of that name,
+// as written by WriteMTL.
+func (m *Mesh) WriteOBJ(w io.Writer, mtl string) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# %d vertices, %d faces\n", len(m.Vertices), len(m.Faces))
+	if mtl != "" {
+		fmt.Fprintf(out, "mtllib %s\nusemtl %s\n", mtl, material)
+	}
+
+	for _, v := range m.Vertices {
+		fmt.Fprintf(out, "v %g %g %g\n", v.X, v.Y, v.Z)
+	}
+	uvs := len(m.UVs) == len(m.Vertices) && len(m.UVs) > 0
+	for _, uv := range m.UVs {
+		fmt.Fprintf(out, "vt %g %g\n", uv[0], uv[1])
+	}
+	normals := len(m.Normals) == len(m.Vertices) && len(m.Normals) > 0
+	for _, n := range m.Normals {
+		n = written(n)
+		fmt.Fprintf(out, "vn %g %g %g\n", n.X, n.Y, n.Z)
+	}
+
+	// OBJ indices start at one
+	for _, f := range m.Faces {
+		out.WriteString("f")
+		for _, i := range f {
+			switch {
+			case uvs && normals:
+				fmt.Fprintf(out, " %d/%d/%d", i+1, i+1, i+1)
+			case uvs:
+				fmt.Fprintf(out, " %d/%d", i+1, i+1)
+			case normals:
+				fmt.Fprintf(out, " %d//%d", i+1, i+1)
+			default:
+				fmt.Fprintf(out, " %d", i+1)
+			}
+		}
+		out.WriteString("\n")
+	}
+	return out.Flush()
+}
+
+// Returns the normal to write for a vertex. Neither OBJ nor PLY has a missing value, so a vertex without a normal is
+// pointed at the sensor.
+func written(n freenect.Vector) freenect.Vector {
+	if !n.Valid() {
+		return freenect.Vector{X: 0, Y: 0, Z: -1}
+	}
+	return n
+}
+
+// Writes the material library for an OBJ file. If texture is not empty the material maps the image file of that name.
+func (m *Mesh) WriteMTL(w io.Writer, texture string) error {
+	_, err := fmt.Fprintf(w, "newmtl %s\nKa 1 1 1\nKd 1 1 1\nKs 0 0 0\nillum 1\n", material)
+	if err == nil && texture != "" {
+		_, err = fmt.Fprintf(w, "map_Kd %s\n", texture)
+	}
+	return err
+}
+
+// Writes the mesh in binary little endian PLY format, with vertex normals, colors and texture coordinates where the
+// mesh has them.
+func (m *Mesh) WritePLY(w io.Writer) error {
+	normals := len(m.Normals) == len(m.Vertices)
+	colors := len(m.Colors) == len(m.Vertices)
+	uvs := len(m.UVs) == len(m.Vertices)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "ply\nformat binary_little_endian 1.0\nelement vertex %d\n", len(m.Vertices))
+	out.WriteString("property float x\nproperty float y\nproperty float z\n")
+	if normals {
+		out.WriteString("property float nx\nproperty float ny\nproperty float nz\n")
+	}
+	if colors {
+		out.WriteString("property uchar red\nproperty uchar green\nproperty uchar blue\n")
+	}
+	if uvs {
+		out.WriteString("property float s\nproperty float t\n")
+	}
+	fmt.Fprintf(out, "element face %d\nproperty list uchar int vertex_indices\nend_header\n", len(m.Faces))
+
+	buf := make([]byte, 0, 64)
+	float := func(v float64) {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+	}
+	for i, v := range m.Vertices {
+		buf = buf[:0]
+		float(v.X)
+		float(v.Y)
+		float(v.Z)
+		if normals {
+			n := written(m.Normals[i])
+			float(n.X)
+			float(n.Y)
+			float(n.Z)
+		}
+		if colors {
+			buf = append(buf, m.Colors[i].R, m.Colors[i].G, m.Colors[i].B)
+		}
+		if uvs {
+			float(m.UVs[i][0])
+			float(m.UVs[i][1])
+		}
+		out.Write(buf)
+	}
+	for _, f := range m.Faces {
+		buf = append(buf[:0], 3)
+		for _, i := range f {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(i))
+		}
+		out.Write(buf)
+	}
+	return out.Flush()
+}
+
+// Saves the mesh as an OBJ file at the path, with its material library next to it and, if the mesh has a texture,
+// the texture as a PNG image: scan.obj, scan.mtl and scan.png for the path scan.obj.
+func (m *Mesh) SaveOBJ(path string) error {
+	base := path[:len(path)-len(filepath.Ext(path))]
+	mtl, texture := base+".mtl", ""
+	if m.Texture != nil {
+		texture = base + ".png"
+		if err := writeFile(texture, func(w io.Writer) error { return png.Encode(w, m.Texture) }); err != nil {
+			return err
+		}
+		texture = filepath.Base(texture)
+	}
+	if err := writeFile(mtl, func(w io.Writer) error { return m.WriteMTL(w, texture) }); err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error { return m.WriteOBJ(w, filepath.Base(mtl)) })
+}
+
+// Saves the mesh as a binary PLY file at the path.
+func (m *Mesh) SavePLY(path string) error {
+	return writeFile(path, m.WritePLY)
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package mesh turns depth frames into triangle meshes and writes them in formats 3D tools read: OBJ with an MTL
+// material and texture, and binary PLY.
+package mesh
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"freenect"
+)
+
+// A triangle mesh. Faces index Vertices, wound counter-clockwise as seen from the front. Normals, UVs and Colors are
+// optional; when present they hold one entry per vertex. UVs run from 0,0 at the bottom left of Texture to 1,1 at its
+// top right.
+type Mesh struct {
+	Vertices	[]freenect.Vector
+	Normals		[]freenect.Vector
+	UVs				[][2]float64
+	Colors		[]color.RGBA
+	Faces			[][3]int
+	Texture		image.Image
+}
+
+// Returned for depth in a format that cannot be converted to meters.
+var ErrUnsupportedFormat = errors.New("mesh: unsupported depth format")
+
+// Returned when texturing a mesh without texture coordinates.
+var ErrNoUVs = errors.New("mesh: mesh has no texture coordinates")
+
+// The default settings of a triangulator.
+const (
+	DefaultMaxJump	= 0.05
+	DefaultStep			= 1
+)
+
+// Triangulates the organized grid of a point cloud: each square of four neighboring points becomes two triangles
+// facing the sensor. A triangle whose depths span more than MaxJump, as a fraction of its nearest depth, bridges a
+// discontinuity, such as between a person and the wall behind, and is skipped. Step takes every Step-th point of
+// every Step-th row, for lighter meshes.
+type Triangulator struct {
+	MaxJump	float64
+	Step		int
+}
+
+// Creates a triangulator with the default settings.
+func NewTriangulator() *Triangulator {
+	return &Triangulator{MaxJump: DefaultMaxJump, Step: DefaultStep}
+}
+
+// Returns the mesh of the cloud's surface. Every vertex gets texture coordinates from its pixel, so a video frame
+// aligned with the depth, as with the REGISTERED format, can be applied with SetTexture. The cloud's normals, if
+// estimated, are carried over. A cloud with fewer points than its size yields an empty mesh.
+func (t *Triangulator) Triangulate(cloud freenect.PointCloud) *Mesh {
+	step := max(t.Step, 1)
+	w, h := cloud.Width, cloud.Height
+	m := &Mesh{}
+	if w <= 0 || h <= 0 || len(cloud.Points) < w*h {
+		return m
+	}
+	normals := len(cloud.Normals) >= w*h
+
+	// vertices are added as faces first use them
+	index := make([]int32, w*h)
+	for i := range index {
+		index[i] = -1
+	}
+	vertex := func(x, y int) int {
+		i := y*w + x
+		if v := index[i]; v >= 0 {
+			return int(v)
+		}
+		v := len(m.Vertices)
+		index[i] = int32(v)
+		m.Vertices = append(m.Vertices, cloud.Points[i])
+		m.UVs = append(m.UVs, [2]float64{(float64(x) + 0.5) / float64(w), 1 - (float64(y)+0.5)/float64(h)})
+		if normals {
+			m.Normals = append(m.Normals, cloud.Normals[i])
+		}
+		return v
+	}
+	connected := func(corners ...[2]int) bool {
+		near, far := math.Inf(1), math.Inf(-1)
+		for _, c := range corners {
+			p := cloud.Points[c[1]*w+c[0]]
+			if !p.Valid() {
+				return false
+			}
+			near, far = math.Min(near, p.Z), math.Max(far, p.Z)
+		}
+		return t.MaxJump <= 0 || far-near <= t.MaxJump*near
+	}
+
+	for y := 0; y+step < h; y += step {
+		for x := 0; x+step < w; x += step {
+			a, b, c, d := [2]int{x, y}, [2]int{x, y + step}, [2]int{x + step, y}, [2]int{x + step, y + step}
+			if connected(a, c, b) {
+				m.Faces = append(m.Faces, [3]int{vertex(a[0], a[1]), vertex(c[0], c[1]), vertex(b[0], b[1])})
+			}
+			if connected(c, d, b) {
+				m.Faces = append(m.Faces, [3]int{vertex(c[0], c[1]), vertex(d[0], d[1]), vertex(b[0], b[1])})
+			}
+		}
+	}
+	return m
+}
+
+// Returns the mesh of a depth image of the given size and format, projected with the intrinsics.
+func (t *Triangulator) TriangulateDepth(depth []uint16, width, height int, format freenect.DepthFormat, intr freenect.Intrinsics) (*Mesh, error) {
+	points := freenect.DepthToPoints(depth, width, height, intr, freenect.MetersConverter(format))
+	if points.Points == nil {
+		return nil, ErrUnsupportedFormat
+	}
+	return t.Triangulate(points), nil
+}
+
+// Applies an image as the mesh's texture and colors each vertex with the pixel under it, for formats carrying
+// vertex colors rather than textures.
+func (m *Mesh) SetTexture(img image.Image) error {
+	if len(m.UVs) != len(m.Vertices) {
+		return ErrNoUVs
+	}
+	m.Texture = img
+	bounds := img.Bounds()
+	m.Colors = make([]color.RGBA, len(m.Vertices))
+	for i, uv := range m.UVs {
+		x := bounds.Min.X + min(int(uv[0]*float64(bounds.Dx())), bounds.Dx()-1)
+		y := bounds.Min.Y + min(int((1-uv[1])*float64(bounds.Dy())), bounds.Dy()-1)
+		m.Colors[i] = color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+	return nil
+}
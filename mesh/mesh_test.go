@@ -0,0 +1,147 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mesh_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"freenect"
+	"freenect/mesh"
+)
+
+// A 3x3 depth image: a wall at 1m with a hole in one corner and an object 0.5m nearer in another.
+var depth = []uint16{
+	1000, 1000, 0,
+	1000, 1000, 1000,
+	1000, 1000, 500,
+}
+
+func TestTriangulate(t *testing.T) {
+	m, err := mesh.NewTriangulator().TriangulateDepth(depth, 3, 3, freenect.MM, freenect.DefaultIntrinsics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// of the eight triangles, one touches the hole and two the object
+	if len(m.Faces) != 5 {
+		t.Fatalf("expected 5 faces, got %d", len(m.Faces))
+	}
+	if len(m.Vertices) != 7 || len(m.UVs) != 7 {
+		t.Errorf("expected the 7 wall points as vertices, got %d", len(m.Vertices))
+	}
+	for _, f := range m.Faces {
+		a, b, c := m.Vertices[f[0]], m.Vertices[f[1]], m.Vertices[f[2]]
+		if n := b.Sub(a).Cross(c.Sub(a)); n.Z >= 0 {
+			t.Errorf("expected face %v to face the sensor, got normal %v", f, n)
+		}
+	}
+	if uv := m.UVs[0]; uv[0] != 0.5/3 || uv[1] != 1-0.5/3 {
+		t.Errorf("expected the first vertex at the top left of the texture, got %v", uv)
+	}
+
+	// the texture colors the vertices
+	img := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	img.SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+	if err = m.SetTexture(img); err != nil {
+		t.Fatal(err)
+	}
+	if m.Colors[0] != (color.RGBA{255, 0, 0, 255}) || m.Colors[1] != (color.RGBA{}) {
+		t.Errorf("expected the top left vertex red, got %v and %v", m.Colors[0], m.Colors[1])
+	}
+
+	if _, err = mesh.NewTriangulator().TriangulateDepth(depth, 3, 3, freenect.D11BIT_PACKED, freenect.DefaultIntrinsics); err != mesh.ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	// a cloud short of its size, or with too few normals, is not indexed past its end
+	short := freenect.PointCloud{Width: 3, Height: 3, Points: make([]freenect.Vector, 4)}
+	if m = mesh.NewTriangulator().Triangulate(short); len(m.Faces) != 0 {
+		t.Errorf("expected no faces from a short cloud, got %d", len(m.Faces))
+	}
+	cloud := freenect.DepthToPoints(depth, 3, 3, freenect.DefaultIntrinsics, freenect.MillimetersToMeters)
+	cloud.Normals = make([]freenect.Vector, 4)
+	if m = mesh.NewTriangulator().Triangulate(cloud); len(m.Faces) != 5 || m.Normals != nil {
+		t.Errorf("expected the faces without normals, got %d faces and %d normals", len(m.Faces), len(m.Normals))
+	}
+}
+
+func TestExport(t *testing.T) {
+	m, _ := mesh.NewTriangulator().TriangulateDepth(depth, 3, 3, freenect.MM, freenect.DefaultIntrinsics)
+	m.SetTexture(image.NewRGBA(image.Rect(0, 0, 3, 3)))
+
+	var obj bytes.Buffer
+	if err := m.WriteOBJ(&obj, "scan.mtl"); err != nil {
+		t.Fatal(err)
+	}
+	text := obj.String()
+	if strings.Count(text, "\nv ") != 7 || strings.Count(text, "\nvt ") != 7 || strings.Count(text, "\nf ") != 5 {
+		t.Errorf("unexpected OBJ contents:\n%s", text)
+	}
+	if !strings.Contains(text, "mtllib scan.mtl\n") || !strings.Contains(text, "f 1/1 2/2 3/3\n") {
+		t.Errorf("expected the material and one based indices:\n%s", text)
+	}
+
+	var ply bytes.Buffer
+	if err := m.WritePLY(&ply); err != nil {
+		t.Fatal(err)
+	}
+	header, body, found := strings.Cut(ply.String(), "end_header\n")
+	if !found || !strings.Contains(header, "element vertex 7\n") || !strings.Contains(header, "property uchar red\n") {
+		t.Errorf("unexpected PLY header:\n%s", header)
+	}
+	// xyz, rgb and st per vertex, a count and three indices per face
+	if size := 7*(12+3+8) + 5*13; len(body) != size {
+		t.Errorf("expected %d bytes of PLY data, got %d", size, len(body))
+	}
+
+	dir := t.TempDir()
+	if err := m.SaveOBJ(filepath.Join(dir, "scan.obj")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"scan.obj", "scan.mtl", "scan.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be written: %v", name, err)
+		}
+	}
+	mtl, _ := os.ReadFile(filepath.Join(dir, "scan.mtl"))
+	if !strings.Contains(string(mtl), "map_Kd scan.png\n") {
+		t.Errorf("expected the material to map the texture:\n%s", mtl)
+	}
+
+	// both formats point a vertex without a normal at the sensor
+	nan := math.NaN()
+	bare := &mesh.Mesh{Vertices: []freenect.Vector{{X: 0, Y: 0, Z: 1}}, Normals: []freenect.Vector{{X: nan, Y: nan, Z: nan}}}
+	obj.Reset()
+	bare.WriteOBJ(&obj, "")
+	if !strings.Contains(obj.String(), "vn 0 0 -1\n") {
+		t.Errorf("expected the OBJ normal to face the sensor:\n%s", obj.String())
+	}
+	ply.Reset()
+	bare.WritePLY(&ply)
+	_, body, _ = strings.Cut(ply.String(), "end_header\n")
+	if nz := math.Float32frombits(binary.LittleEndian.Uint32([]byte(body[20:24]))); nz != -1 {
+		t.Errorf("expected the PLY normal to face the sensor, got %v", nz)
+	}
+}
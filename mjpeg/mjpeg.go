@@ -0,0 +1,384 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package mjpeg serves the live frames of a freenect camera to web browsers, as Motion JPEG streams and PNG snapshots.
+package mjpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sync"
+
+	"freenect"
+	"freenect/colormap"
+)
+
+// The JPEG quality used unless the Server says otherwise.
+const DefaultQuality = 80
+
+const boundary = "freenectframe"
+
+// Returned by Image for frame formats it cannot render.
+var ErrUnsupportedFormat = errors.New("mjpeg: unsupported frame format")
+
+// An http.Handler serving the frames of the cameras attached to it. The routes are relative to where the server is
+// mounted, so use http.StripPrefix to serve it below the root:
+//
+//	/             a page showing the streams
+//	/video.mjpg   the video stream as Motion JPEG (RGB, Bayer, YUV and IR formats)
+//	/depth.mjpg   the depth stream as Motion JPEG, colorized by the Colors renderer
+//	/video.png    the latest video frame
+//	/depth.png    the latest depth frame, colorized; add ?raw for the 16 bit values as grayscale
+//
+// Attach cameras and adjust the fields before serving; frames are only encoded while someone is watching.
+type Server struct {
+	Quality		int
+	Colors		*colormap.Renderer
+	mux				*http.ServeMux
+	lock			sync.Mutex
+	feeds			map[string]*feed
+}
+
+// The latest frame of a camera and its encodings, shared by every client.
+type feed struct {
+	lock				sync.Mutex
+	frame				*freenect.Frame
+	changed			chan bool
+	done				chan bool
+	encoded			[]byte
+	sequence		uint64
+	unsubscribe	func()
+}
+
+// Creates a server with no cameras attached.
+func NewServer() *Server {
+	s := &Server{Quality: DefaultQuality, Colors: colormap.New(colormap.Glview), mux: http.NewServeMux(), feeds: map[string]*feed{}}
+	s.mux.HandleFunc("/{$}", s.index)
+	s.mux.HandleFunc("/video.mjpg", s.stream("video"))
+	s.mux.HandleFunc("/depth.mjpg", s.stream("depth"))
+	s.mux.HandleFunc("/video.png", s.snapshot("video"))
+	s.mux.HandleFunc("/depth.png", s.snapshot("depth"))
+	return s
+}
+
+// Serves the frames of a video camera. Replaces any video camera attached before.
+func (s *Server) Video(camera *freenect.VideoCamera) {
+	ch := camera.Subscribe()
+	s.attach("video", ch, func() { camera.Unsubscribe(ch) })
+}
+
+// Serves the frames of a depth camera. Replaces any depth camera attached before.
+func (s *Server) Depth(camera *freenect.DepthCamera) {
+	ch := camera.Subscribe()
+	s.attach("depth", ch, func() { camera.Unsubscribe(ch) })
+}
+
+func (s *Server) attach(name string, ch <-chan freenect.Frame, unsubscribe func()) {
+	f := &feed{changed: make(chan bool), done: make(chan bool), unsubscribe: unsubscribe}
+	go func() {
+		defer close(f.done)
+		for frame := range ch {
+			f.lock.Lock()
+			f.frame = &frame
+			close(f.changed)
+			f.changed = make(chan bool)
+			f.lock.Unlock()
+		}
+	}()
+
+	s.lock.Lock()
+	old := s.feeds[name]
+	s.feeds[name] = f
+	s.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// Detaches the cameras, ending any stream being served.
+func (s *Server) Close() {
+	s.lock.Lock()
+	feeds := s.feeds
+	s.feeds = map[string]*feed{}
+	s.lock.Unlock()
+
+	for _, f := range feeds {
+		f.close()
+	}
+}
+
+func (f *feed) close() {
+	f.unsubscribe()
+	<-f.done
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) feed(name string) *feed {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.feeds[name]
+}
+
+func (s *Server) colors() *colormap.Renderer {
+	if s.Colors == nil {
+		return DefaultColors
+	}
+	return s.Colors
+}
+
+func (s *Server) quality() int {
+	if s.Quality <= 0 || s.Quality > 100 {
+		return DefaultQuality
+	}
+	return s.Quality
+}
+
+// Returns the JPEG encoding of the latest frame if it is newer than the given sequence number, along with the
+// frame's sequence number and a channel closed when the next frame arrives. The encoding is shared by all clients.
+func (f *feed) next(after uint64, quality int, colors *colormap.Renderer) ([]byte, uint64, <-chan bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.frame == nil || f.frame.Sequence <= after {
+		return nil, after, f.changed, nil
+	}
+	if f.sequence != f.frame.Sequence || f.encoded == nil {
+		img, err := render(f.frame, colors)
+		if err != nil {
+			return nil, after, f.changed, err
+		}
+		buffer := &bytes.Buffer{}
+		if err = jpeg.Encode(buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, after, f.changed, err
+		}
+		f.encoded, f.sequence = buffer.Bytes(), f.frame.Sequence
+	}
+	return f.encoded, f.sequence, f.changed, nil
+}
+
+// Waits for a frame, giving up if the request is cancelled or the camera is detached.
+func (f *feed) latest(r *http.Request) *freenect.Frame {
+	for {
+		f.lock.Lock()
+		frame, changed := f.frame, f.changed
+		f.lock.Unlock()
+		if frame != nil {
+			return frame
+		}
+
+		select {
+		case <-changed:
+		case <-f.done:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) stream(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.feed(name)
+		if f == nil {
+			http.Error(w, "no "+name+" camera", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		flusher, _ := w.(http.Flusher)
+		quality := s.quality()
+
+		var sequence uint64
+		for {
+			frame, seq, changed, err := f.next(sequence, quality, s.colors())
+			if err != nil {
+				return
+			}
+			if frame != nil {
+				sequence = seq
+				fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(frame))
+				if _, err = w.Write(frame); err != nil {
+					return
+				}
+				if _, err = w.Write([]byte("\r\n")); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+
+			select {
+			case <-changed:
+			case <-f.done:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) snapshot(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.feed(name)
+		if f == nil {
+			http.Error(w, "no "+name+" camera", http.StatusNotFound)
+			return
+		}
+		frame := f.latest(r)
+		if frame == nil {
+			http.Error(w, "no frame", http.StatusServiceUnavailable)
+			return
+		}
+
+		var img image.Image
+		var err error
+		if _, raw := r.URL.Query()["raw"]; raw && frame.Stream == "depth" {
+			img = rawDepth(frame)
+		} else {
+			img, err = render(frame, s.colors())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		buffer := &bytes.Buffer{}
+		if err = png.Encode(buffer, img); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.Write(buffer.Bytes())
+	}
+}
+
+const page = `<!DOCTYPE html>
+<html>
+<head><title>freenect</title></head>
+<body style="background:#222">
+%s
+</body>
+</html>
+`
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	imgs := ""
+	for _, name := range []string{"video", "depth"} {
+		if s.feed(name) != nil {
+			imgs += fmt.Sprintf("<img src=\"%s.mjpg\" alt=\"%s\">\n", name, name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, page, imgs)
+}
+
+// The renderer Image uses for depth frames.
+var DefaultColors = colormap.New(colormap.Glview)
+
+// Renders a frame for display: video frames in their natural colors, IR as grayscale and depth with DefaultColors.
+func Image(frame *freenect.Frame) (image.Image, error) {
+	return render(frame, DefaultColors)
+}
+
+func render(frame *freenect.Frame, colors *colormap.Renderer) (image.Image, error) {
+	if frame.Stream == "depth" {
+		img, err := colors.RenderFrame(frame)
+		if err != nil {
+			return nil, ErrUnsupportedFormat
+		}
+		return img, nil
+	}
+
+	w, h := frame.Width, frame.Height
+	pixels := w * h
+	rect := image.Rect(0, 0, w, h)
+	switch frame.VideoFormat() {
+	case freenect.RGB, freenect.YUV_RGB:
+		if len(frame.Video) < pixels*3 {
+			break
+		}
+		img := image.NewRGBA(rect)
+		for i := 0; i < pixels; i++ {
+			copy(img.Pix[i*4:], frame.Video[i*3:i*3+3])
+			img.Pix[i*4+3] = 0xff
+		}
+		return img, nil
+	case freenect.IR_8BIT:
+		if len(frame.Video) < pixels {
+			break
+		}
+		img := image.NewGray(rect)
+		copy(img.Pix, frame.Video)
+		return img, nil
+	case freenect.IR_10BIT:
+		if len(frame.Video) < pixels*2 {
+			break
+		}
+		// the values are little endian and 10 bits wide; stretch them to 16
+		img := image.NewGray16(rect)
+		for i := 0; i < pixels; i++ {
+			v := (uint16(frame.Video[i*2]) | uint16(frame.Video[i*2+1])<<8) << 6
+			img.Pix[i*2], img.Pix[i*2+1] = byte(v>>8), byte(v)
+		}
+		return img, nil
+	case freenect.BAYER:
+		if len(frame.Video) < pixels {
+			break
+		}
+		return debayer(frame.Video, w, h), nil
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// A quick demosaic of the sensor's GRBG pattern, taking the colors of each 2x2 cell for all of its pixels.
+func debayer(raw []byte, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y+1 < h; y += 2 {
+		for x := 0; x+1 < w; x += 2 {
+			g1, r := raw[y*w+x], raw[y*w+x+1]
+			b, g2 := raw[(y+1)*w+x], raw[(y+1)*w+x+1]
+			c := color.RGBA{r, uint8((int(g1) + int(g2)) / 2), b, 0xff}
+			img.SetRGBA(x, y, c)
+			img.SetRGBA(x+1, y, c)
+			img.SetRGBA(x, y+1, c)
+			img.SetRGBA(x+1, y+1, c)
+		}
+	}
+	return img
+}
+
+// Returns the depth values unchanged as a 16 bit grayscale image.
+func rawDepth(frame *freenect.Frame) image.Image {
+	img := image.NewGray16(image.Rect(0, 0, frame.Width, frame.Height))
+	for i := 0; i < frame.Width*frame.Height && i < len(frame.Depth); i++ {
+		v := frame.Depth[i]
+		img.Pix[i*2], img.Pix[i*2+1] = byte(v>>8), byte(v)
+	}
+	return img
+}
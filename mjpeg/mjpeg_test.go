@@ -0,0 +1,112 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mjpeg_test
+
+import (
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"freenect"
+	"freenect/mjpeg"
+)
+
+func TestServer(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+	dev := lib.Devices[0]
+	dev.Open()
+	defer dev.Close()
+
+	video, _ := dev.VideoCamera(freenect.MEDIUM, freenect.RGB,
+		func(bytes int) []byte { return make([]byte, bytes) }, func(frame []byte, stamp int32) {})
+	depth, _ := dev.DepthCamera(freenect.MEDIUM, freenect.D11BIT,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) }, func(frame []uint16, stamp int32) {})
+
+	server := mjpeg.NewServer()
+	server.Video(video)
+	server.Depth(depth)
+	defer server.Close()
+	web := httptest.NewServer(server)
+	defer web.Close()
+
+	video.Start()
+	defer video.Stop()
+	depth.Start()
+	defer depth.Stop()
+
+	for _, path := range []string{"/video.png", "/depth.png", "/depth.png?raw"} {
+		resp, err := http.Get(web.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		img, err := png.Decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if b := img.Bounds(); b.Dx() != 640 || b.Dy() != 480 {
+			t.Errorf("GET %s: expected 640x480, got %v", path, b)
+		}
+	}
+
+	resp, err := http.Get(web.URL + "/depth.mjpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	media, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || media != "multipart/x-mixed-replace" {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for x := 0; x < 3; x++ {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", x, err)
+		}
+		if _, err = jpeg.Decode(part); err != nil {
+			t.Fatalf("part %d: %v", x, err)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	frame := &freenect.Frame{Stream: "depth", Format: int32(freenect.D11BIT), Width: 2, Height: 1, Depth: []uint16{0, 2047}}
+	img, err := mjpeg.Image(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 {
+		t.Errorf("expected white up close, got %d %d %d", r>>8, g>>8, b>>8)
+	}
+	if r, g, b, _ := img.At(1, 0).RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("expected black for no depth, got %d %d %d", r, g, b)
+	}
+
+	frame = &freenect.Frame{Stream: "video", Format: int32(freenect.YUV_RAW), Width: 2, Height: 1, Video: make([]byte, 4)}
+	if _, err = mjpeg.Image(frame); err != mjpeg.ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// The safe range of the tilt motor in degrees. MoveTo clamps its target to this range.
+const (
+	TILT_MIN_DEGREES	= -27.0
+	TILT_MAX_DEGREES	= 27.0
+)
+
+// Return codes for the blocking motor calls.
+const (
+	TILT_TIMEOUT			= -997
+)
+
+const (
+	motorPoll				= 50 * time.Millisecond
+	motorTimeout		= 5 * time.Second
+	motorTolerance	= 1.0
+	sweepEpsilon		= 1e-6
+)
+
+// Type definition for the function invoked at each stop of a Scan or Sweep. Return false to end the scan early.
+type ScanStop func(tilt *Tilt, deg float64) bool
+
+// Moves the device to the target angle (in degrees) and blocks until the motor reports it has stopped or reached its limit.
+// The target is clamped to TILT_MIN_DEGREES..TILT_MAX_DEGREES. If the context carries no deadline, a default timeout of
+// a few seconds is applied. Returns TILT_TIMEOUT if the context expires before the motor stops.
+func (tilt *Tilt) MoveTo(ctx context.Context, deg float64) int {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, motorTimeout)
+		defer cancel()
+	}
+
+	deg = math.Max(TILT_MIN_DEGREES, math.Min(TILT_MAX_DEGREES, deg))
+	rc := tilt.SetAngle(deg)
+	if rc != 0 {
+		return rc
+	}
+
+	ticker := time.NewTicker(motorPoll)
+	defer ticker.Stop()
+
+	moved := false
+	for {
+		select {
+		case <-ctx.Done():
+			return TILT_TIMEOUT
+		case <-ticker.C:
+		}
+
+		tilt.Refresh()
+		if settled(tilt.Latest(), deg, &moved) {
+			return 0
+		}
+	}
+}
+
+// Reports whether a move to deg is over, given the latest state, and records in moved whether the motor has been seen
+// moving. The motor may still report the status from before the request, stopped or at a limit it is now leaving, so
+// either is only trusted once the motor has been seen moving or the angle is on target.
+func settled(state TiltState, deg float64, moved *bool) bool {
+	switch state.Status {
+	case TILT_MOVING:
+		*moved = true
+	case TILT_STOPPED, TILT_AT_LIMIT:
+		return *moved || math.Abs(float64(state.Angle)-deg) <= motorTolerance
+	}
+	return false
+}
+
+// Moves the device through each of the given angles in turn, invoking stop once the motor has come to rest at each one.
+// The scan ends early if stop returns false or a move fails; the return code is that of the failed move.
+func (tilt *Tilt) Scan(ctx context.Context, angles []float64, stop ScanStop) int {
+	for _, deg := range angles {
+		rc := tilt.MoveTo(ctx, deg)
+		if rc != 0 {
+			return rc
+		}
+		if stop != nil && !stop(tilt, deg) {
+			break
+		}
+	}
+	return 0
+}
+
+// Steps the device from one angle to another in increments of step degrees, invoking stop at each stop along the way.
+// Both end points are included. The step must be positive; the direction is taken from the end points.
+func (tilt *Tilt) Sweep(ctx context.Context, from, to, step float64, stop ScanStop) int {
+	if step <= 0 {
+		return -998
+	}
+	return tilt.Scan(ctx, sweepAngles(from, to, step), stop)
+}
+
+// Returns the stops of a sweep. Each is computed from its index rather than accumulated, so rounding cannot add a
+// stop a hair short of the end; a last stop within sweepEpsilon of the end is the end.
+func sweepAngles(from, to, step float64) []float64 {
+	if to < from {
+		step = -step
+	}
+	n := int(math.Floor((to-from)/step + 1e-9))
+	angles := make([]float64, 0, n+2)
+	for i := 0; i <= n; i++ {
+		angles = append(angles, from+float64(i)*step)
+	}
+	if last := len(angles) - 1; math.Abs(angles[last]-to) <= sweepEpsilon {
+		angles[last] = to
+	} else {
+		angles = append(angles, to)
+	}
+	return angles
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// A three component vector. For accelerometer readings the units are m/s^2, in the device frame:
+// X to the right, Y up and Z out of the front of the sensor.
+type Vector struct {
+	X, Y, Z	float64
+}
+
+// The device orientation relative to gravity, in degrees. Pitch is positive when the sensor looks up,
+// roll is positive when it is rotated clockwise as seen from behind.
+type Orientation struct {
+	Roll		float64
+	Pitch		float64
+}
+
+// Return code from Level when the device cannot be brought level within the motor range.
+const (
+	TILT_NOT_LEVEL		= -996
+)
+
+const (
+	gravitySmoothing	= 0.2
+	levelTolerance		= 0.5
+	levelAttempts			= 5
+	levelSamples			= 10
+)
+
+// Returns the length of the vector.
+func (v Vector) Norm() float64 {
+	return math.Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z)
+}
+
+// Returns the vector scaled to unit length, or the zero vector if it has no length.
+func (v Vector) Unit() Vector {
+	n := v.Norm()
+	if n == 0 {
+		return Vector{}
+	}
+	return Vector{v.X / n, v.Y / n, v.Z / n}
+}
+
+// Computes the orientation of the device from a gravity (accelerometer) vector.
+func (v Vector) Orientation() Orientation {
+	return Orientation{
+		Roll:		math.Atan2(-v.X, v.Y) * 180 / math.Pi,
+		Pitch:	math.Atan2(v.Z, math.Hypot(v.X, v.Y)) * 180 / math.Pi,
+	}
+}
+
+// A first order low-pass filter for accelerometer readings. Alpha is the weight given to each new sample;
+// smaller values are smoother but slower to respond.
+type GravityFilter struct {
+	Alpha		float64
+	gravity	Vector
+	primed	bool
+}
+
+// Folds a new accelerometer reading into the filter and returns the filtered gravity vector.
+func (filter *GravityFilter) Update(accel Vector) Vector {
+	if !filter.primed {
+		filter.gravity = accel
+		filter.primed = true
+		return accel
+	}
+
+	a := filter.Alpha
+	filter.gravity = Vector{
+		filter.gravity.X + a*(accel.X-filter.gravity.X),
+		filter.gravity.Y + a*(accel.Y-filter.gravity.Y),
+		filter.gravity.Z + a*(accel.Z-filter.gravity.Z),
+	}
+	return filter.gravity
+}
+
+// Returns the current filtered gravity vector.
+func (filter *GravityFilter) Gravity() Vector {
+	return filter.gravity
+}
+
+// Discards the filter history; the next reading is taken as is.
+func (filter *GravityFilter) Reset() {
+	filter.gravity = Vector{}
+	filter.primed = false
+}
+
+// Returns the raw accelerometer reading of the snapshot.
+func (state TiltState) Accel() Vector {
+	return Vector{float64(state.AccelX), float64(state.AccelY), float64(state.AccelZ)}
+}
+
+// Returns the orientation of the device computed from the snapshot's filtered gravity vector.
+func (state TiltState) Orientation() Orientation {
+	return state.Gravity.Orientation()
+}
+
+// Sets the weight given to each new accelerometer reading by the gravity filter, between 0 (frozen) and 1 (unfiltered).
+func (tilt *Tilt) GravitySmoothing(alpha float64) {
+	tilt.lock.Lock()
+	defer tilt.lock.Unlock()
+	tilt.gravity.Alpha = math.Max(0, math.Min(1, alpha))
+}
+
+// Returns the low-pass filtered gravity vector as of the latest tilt state.
+func (tilt *Tilt) Gravity() Vector {
+	return tilt.Latest().Gravity
+}
+
+// Returns the orientation of the device as of the latest tilt state.
+func (tilt *Tilt) Orientation() Orientation {
+	return tilt.Latest().Orientation()
+}
+
+// Drives the motor until the pitch measured by the accelerometer is zero, compensating for a base that is not level.
+// Returns TILT_NOT_LEVEL if the motor range is exhausted or the pitch does not settle within a few attempts,
+// or TILT_TIMEOUT if the context expires.
+func (tilt *Tilt) Level(ctx context.Context) int {
+	target := float64(tilt.refresh().Angle)
+
+	for attempt := 0; attempt < levelAttempts; attempt++ {
+		rc := tilt.MoveTo(ctx, target)
+		if rc != 0 {
+			return rc
+		}
+
+		gravity, rc := tilt.measure(ctx, levelSamples)
+		if rc != 0 {
+			return rc
+		}
+
+		pitch := gravity.Orientation().Pitch
+		if math.Abs(pitch) <= levelTolerance {
+			return 0
+		}
+
+		next := math.Max(TILT_MIN_DEGREES, math.Min(TILT_MAX_DEGREES, target-pitch))
+		if next == target {
+			return TILT_NOT_LEVEL
+		}
+		target = next
+	}
+	return TILT_NOT_LEVEL
+}
+
+// Averages several accelerometer readings once the motor is at rest.
+func (tilt *Tilt) measure(ctx context.Context, samples int) (Vector, int) {
+	var sum Vector
+	for n := 0; n < samples; n++ {
+		select {
+		case <-ctx.Done():
+			return sum, TILT_TIMEOUT
+		case <-time.After(motorPoll):
+		}
+
+		accel := tilt.refresh().Accel()
+		sum.X += accel.X
+		sum.Y += accel.Y
+		sum.Z += accel.Z
+	}
+	return Vector{sum.X / float64(samples), sum.Y / float64(samples), sum.Z / float64(samples)}, 0
+}
@@ -0,0 +1,257 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package pipeline moves frame processing off the libfreenect event loop. A pipeline is a chain of stages, each
+// running on its own go routine and fed by a bounded queue, so a slow stage delays only the stages behind it and never
+// the USB transfers.
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"freenect"
+)
+
+// What a stage does when a frame arrives and its queue is full.
+type Policy int
+
+const (
+	Block				= Policy(iota)	// wait for room, holding up the stage before it
+	DropNewest									// drop the arriving frame
+	DropOldest									// drop the oldest queued frame to make room
+)
+
+// The queue length of a stage that does not set one.
+const DefaultQueue = 4
+
+// A frame on its way through a pipeline. Encoding stages put their output in Data, with its MIME type in Type.
+type Packet struct {
+	Frame	freenect.Frame
+	Data	[]byte
+	Type	string
+}
+
+// Returned by a stage to drop a frame quietly. Any other error is reported to the pipeline's error handler and also
+// drops the frame.
+var Skip = errors.New("pipeline: skip frame")
+
+// One step of a pipeline. Process owns the packet until it returns and may change its fields, but the frame's Video
+// and Depth are shared with the camera's other subscribers and are read-only: a stage changing them replaces them
+// with a copy. Queue is the number of packets waiting for the stage, DefaultQueue if not positive, and Policy says
+// what happens when it is full.
+type Stage struct {
+	Name		string
+	Process	func(packet *Packet) error
+	Queue		int
+	Policy	Policy
+}
+
+// Type definition for the function receiving the errors returned by stages. It is invoked on the stage's go routine.
+type ErrorHandler func(stage string, err error)
+
+// Counters describing a stage.
+type StageStats struct {
+	Name			string
+	Processed	uint64
+	Dropped		uint64
+	Errors		uint64
+	Queued		int
+}
+
+type worker struct {
+	Stage
+	queue			chan Packet
+	processed	atomic.Uint64
+	dropped		atomic.Uint64
+	errors		atomic.Uint64
+}
+
+// A running chain of stages. Frames enter from attached cameras or through Push. A camera never waits for a
+// pipeline: a Block policy on the first stage only makes the pipeline skip camera frames while it is busy. All
+// methods are safe for concurrent use.
+type Pipeline struct {
+	workers		[]*worker
+	lock			sync.RWMutex
+	closed		bool
+	detach		[]func()
+	intake		sync.WaitGroup
+	running		sync.WaitGroup
+	handler		atomic.Value
+}
+
+// Creates and starts a pipeline running the stages in order.
+func New(stages ...Stage) *Pipeline {
+	p := &Pipeline{}
+	for _, stage := range stages {
+		size := stage.Queue
+		if size <= 0 {
+			size = DefaultQueue
+		}
+		p.workers = append(p.workers, &worker{Stage: stage, queue: make(chan Packet, size)})
+	}
+
+	for i, w := range p.workers {
+		var next *worker
+		if i+1 < len(p.workers) {
+			next = p.workers[i+1]
+		}
+		p.running.Add(1)
+		go p.run(w, next)
+	}
+	return p
+}
+
+// Registers the function receiving the errors returned by stages. Provide nil to ignore them.
+func (p *Pipeline) OnError(handler ErrorHandler) {
+	p.handler.Store(handler)
+}
+
+func (p *Pipeline) run(w *worker, next *worker) {
+	defer p.running.Done()
+	if next != nil {
+		defer close(next.queue)
+	}
+
+	for packet := range w.queue {
+		if w.Process != nil {
+			if err := w.Process(&packet); err != nil {
+				if err != Skip {
+					w.errors.Add(1)
+					if handler, _ := p.handler.Load().(ErrorHandler); handler != nil {
+						handler(w.Name, err)
+					}
+				}
+				continue
+			}
+		}
+		w.processed.Add(1)
+		if next != nil {
+			next.offer(packet)
+		}
+	}
+}
+
+// Queues a packet according to the worker's policy, reporting whether it was queued.
+func (w *worker) offer(packet Packet) bool {
+	switch w.Policy {
+	case DropNewest:
+		select {
+		case w.queue <- packet:
+			return true
+		default:
+			w.dropped.Add(1)
+			return false
+		}
+	case DropOldest:
+		for {
+			select {
+			case w.queue <- packet:
+				return true
+			default:
+			}
+			select {
+			case <-w.queue:
+				w.dropped.Add(1)
+			default:
+			}
+		}
+	}
+	w.queue <- packet
+	return true
+}
+
+// Feeds a frame to the pipeline, such as one read from a recording. Reports whether the frame was queued; it is not
+// when the first stage drops it or the pipeline is closed. With a Block policy on the first stage Push waits for room.
+func (p *Pipeline) Push(frame freenect.Frame) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed || len(p.workers) == 0 {
+		return false
+	}
+	return p.workers[0].offer(Packet{Frame: frame})
+}
+
+// Feeds the frames of a video camera to the pipeline until it is closed.
+func (p *Pipeline) Video(camera *freenect.VideoCamera) {
+	ch := camera.Subscribe()
+	p.attach(ch, func() { camera.Unsubscribe(ch) })
+}
+
+// Feeds the frames of a depth camera to the pipeline until it is closed.
+func (p *Pipeline) Depth(camera *freenect.DepthCamera) {
+	ch := camera.Subscribe()
+	p.attach(ch, func() { camera.Unsubscribe(ch) })
+}
+
+func (p *Pipeline) attach(ch <-chan freenect.Frame, unsubscribe func()) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		unsubscribe()
+		return
+	}
+	p.detach = append(p.detach, unsubscribe)
+	p.intake.Add(1)
+	p.lock.Unlock()
+
+	go func() {
+		defer p.intake.Done()
+		for frame := range ch {
+			p.Push(frame)
+		}
+	}()
+}
+
+// Detaches the cameras, lets every stage finish the frames already queued and stops the pipeline. Returns once the
+// last stage is done.
+func (p *Pipeline) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		p.running.Wait()
+		return
+	}
+	p.closed = true
+	detach := p.detach
+	p.detach = nil
+	p.lock.Unlock()
+
+	for _, unsubscribe := range detach {
+		unsubscribe()
+	}
+	p.intake.Wait()
+	if len(p.workers) > 0 {
+		close(p.workers[0].queue)
+	}
+	p.running.Wait()
+}
+
+// Returns the counters of every stage, in order.
+func (p *Pipeline) Stats() []StageStats {
+	stats := make([]StageStats, len(p.workers))
+	for i, w := range p.workers {
+		stats[i] = StageStats{
+			Name:				w.Name,
+			Processed:	w.processed.Load(),
+			Dropped:		w.dropped.Load(),
+			Errors:			w.errors.Load(),
+			Queued:			len(w.queue),
+		}
+	}
+	return stats
+}
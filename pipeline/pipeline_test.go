@@ -0,0 +1,242 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pipeline_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"freenect"
+	"freenect/colormap"
+	"freenect/filter"
+	"freenect/pipeline"
+)
+
+func frame(sequence uint64) freenect.Frame {
+	return freenect.Frame{Stream: "depth", Format: int32(freenect.MM), Width: 2, Height: 1, Sequence: sequence, Depth: []uint16{1000, 0}}
+}
+
+// Collects the sequence numbers reaching the end of a pipeline.
+type collector struct {
+	lock	sync.Mutex
+	seen	[]uint64
+}
+
+func (c *collector) stage() pipeline.Stage {
+	return pipeline.Stage{Name: "collect", Process: func(packet *pipeline.Packet) error {
+		c.lock.Lock()
+		c.seen = append(c.seen, packet.Frame.Sequence)
+		c.lock.Unlock()
+		return nil
+	}}
+}
+
+func TestPolicies(t *testing.T) {
+	for _, policy := range []pipeline.Policy{pipeline.Block, pipeline.DropNewest, pipeline.DropOldest} {
+		busy, release := make(chan bool, 1), make(chan bool)
+		c := &collector{}
+		p := pipeline.New(
+			pipeline.Stage{Name: "slow", Queue: 2, Policy: policy, Process: func(packet *pipeline.Packet) error {
+				busy <- true
+				<-release
+				return nil
+			}},
+			c.stage())
+
+		// the slow stage takes the first frame and queues two; the rest meet a full queue
+		p.Push(frame(1))
+		<-busy
+		pushed := make(chan bool)
+		go func() {
+			for i := uint64(2); i <= 5; i++ {
+				p.Push(frame(i))
+			}
+			close(pushed)
+		}()
+		if policy != pipeline.Block {
+			<-pushed
+		}
+		go func() {
+			for range busy {
+			}
+		}()
+		close(release)
+		<-pushed
+		p.Close()
+		close(busy)
+
+		stats := p.Stats()
+		var expected []uint64
+		switch policy {
+		case pipeline.Block:
+			expected = []uint64{1, 2, 3, 4, 5}
+		case pipeline.DropNewest:
+			expected = []uint64{1, 2, 3}
+		case pipeline.DropOldest:
+			expected = []uint64{1, 4, 5}
+		}
+		if len(c.seen) != len(expected) {
+			t.Errorf("policy %d: expected %v, got %v", policy, expected, c.seen)
+			continue
+		}
+		for i := range expected {
+			if c.seen[i] != expected[i] {
+				t.Errorf("policy %d: expected %v, got %v", policy, expected, c.seen)
+				break
+			}
+		}
+		if stats[0].Dropped != uint64(5-len(expected)) || stats[1].Processed != uint64(len(expected)) {
+			t.Errorf("policy %d: unexpected stats %+v", policy, stats)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	failure := errors.New("odd frame")
+	var reported []error
+	c := &collector{}
+	p := pipeline.New(
+		pipeline.Stage{Name: "check", Process: func(packet *pipeline.Packet) error {
+			switch packet.Frame.Sequence % 3 {
+			case 1:
+				return failure
+			case 2:
+				return pipeline.Skip
+			}
+			return nil
+		}},
+		c.stage())
+	p.OnError(func(stage string, err error) {
+		if stage != "check" {
+			t.Errorf("expected the check stage, got %s", stage)
+		}
+		reported = append(reported, err)
+	})
+
+	for i := uint64(1); i <= 6; i++ {
+		p.Push(frame(i))
+	}
+	p.Close()
+
+	if len(reported) != 2 || reported[0] != failure {
+		t.Errorf("expected two failures, got %v", reported)
+	}
+	if len(c.seen) != 2 || c.seen[0] != 3 || c.seen[1] != 6 {
+		t.Errorf("expected frames 3 and 6 to pass, got %v", c.seen)
+	}
+	if stats := p.Stats(); stats[0].Errors != 2 {
+		t.Errorf("expected two errors counted, got %+v", stats[0])
+	}
+	if p.Push(frame(7)) {
+		t.Error("expected a closed pipeline to refuse frames")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	var recording bytes.Buffer
+	p := pipeline.New(pipeline.Filter(filter.HoleFill{Method: filter.NEAREST}), pipeline.Record(&recording))
+
+	// a camera hands the same frame to every subscriber, so another pipeline reads it while this one filters
+	var sum uint64
+	reader := pipeline.New(pipeline.Stage{Name: "read", Process: func(packet *pipeline.Packet) error {
+		for _, d := range packet.Frame.Depth {
+			sum += uint64(d)
+		}
+		return nil
+	}})
+	first := frame(1)
+	p.Push(first)
+	reader.Push(first)
+	p.Push(frame(2))
+	p.Close()
+	reader.Close()
+
+	if first.Depth[1] != 0 || sum != 1000 {
+		t.Errorf("expected the shared frame untouched, got %v", first.Depth)
+	}
+
+	for i := uint64(1); i <= 2; i++ {
+		f, err := pipeline.Read(&recording)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Sequence != i || f.Depth[1] != 1000 {
+			t.Errorf("expected filtered frame %d, got %d with %v", i, f.Sequence, f.Depth)
+		}
+	}
+	if _, err := pipeline.Read(&recording); err != io.EOF {
+		t.Errorf("expected the end of the recording, got %v", err)
+	}
+
+	// a corrupt length is refused rather than allocated
+	corrupt := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0})
+	if _, err := pipeline.Read(corrupt); err != pipeline.ErrRecordTooLarge {
+		t.Errorf("expected ErrRecordTooLarge, got %v", err)
+	}
+}
+
+// Colorizes and encodes a simulated depth stream.
+func TestCamera(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+
+	dev := lib.Devices[0]
+	if rc = dev.Open(); rc != 0 {
+		t.Fatalf("Open failed: %d", rc)
+	}
+	defer dev.Close()
+
+	// the pipeline does the work; the sink has nothing left to do
+	depth, rc := dev.DepthCamera(freenect.MEDIUM, freenect.MM,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) },
+		func(frame []uint16, stamp int32) {})
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+
+	out := make(chan pipeline.Packet, 1)
+	p := pipeline.New(
+		pipeline.Stage{Name: "colorize", Process: pipeline.Colorize(colormap.New(colormap.Jet)).Process, Policy: pipeline.DropOldest},
+		pipeline.JPEG(80),
+		pipeline.Publish(out))
+	p.Depth(depth)
+	defer p.Close()
+
+	if rc = depth.Start(); rc != 0 {
+		t.Fatalf("Start failed: %d", rc)
+	}
+	defer depth.Stop()
+
+	select {
+	case packet := <-out:
+		if packet.Type != "image/jpeg" || len(packet.Data) == 0 {
+			t.Errorf("expected a JPEG image, got %q with %d bytes", packet.Type, len(packet.Data))
+		}
+		if packet.Frame.Stream != "video" || len(packet.Frame.Video) != 640*480*3 {
+			t.Errorf("expected a colorized frame, got a %s frame", packet.Frame.Stream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame arrived")
+	}
+}
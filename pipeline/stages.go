@@ -0,0 +1,155 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"freenect"
+	"freenect/colormap"
+	"freenect/filter"
+	"freenect/mjpeg"
+	"freenect/websocket"
+)
+
+// A stage running depth frames through the filters, in order, on a copy of the frame. Video frames pass untouched.
+func Filter(filters ...filter.Filter) Stage {
+	return Stage{Name: "filter", Process: func(packet *Packet) error {
+		frame := &packet.Frame
+		if frame.Stream != "depth" {
+			return nil
+		}
+		frame.Depth = append([]uint16(nil), frame.Depth...)
+		for _, f := range filters {
+			f.Filter(frame.Depth, frame.Width, frame.Height, frame.DepthFormat())
+		}
+		return nil
+	}}
+}
+
+// A stage converting depth frames into RGB video frames with the renderer. Video frames pass untouched.
+func Colorize(colors *colormap.Renderer) Stage {
+	return Stage{Name: "colorize", Process: func(packet *Packet) error {
+		frame := &packet.Frame
+		if frame.Stream != "depth" {
+			return nil
+		}
+		img, err := colors.RenderFrame(frame)
+		if err != nil {
+			return err
+		}
+
+		rgb := make([]byte, frame.Width*frame.Height*3)
+		for i := range frame.Width * frame.Height {
+			copy(rgb[i*3:i*3+3], img.Pix[i*4:])
+		}
+		frame.Stream, frame.Format = "video", int32(freenect.RGB)
+		frame.Video, frame.Depth = rgb, nil
+		return nil
+	}}
+}
+
+// A stage encoding each frame as a JPEG image of the given quality into the packet's Data. Depth frames are drawn
+// with mjpeg.DefaultColors.
+func JPEG(quality int) Stage {
+	return Stage{Name: "jpeg", Process: func(packet *Packet) error {
+		img, err := mjpeg.Image(&packet.Frame)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+		packet.Data, packet.Type = buf.Bytes(), "image/jpeg"
+		return nil
+	}}
+}
+
+// A stage encoding each frame as a PNG image into the packet's Data. Depth frames are drawn with mjpeg.DefaultColors.
+func PNG() Stage {
+	return Stage{Name: "png", Process: func(packet *Packet) error {
+		img, err := mjpeg.Image(&packet.Frame)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = png.Encode(&buf, img); err != nil {
+			return err
+		}
+		packet.Data, packet.Type = buf.Bytes(), "image/png"
+		return nil
+	}}
+}
+
+// The largest recorded frame Read accepts; a raw high resolution video frame is a little under 4MB.
+const maxRecord = 16 << 20
+
+// Returned by Read for a recorded frame claiming to be larger than any frame can be, as in a corrupt recording.
+var ErrRecordTooLarge = errors.New("pipeline: recorded frame too large")
+
+// A stage appending each frame, exactly as it arrives, to a recording. Each frame is written as its length, a
+// little endian uint32, followed by the frame in the encoding of websocket.MarshalFrame. Read reads the frames back.
+func Record(w io.Writer) Stage {
+	return Stage{Name: "record", Process: func(packet *Packet) error {
+		data := websocket.MarshalFrame(&packet.Frame)
+		record := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+		_, err := w.Write(append(record, data...))
+		return err
+	}}
+}
+
+// Reads the next frame of a recording written by Record. Returns io.EOF at the end of the recording.
+func Read(r io.Reader) (*freenect.Frame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > maxRecord {
+		return nil, ErrRecordTooLarge
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return websocket.UnmarshalFrame(data)
+}
+
+// A stage handing a copy of each packet to the channel. A full channel is not waited for; the packet is skipped
+// instead, so a reader that falls behind cannot stall the pipeline.
+func Publish(ch chan<- Packet) Stage {
+	return Stage{Name: "publish", Process: func(packet *Packet) error {
+		out := *packet
+		out.Frame.Video = append([]byte(nil), packet.Frame.Video...)
+		out.Frame.Depth = append([]uint16(nil), packet.Frame.Depth...)
+		out.Data = append([]byte(nil), packet.Data...)
+		select {
+		case ch <- out:
+		default:
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"math"
+)
+
+// Pinhole camera parameters of the depth camera, in pixels.
+type Intrinsics struct {
+	Fx, Fy	float64
+	Cx, Cy	float64
+}
+
+// Typical intrinsics of the Kinect depth camera at 640x480.
+var DefaultIntrinsics = Intrinsics{Fx: 594.21, Fy: 591.04, Cx: 339.31, Cy: 242.74}
+
+// An organized point cloud: one point per depth pixel in row order, in meters. Pixels without a valid
+// depth reading hold NaN coordinates. In the camera frame X is to the right, Y up and Z out of the sensor,
+// matching the accelerometer axes. Normals, when they have been estimated, holds the unit surface normal at each
+// point, NaN where there is none.
+type PointCloud struct {
+	Width		int
+	Height	int
+	Points	[]Vector
+	Normals	[]Vector
+}
+
+// A rigid transform: a rotation followed by a translation.
+type Transform struct {
+	R	[3][3]float64
+	T	Vector
+}
+
+// The transform that leaves points unchanged.
+var Identity = Transform{R: [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}}
+
+// Converts a raw 11 bit depth value to meters. Returns NaN for the "no reading" value and anything beyond it.
+func RawDepthToMeters(raw uint16) float64 {
+	if raw >= 2047 {
+		return math.NaN()
+	}
+	m := 1.0 / (float64(raw)*-0.0030711016 + 3.3309495161)
+	if m <= 0 {
+		return math.NaN()
+	}
+	return m
+}
+
+// Converts a depth value in millimeters, as produced by the MM and REGISTERED formats, to meters.
+// Returns NaN for a zero (no reading) value.
+func MillimetersToMeters(mm uint16) float64 {
+	if mm == 0 {
+		return math.NaN()
+	}
+	return float64(mm) / 1000.0
+}
+
+// Returns the function converting depth values of the format to meters, as used by DepthToPoints, or nil for the
+// packed formats.
+func MetersConverter(format DepthFormat) func(uint16) float64 {
+	switch format {
+	case D11BIT:
+		return RawDepthToMeters
+	case D10BIT:
+		return func(v uint16) float64 { return RawDepthToMeters(v << 1) }
+	case MM, REGISTERED:
+		return MillimetersToMeters
+	}
+	return nil
+}
+
+// Returns the sum of the vectors.
+func (v Vector) Add(u Vector) Vector {
+	return Vector{v.X + u.X, v.Y + u.Y, v.Z + u.Z}
+}
+
+// Returns the difference of the vectors.
+func (v Vector) Sub(u Vector) Vector {
+	return Vector{v.X - u.X, v.Y - u.Y, v.Z - u.Z}
+}
+
+// Returns the vector multiplied by s.
+func (v Vector) Scale(s float64) Vector {
+	return Vector{v.X * s, v.Y * s, v.Z * s}
+}
+
+// Returns the dot product of the vectors.
+func (v Vector) Dot(u Vector) float64 {
+	return v.X*u.X + v.Y*u.Y + v.Z*u.Z
+}
+
+// Returns the cross product of the vectors.
+func (v Vector) Cross(u Vector) Vector {
+	return Vector{v.Y*u.Z - v.Z*u.Y, v.Z*u.X - v.X*u.Z, v.X*u.Y - v.Y*u.X}
+}
+
+// Returns true if the point holds a valid reading.
+func (v Vector) Valid() bool {
+	return !math.IsNaN(v.X) && !math.IsNaN(v.Y) && !math.IsNaN(v.Z)
+}
+
+// Projects a depth frame into an organized point cloud in the camera frame. The meters function converts each
+// depth value; use RawDepthToMeters for the 11 bit formats and MillimetersToMeters for MM and REGISTERED, or
+// MetersConverter. A frame shorter than width*height, or a nil meters function, as MetersConverter returns for the
+// packed formats, yields an empty cloud.
+func DepthToPoints(depth []uint16, width, height int, intr Intrinsics, meters func(uint16) float64) PointCloud {
+	if meters == nil || width <= 0 || height <= 0 || len(depth) < width*height {
+		return PointCloud{}
+	}
+	cloud := PointCloud{Width: width, Height: height, Points: make([]Vector, width*height)}
+	nan := math.NaN()
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			z := meters(depth[i])
+			if math.IsNaN(z) {
+				cloud.Points[i] = Vector{nan, nan, nan}
+				continue
+			}
+			cloud.Points[i] = Vector{
+				(float64(x) - intr.Cx) * z / intr.Fx,
+				-(float64(y) - intr.Cy) * z / intr.Fy,
+				z,
+			}
+		}
+	}
+	return cloud
+}
+
+// Returns the transform from the camera frame into a gravity aligned world frame, given the accelerometer's gravity
+// vector. The world Y axis points up and the heading of the camera is preserved. The origin lies height meters below
+// the sensor, so with the sensor height above the floor, world Y is the height of a point off the floor.
+func WorldTransform(gravity Vector, height float64) Transform {
+	// rotate the measured up direction onto +Y about the axis perpendicular to both
+	up := gravity.Unit()
+	if up == (Vector{}) {
+		return Transform{R: Identity.R, T: Vector{0, height, 0}}
+	}
+
+	axis := Vector{-up.Z, 0, up.X}
+	s := axis.Norm()
+	c := up.Y
+	if s < 1e-12 {
+		if c > 0 {
+			return Transform{R: Identity.R, T: Vector{0, height, 0}}
+		}
+		// upside down: half turn about Z
+		return Transform{R: [3][3]float64{{-1, 0, 0}, {0, -1, 0}, {0, 0, 1}}, T: Vector{0, height, 0}}
+	}
+
+	k := Vector{axis.X / s, axis.Y / s, axis.Z / s}
+	t := 1 - c
+	r := [3][3]float64{
+		{c + k.X*k.X*t, k.X*k.Y*t - k.Z*s, k.X*k.Z*t + k.Y*s},
+		{k.Y*k.X*t + k.Z*s, c + k.Y*k.Y*t, k.Y*k.Z*t - k.X*s},
+		{k.Z*k.X*t - k.Y*s, k.Z*k.Y*t + k.X*s, c + k.Z*k.Z*t},
+	}
+	return Transform{R: r, T: Vector{0, height, 0}}
+}
+
+// Returns the transform into the gravity aligned world frame using the latest filtered gravity vector of the device.
+// See WorldTransform.
+func (tilt *Tilt) WorldTransform(height float64) Transform {
+	return WorldTransform(tilt.Gravity(), height)
+}
+
+// Applies the transform to a single point.
+func (t Transform) Apply(v Vector) Vector {
+	return Vector{
+		t.R[0][0]*v.X + t.R[0][1]*v.Y + t.R[0][2]*v.Z + t.T.X,
+		t.R[1][0]*v.X + t.R[1][1]*v.Y + t.R[1][2]*v.Z + t.T.Y,
+		t.R[2][0]*v.X + t.R[2][1]*v.Y + t.R[2][2]*v.Z + t.T.Z,
+	}
+}
+
+// Returns the transform applying u first and then t.
+func (t Transform) Compose(u Transform) Transform {
+	var out Transform
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			out.R[i][j] = t.R[i][0]*u.R[0][j] + t.R[i][1]*u.R[1][j] + t.R[i][2]*u.R[2][j]
+		}
+	}
+	out.T = t.Apply(u.T)
+	return out
+}
+
+// Returns the transform undoing this one.
+func (t Transform) Inverse() Transform {
+	var inv Transform
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			inv.R[i][j] = t.R[j][i]
+		}
+	}
+	inv.T = Transform{R: inv.R}.Apply(t.T).Scale(-1)
+	return inv
+}
+
+// Returns a new point cloud with every point transformed, and every normal rotated. Invalid points stay invalid.
+func (cloud PointCloud) Transform(t Transform) PointCloud {
+	out := PointCloud{Width: cloud.Width, Height: cloud.Height, Points: make([]Vector, len(cloud.Points))}
+	for i, p := range cloud.Points {
+		out.Points[i] = t.Apply(p)
+	}
+	if cloud.Normals != nil {
+		rotate := Transform{R: t.R}
+		out.Normals = make([]Vector, len(cloud.Normals))
+		for i, n := range cloud.Normals {
+			out.Normals[i] = rotate.Apply(n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect_test
+
+import (
+	"math"
+	"testing"
+	"freenect"
+)
+
+func near(a, b freenect.Vector) bool {
+	return math.Abs(a.X-b.X) < 1e-9 && math.Abs(a.Y-b.Y) < 1e-9 && math.Abs(a.Z-b.Z) < 1e-9
+}
+
+func TestDepthToPoints(t *testing.T) {
+	depth := []uint16{0, 1000, 2000, 0}
+	intr := freenect.Intrinsics{Fx: 1, Fy: 1, Cx: 0, Cy: 0}
+	cloud := freenect.DepthToPoints(depth, 2, 2, intr, freenect.MillimetersToMeters)
+
+	if cloud.Points[0].Valid() || cloud.Points[3].Valid() {
+		t.Errorf("Zero depth should produce invalid points")
+	}
+	if !near(cloud.Points[1], freenect.Vector{1, 0, 1}) {
+		t.Errorf("Unexpected point %v", cloud.Points[1])
+	}
+	if !near(cloud.Points[2], freenect.Vector{0, -2, 2}) {
+		t.Errorf("Unexpected point %v", cloud.Points[2])
+	}
+
+	if short := freenect.DepthToPoints(depth[:3], 2, 2, intr, freenect.MillimetersToMeters); short.Points != nil {
+		t.Errorf("A short frame should produce an empty cloud")
+	}
+	if packed := freenect.DepthToPoints(depth, 2, 2, intr, freenect.MetersConverter(freenect.D11BIT_PACKED)); packed.Points != nil {
+		t.Errorf("A packed format should produce an empty cloud")
+	}
+
+	if !math.IsNaN(freenect.RawDepthToMeters(2047)) {
+		t.Errorf("Raw 2047 should have no reading")
+	}
+	if m := freenect.RawDepthToMeters(800); m < 1 || m > 2 {
+		t.Errorf("Raw 800 should be between 1 and 2 meters, got %f", m)
+	}
+}
+
+func TestWorldTransform(t *testing.T) {
+	// level sensor 1.5m off the floor: a point 1.5m below the sensor is on the floor
+	level := freenect.WorldTransform(freenect.Vector{0, 9.81, 0}, 1.5)
+	if p := level.Apply(freenect.Vector{0, -1.5, 3}); !near(p, freenect.Vector{0, 0, 3}) {
+		t.Errorf("Expected floor point, got %v", p)
+	}
+
+	// sensor pitched up 30 degrees: the up direction leans towards +Z in the camera frame
+	a := math.Pi / 6
+	pitched := freenect.WorldTransform(freenect.Vector{0, math.Cos(a), math.Sin(a)}, 0)
+	if up := pitched.Apply(freenect.Vector{0, math.Cos(a), math.Sin(a)}); !near(up, freenect.Vector{0, 1, 0}) {
+		t.Errorf("Up should map to +Y, got %v", up)
+	}
+	// the optical axis points up and ahead in the world
+	if fwd := pitched.Apply(freenect.Vector{0, 0, 1}); !near(fwd, freenect.Vector{0, math.Sin(a), math.Cos(a)}) {
+		t.Errorf("Unexpected forward direction %v", fwd)
+	}
+
+	cloud := freenect.PointCloud{Width: 1, Height: 1, Points: []freenect.Vector{{math.NaN(), math.NaN(), math.NaN()}}}
+	if cloud.Transform(pitched).Points[0].Valid() {
+		t.Errorf("Invalid points should stay invalid")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"sync"
+	"time"
+)
+
+// An immutable snapshot of the tilt motor and accelerometer state, as published by the tilt poller.
+// Gravity is the low-pass filtered accelerometer vector.
+type TiltState struct {
+	Angle		float32
+	Status	int
+	AccelX	float32
+	AccelY	float32
+	AccelZ	float32
+	Gravity	Vector
+	Time		time.Time
+}
+
+type tiltPoller struct {
+	stop	chan bool
+	done	chan bool
+	lock	sync.Mutex
+	subs	[]chan TiltState
+}
+
+// Starts refreshing the tilt state in the background every rate interval. Each snapshot is made available via Latest()
+// and sent to every subscriber. Returns 1 if the poller is already running.
+func (tilt *Tilt) StartPolling(rate time.Duration) int {
+	if rate <= 0 {
+		return -998
+	}
+
+	poller := tilt.getPoller()
+
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+	if poller.stop != nil {
+		return 1
+	}
+	poller.stop = make(chan bool)
+	poller.done = make(chan bool)
+
+	go func(stop, done chan bool) {
+		defer close(done)
+		ticker := time.NewTicker(rate)
+		defer ticker.Stop()
+		for {
+			poller.publish(tilt.refresh())
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(poller.stop, poller.done)
+
+	return 0
+}
+
+// Stops the background poller and waits for it to exit. Subscriptions remain open and resume if polling is restarted.
+// Returns 1 if the poller is not running.
+func (tilt *Tilt) StopPolling() int {
+	poller := tilt.getPoller()
+
+	poller.lock.Lock()
+	if poller.stop == nil {
+		poller.lock.Unlock()
+		return 1
+	}
+	stop, done := poller.stop, poller.done
+	poller.stop, poller.done = nil, nil
+	poller.lock.Unlock()
+
+	close(stop)
+	<-done
+	return 0
+}
+
+// Returns a channel on which tilt snapshots are delivered while polling. The channel holds only the most recent
+// snapshot; a slow reader skips stale states rather than blocking the poller.
+func (tilt *Tilt) Subscribe() <-chan TiltState {
+	poller := tilt.getPoller()
+	ch := make(chan TiltState, 1)
+
+	poller.lock.Lock()
+	poller.subs = append(poller.subs, ch)
+	poller.lock.Unlock()
+	return ch
+}
+
+// Removes and closes a channel previously returned by Subscribe.
+func (tilt *Tilt) Unsubscribe(ch <-chan TiltState) {
+	poller := tilt.getPoller()
+
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+	for i, sub := range poller.subs {
+		if sub == ch {
+			poller.subs = append(poller.subs[:i], poller.subs[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Returns the most recently read tilt state, whether it came from the poller, Refresh() or a motor call.
+// The zero TiltState is returned if the state has never been read.
+func (tilt *Tilt) Latest() TiltState {
+	state, _ := tilt.latest.Load().(TiltState)
+	return state
+}
+
+func (tilt *Tilt) getPoller() *tiltPoller {
+	tilt.lock.Lock()
+	defer tilt.lock.Unlock()
+	if tilt.poller == nil {
+		tilt.poller = &tiltPoller{}
+	}
+	return tilt.poller
+}
+
+func (poller *tiltPoller) publish(state TiltState) {
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+	for _, sub := range poller.subs {
+		// drop the stale snapshot, if any, so the newest always gets through
+		select {
+		case <-sub:
+		default:
+		}
+		select {
+		case sub <- state:
+		default:
+		}
+	}
+}
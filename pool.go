@@ -0,0 +1,194 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// A fixed set of frame buffers allocated in C memory, so libfreenect can safely hold on to them.
+type framePool struct {
+	lock	sync.Mutex
+	count	int
+	bytes	int
+	all		[]unsafe.Pointer
+	free	[]unsafe.Pointer
+	dry		bool
+}
+
+// Pool buffers keyed by their address, so a frame callback can tell that the source returned nil because the pool
+// holding its buffer ran dry.
+var _pooled = map[unsafe.Pointer]*framePool{}
+var _pooledLock sync.Mutex
+
+// Returns whether the buffer belongs to a pool that had no buffer to give when last asked.
+func exhausted(buffer unsafe.Pointer) bool {
+	_pooledLock.Lock()
+	pool := _pooled[buffer]
+	_pooledLock.Unlock()
+	if pool == nil {
+		return false
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.dry
+}
+
+// Borrows a buffer of the given size, allocating it if the pool has not reached its count yet. Returns nil, and
+// marks the pool dry until a buffer is handed out again, when every buffer is on loan. Also returns nil for a
+// buffer of another size.
+func (pool *framePool) get(bytes int) unsafe.Pointer {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.bytes == 0 {
+		pool.bytes = bytes
+	}
+	if bytes != pool.bytes {
+		return nil
+	}
+
+	var buffer unsafe.Pointer
+	if n := len(pool.free); n > 0 {
+		buffer = pool.free[n-1]
+		pool.free = pool.free[:n-1]
+	} else if len(pool.all) < pool.count {
+		buffer = C.calloc(1, C.size_t(bytes))
+		pool.all = append(pool.all, buffer)
+		_pooledLock.Lock()
+		_pooled[buffer] = pool
+		_pooledLock.Unlock()
+	}
+	pool.dry = buffer == nil
+	return buffer
+}
+
+// Gives a buffer back to the pool. Buffers that did not come from the pool, or are already returned, are ignored.
+func (pool *framePool) put(buffer unsafe.Pointer) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, p := range pool.free {
+		if p == buffer {
+			return
+		}
+	}
+	for _, p := range pool.all {
+		if p == buffer {
+			pool.free = append(pool.free, buffer)
+			return
+		}
+	}
+}
+
+func (pool *framePool) release() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	_pooledLock.Lock()
+	for _, p := range pool.all {
+		delete(_pooled, p)
+		C.free(p)
+	}
+	_pooledLock.Unlock()
+	pool.all, pool.free, pool.dry, pool.bytes = nil, nil, false, 0
+}
+
+// A pool of video frame buffers allocated outside the Go heap. Frames are delivered to the sink without copying;
+// the sink, or whoever it hands the frame to, borrows the frame until it is given back with Return.
+// Use one pool per camera.
+type VideoPool struct {
+	pool	framePool
+}
+
+// A pool of depth frame buffers allocated outside the Go heap. See VideoPool.
+type DepthPool struct {
+	pool	framePool
+}
+
+// Creates a pool of count video buffers. Buffers are allocated on first use, once the frame size is known.
+// Returns ErrPoolSize if count is less than two.
+func NewVideoPool(count int) (*VideoPool, error) {
+	if count < 2 {
+		return nil, ErrPoolSize
+	}
+	return &VideoPool{framePool{count: count}}, nil
+}
+
+// Returns a source that borrows buffers from the pool. When every buffer is on loan the source returns nil, and the
+// camera drops frames until one is returned rather than overwrite a borrowed frame. One buffer is always with the
+// camera, so a sink can hold one frame less than the pool's count. Frames should be returned promptly.
+func (pool *VideoPool) Source() VideoSource {
+	return func(bytes int) []byte {
+		buffer := pool.pool.get(bytes)
+		if buffer == nil {
+			return nil
+		}
+		return unsafe.Slice((*byte)(buffer), bytes)
+	}
+}
+
+// Gives a frame back to the pool.
+func (pool *VideoPool) Return(frame []byte) {
+	if len(frame) > 0 {
+		pool.pool.put(unsafe.Pointer(&frame[0]))
+	}
+}
+
+// Releases the pool's memory. The camera must be stopped, and no frame from the pool may be used afterwards.
+func (pool *VideoPool) Free() {
+	pool.pool.release()
+}
+
+// Creates a pool of count depth buffers. Buffers are allocated on first use, once the frame size is known.
+// Returns ErrPoolSize if count is less than two.
+func NewDepthPool(count int) (*DepthPool, error) {
+	if count < 2 {
+		return nil, ErrPoolSize
+	}
+	return &DepthPool{framePool{count: count}}, nil
+}
+
+// Returns a source that borrows buffers from the pool. See VideoPool.Source.
+func (pool *DepthPool) Source() DepthSource {
+	return func(bytes int) []uint16 {
+		buffer := pool.pool.get(bytes)
+		if buffer == nil {
+			return nil
+		}
+		return unsafe.Slice((*uint16)(buffer), bytes/2)
+	}
+}
+
+// Gives a frame back to the pool.
+func (pool *DepthPool) Return(frame []uint16) {
+	if len(frame) > 0 {
+		pool.pool.put(unsafe.Pointer(&frame[0]))
+	}
+}
+
+// Releases the pool's memory. The camera must be stopped, and no frame from the pool may be used afterwards.
+func (pool *DepthPool) Free() {
+	pool.pool.release()
+}
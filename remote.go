@@ -0,0 +1,671 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Return code for calls on a remote device whose connection has failed.
+const (
+	REMOTE_FAILED			= -994
+)
+
+// How long the server holds a request for frames when none are waiting.
+const remotePoll = 50 * time.Millisecond
+
+// The operations of the remote protocol. Requests and responses are gob encoded and matched by ID; the server
+// handles each request on its own go routine, so a client may have several in flight.
+const (
+	opDevices			= iota
+	opOpen
+	opClose
+	opLED
+	opFlag
+	opTiltState
+	opTilt
+	opVideoMode
+	opDepthMode
+	opStartVideo
+	opStopVideo
+	opStartDepth
+	opStopDepth
+	opFrames
+)
+
+type remoteRequest struct {
+	ID					uint64
+	Op					int
+	Handle			int
+	Index				int
+	Serial			string
+	Value				int
+	On					bool
+	Degrees			float64
+	Resolution	Resolution
+	Format			int32
+}
+
+type remoteResponse struct {
+	ID				uint64
+	RC				int
+	Serials		[]string
+	Handle		int
+	Bytes			int
+	Width			int
+	Height		int
+	Tilt			TiltState
+	Frames		[]remoteFrame
+}
+
+// A frame in transit; depth values are sent as little endian bytes.
+type remoteFrame struct {
+	Handle		int
+	Depth			bool
+	Timestamp	uint32
+	Data			[]byte
+}
+
+// Exports the devices of the context to clients connecting with Dial, until the listener is closed. Each client may
+// open any device the host has not opened itself; the devices a client opened are closed when it disconnects.
+// Clients are not authenticated and the connection is not encrypted, so the listener must only be reachable from
+// trusted networks, such as the loopback interface or a private LAN.
+func (freenect *Freenect) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go freenect.serveRemote(conn)
+	}
+}
+
+// The state of one client connection on the server.
+type remoteSession struct {
+	freenect	*Freenect
+	conn			net.Conn
+	writer		*bufio.Writer
+	encoder		*gob.Encoder
+	wlock			sync.Mutex
+	lock			sync.Mutex
+	handles		map[int]*remoteHandle
+	next			int
+	pending		map[int]remoteFrame
+	ready			chan bool
+	done			chan bool
+}
+
+type remoteHandle struct {
+	device	*Device
+	video		*VideoCamera
+	depth		*DepthCamera
+}
+
+func (freenect *Freenect) serveRemote(conn net.Conn) {
+	s := &remoteSession{freenect: freenect, conn: conn, writer: bufio.NewWriter(conn), handles: map[int]*remoteHandle{},
+		pending: map[int]remoteFrame{}, ready: make(chan bool, 1), done: make(chan bool)}
+	s.encoder = gob.NewEncoder(s.writer)
+	log := freenect.structured().With("remote", conn.RemoteAddr().String())
+	log.Info("remote client connected")
+
+	var wg sync.WaitGroup
+	decoder := gob.NewDecoder(bufio.NewReader(conn))
+	for {
+		var req remoteRequest
+		if err := decoder.Decode(&req); err != nil {
+			if err != io.EOF {
+				log.Warn("remote client failed", "err", err)
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.respond(s.handle(req))
+		}()
+	}
+
+	close(s.done)
+	wg.Wait()
+	conn.Close()
+
+	s.lock.Lock()
+	handles := s.handles
+	s.handles = nil
+	s.lock.Unlock()
+	for _, h := range handles {
+		h.device.Close()
+	}
+	log.Info("remote client disconnected")
+}
+
+func (s *remoteSession) respond(resp remoteResponse) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if s.encoder.Encode(resp) == nil {
+		s.writer.Flush()
+	}
+}
+
+func (s *remoteSession) lookup(handle int) *remoteHandle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.handles[handle]
+}
+
+// Carries out a request. Calls on unknown handles fail with DEVICE_NOT_OPEN.
+func (s *remoteSession) handle(req remoteRequest) remoteResponse {
+	resp := remoteResponse{ID: req.ID}
+	switch req.Op {
+	case opDevices:
+		resp.Serials = s.freenect.backend.devices()
+		return resp
+	case opOpen:
+		resp.Handle, resp.RC = s.open(req.Index, req.Serial)
+		return resp
+	case opFrames:
+		resp.Frames = s.frames()
+		return resp
+	}
+
+	h := s.lookup(req.Handle)
+	if h == nil {
+		resp.RC = DEVICE_NOT_OPEN
+		return resp
+	}
+
+	switch req.Op {
+	case opClose:
+		s.lock.Lock()
+		delete(s.handles, req.Handle)
+		s.lock.Unlock()
+		resp.RC = h.device.Close()
+	case opLED:
+		resp.RC = h.device.LED(LEDOption(req.Value))
+	case opFlag:
+		resp.RC = h.device.SetFlag(Flag(req.Value), req.On)
+	case opTiltState:
+		tilt := h.device.GetTilt()
+		resp.Tilt = tilt.Latest()
+	case opTilt:
+		resp.RC = h.device.GetTilt().SetAngle(req.Degrees)
+	case opVideoMode:
+		var mode frameMode
+		mode, resp.RC = s.videoMode(req.Handle, h, req.Resolution, VideoFormat(req.Format))
+		resp.Bytes, resp.Width, resp.Height = mode.bytes, mode.width, mode.height
+	case opDepthMode:
+		var mode frameMode
+		mode, resp.RC = s.depthMode(req.Handle, h, req.Resolution, DepthFormat(req.Format))
+		resp.Bytes, resp.Width, resp.Height = mode.bytes, mode.width, mode.height
+	case opStartVideo, opStopVideo, opStartDepth, opStopDepth:
+		resp.RC = s.control(h, req.Op)
+	}
+	return resp
+}
+
+// Opens a device for the client. An index is a position in the enumeration sent for opDevices, not in the host's
+// known devices, whose order differs once devices come and go, so it is resolved against a fresh enumeration.
+func (s *remoteSession) open(index int, serial string) (int, int) {
+	if index >= 0 {
+		serials := s.freenect.backend.devices()
+		if index >= len(serials) {
+			return 0, -1
+		}
+		serial = serials[index]
+	}
+
+	var device *Device
+	if serial != "" {
+		device = s.freenect.deviceFor(serial)
+	} else {
+		// without serial numbers a device is only known by its position, which Open uses as it stands
+		for _, d := range s.freenect.attached() {
+			if index >= 0 && d.serial == "" && d.index == index {
+				device = d
+			}
+		}
+	}
+	if device == nil {
+		return 0, -1
+	}
+
+	rc := device.Open()
+	if rc == 1 {
+		// opened by the host or another client
+		return 0, -1
+	}
+	if rc != 0 {
+		return 0, rc
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.next++
+	s.handles[s.next] = &remoteHandle{device: device}
+	return s.next, 0
+}
+
+// Sets the mode by creating a camera on the host whose sink queues the frames for the client. Returns the mode as
+// the camera resolved it.
+func (s *remoteSession) videoMode(handle int, h *remoteHandle, res Resolution, format VideoFormat) (frameMode, int) {
+	var buffer []byte
+	source := func(bytes int) []byte {
+		if buffer == nil {
+			buffer = make([]byte, bytes)
+			return buffer
+		}
+		return nil
+	}
+	sink := func(frame []byte, stamp int32) {
+		s.queue(remoteFrame{Handle: handle, Timestamp: uint32(stamp), Data: append([]byte(nil), frame...)})
+	}
+
+	camera, rc := h.device.VideoCamera(res, format, source, sink)
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+	s.lock.Lock()
+	h.video = camera
+	s.lock.Unlock()
+
+	camera.lock.Lock()
+	defer camera.lock.Unlock()
+	return camera.mode, 0
+}
+
+// See videoMode.
+func (s *remoteSession) depthMode(handle int, h *remoteHandle, res Resolution, format DepthFormat) (frameMode, int) {
+	var buffer []uint16
+	source := func(bytes int) []uint16 {
+		if buffer == nil {
+			buffer = make([]uint16, bytes/2)
+			return buffer
+		}
+		return nil
+	}
+	sink := func(frame []uint16, stamp int32) {
+		data := make([]byte, len(frame)*2)
+		for i, v := range frame {
+			data[i*2], data[i*2+1] = byte(v), byte(v>>8)
+		}
+		s.queue(remoteFrame{Handle: handle, Depth: true, Timestamp: uint32(stamp), Data: data})
+	}
+
+	camera, rc := h.device.DepthCamera(res, format, source, sink)
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+	s.lock.Lock()
+	h.depth = camera
+	s.lock.Unlock()
+
+	camera.lock.Lock()
+	defer camera.lock.Unlock()
+	return camera.mode, 0
+}
+
+func (s *remoteSession) control(h *remoteHandle, op int) int {
+	s.lock.Lock()
+	video, depth := h.video, h.depth
+	s.lock.Unlock()
+
+	if (op == opStartVideo || op == opStopVideo) && video == nil {
+		return -998
+	}
+	if (op == opStartDepth || op == opStopDepth) && depth == nil {
+		return -998
+	}
+
+	switch op {
+	case opStartVideo:
+		return video.Start()
+	case opStopVideo:
+		video.Stop()
+	case opStartDepth:
+		return depth.Start()
+	case opStopDepth:
+		depth.Stop()
+	}
+	return 0
+}
+
+// Holds the frame for the client, replacing any older frame of the same stream it has not collected yet.
+func (s *remoteSession) queue(frame remoteFrame) {
+	key := frame.Handle * 2
+	if frame.Depth {
+		key++
+	}
+
+	s.lock.Lock()
+	s.pending[key] = frame
+	s.lock.Unlock()
+
+	select {
+	case s.ready <- true:
+	default:
+	}
+}
+
+// Returns the frames waiting for the client, holding on briefly if there are none.
+func (s *remoteSession) frames() []remoteFrame {
+	timer := time.NewTimer(remotePoll)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		frames := make([]remoteFrame, 0, len(s.pending))
+		for key, frame := range s.pending {
+			frames = append(frames, frame)
+			delete(s.pending, key)
+		}
+		s.lock.Unlock()
+		if len(frames) > 0 {
+			return frames
+		}
+
+		select {
+		case <-s.ready:
+		case <-timer.C:
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// The backend standing in for a host's devices on the client side.
+type remote struct {
+	conn			net.Conn
+	writer		*bufio.Writer
+	encoder		*gob.Encoder
+	wlock			sync.Mutex
+	lock			sync.Mutex
+	calls			map[uint64]chan remoteResponse
+	next			uint64
+	broken		bool
+	opened		map[int]*remoteDevice
+	// held while frames are delivered, so a stream stopped by another go routine receives no further frames
+	events		sync.Mutex
+}
+
+type remoteDevice struct {
+	remote	*remote
+	handle	int
+	owner		*Device
+	lock		sync.Mutex
+	video		unsafe.Pointer
+	depth		unsafe.Pointer
+	vbytes	int
+	dbytes	int
+}
+
+// Connects to a host serving its devices with Serve and returns a context whose Devices are the host's. They are
+// used exactly like local ones; frames are copied into the buffers given by the camera sources as they arrive.
+func Dial(address string) (*Freenect, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &remote{conn: conn, writer: bufio.NewWriter(conn), calls: map[uint64]chan remoteResponse{},
+		opened: map[int]*remoteDevice{}}
+	r.encoder = gob.NewEncoder(r.writer)
+	go r.receive()
+
+	if _, rc := r.call(remoteRequest{Op: opDevices}); rc == REMOTE_FAILED {
+		conn.Close()
+		return nil, errors.New("freenect: remote host did not respond")
+	}
+	return start(r), nil
+}
+
+// Reads responses and hands them to the waiting calls. Once the connection fails every call fails with REMOTE_FAILED.
+func (r *remote) receive() {
+	decoder := gob.NewDecoder(bufio.NewReader(r.conn))
+	for {
+		var resp remoteResponse
+		if err := decoder.Decode(&resp); err != nil {
+			break
+		}
+		r.lock.Lock()
+		ch := r.calls[resp.ID]
+		delete(r.calls, resp.ID)
+		r.lock.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+
+	r.lock.Lock()
+	r.broken = true
+	for id, ch := range r.calls {
+		close(ch)
+		delete(r.calls, id)
+	}
+	r.lock.Unlock()
+}
+
+// Sends a request and waits for its response. The return code is REMOTE_FAILED if the connection has failed,
+// otherwise the one from the host.
+func (r *remote) call(req remoteRequest) (remoteResponse, int) {
+	ch := make(chan remoteResponse, 1)
+	r.lock.Lock()
+	if r.broken {
+		r.lock.Unlock()
+		return remoteResponse{}, REMOTE_FAILED
+	}
+	r.next++
+	req.ID = r.next
+	r.calls[req.ID] = ch
+	r.lock.Unlock()
+
+	r.wlock.Lock()
+	err := r.encoder.Encode(req)
+	if err == nil {
+		err = r.writer.Flush()
+	}
+	r.wlock.Unlock()
+	if err != nil {
+		r.conn.Close()
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		return remoteResponse{}, REMOTE_FAILED
+	}
+	return resp, resp.RC
+}
+
+func (r *remote) attach(freenect *Freenect) {
+}
+
+func (r *remote) devices() []string {
+	resp, _ := r.call(remoteRequest{Op: opDevices})
+	return resp.Serials
+}
+
+func (r *remote) open(index int, serial string, owner *Device) (deviceBackend, int) {
+	resp, rc := r.call(remoteRequest{Op: opOpen, Index: index, Serial: serial})
+	if rc != 0 {
+		return nil, rc
+	}
+
+	dev := &remoteDevice{remote: r, handle: resp.Handle, owner: owner}
+	r.lock.Lock()
+	r.opened[resp.Handle] = dev
+	r.lock.Unlock()
+	return dev, 0
+}
+
+// Collects the frames the host has waiting and delivers them.
+func (r *remote) process() int {
+	resp, rc := r.call(remoteRequest{Op: opFrames})
+	if rc != 0 {
+		return rc
+	}
+
+	r.events.Lock()
+	defer r.events.Unlock()
+	for _, frame := range resp.Frames {
+		r.lock.Lock()
+		dev := r.opened[frame.Handle]
+		r.lock.Unlock()
+		if dev != nil {
+			dev.deliver(frame)
+		}
+	}
+	return 0
+}
+
+// The host's libfreenect log stays on the host.
+func (r *remote) setLogLevel(level LoggerLevel) {
+}
+
+func (r *remote) shutdown() int {
+	r.conn.Close()
+	return 0
+}
+
+func (dev *remoteDevice) deliver(frame remoteFrame) {
+	dev.lock.Lock()
+	buffer, bytes := dev.video, dev.vbytes
+	if frame.Depth {
+		buffer, bytes = dev.depth, dev.dbytes
+	}
+	if buffer == nil || len(frame.Data) != bytes {
+		dev.lock.Unlock()
+		return
+	}
+	copy(unsafe.Slice((*byte)(buffer), bytes), frame.Data)
+	dev.lock.Unlock()
+
+	if frame.Depth {
+		dev.owner.depthFrame(buffer, frame.Timestamp)
+	} else {
+		dev.owner.videoFrame(buffer, frame.Timestamp)
+	}
+}
+
+func (dev *remoteDevice) call(req remoteRequest) (remoteResponse, int) {
+	req.Handle = dev.handle
+	return dev.remote.call(req)
+}
+
+func (dev *remoteDevice) close() int {
+	dev.remote.events.Lock()
+	dev.remote.lock.Lock()
+	delete(dev.remote.opened, dev.handle)
+	dev.remote.lock.Unlock()
+	dev.remote.events.Unlock()
+
+	_, rc := dev.call(remoteRequest{Op: opClose})
+	return rc
+}
+
+func (dev *remoteDevice) setLED(option LEDOption) int {
+	_, rc := dev.call(remoteRequest{Op: opLED, Value: int(option)})
+	return rc
+}
+
+func (dev *remoteDevice) setFlag(flag Flag, on bool) int {
+	_, rc := dev.call(remoteRequest{Op: opFlag, Value: int(flag), On: on})
+	return rc
+}
+
+func (dev *remoteDevice) tiltState() (TiltState, int) {
+	resp, rc := dev.call(remoteRequest{Op: opTiltState})
+	return resp.Tilt, rc
+}
+
+func (dev *remoteDevice) setTilt(deg float64) int {
+	_, rc := dev.call(remoteRequest{Op: opTilt, Degrees: deg})
+	return rc
+}
+
+func (dev *remoteDevice) setVideoMode(res Resolution, format VideoFormat) (frameMode, int) {
+	resp, rc := dev.call(remoteRequest{Op: opVideoMode, Resolution: res, Format: int32(format)})
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+	dev.lock.Lock()
+	dev.vbytes = resp.Bytes
+	dev.lock.Unlock()
+	return frameMode{resp.Bytes, resp.Width, resp.Height}, 0
+}
+
+func (dev *remoteDevice) setDepthMode(res Resolution, format DepthFormat) (frameMode, int) {
+	resp, rc := dev.call(remoteRequest{Op: opDepthMode, Resolution: res, Format: int32(format)})
+	if rc != 0 {
+		return frameMode{}, rc
+	}
+	dev.lock.Lock()
+	dev.dbytes = resp.Bytes
+	dev.lock.Unlock()
+	return frameMode{resp.Bytes, resp.Width, resp.Height}, 0
+}
+
+func (dev *remoteDevice) setVideoBuffer(buffer unsafe.Pointer) int {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	dev.video = buffer
+	return 0
+}
+
+func (dev *remoteDevice) setDepthBuffer(buffer unsafe.Pointer) int {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	dev.depth = buffer
+	return 0
+}
+
+func (dev *remoteDevice) startVideo() int {
+	_, rc := dev.call(remoteRequest{Op: opStartVideo})
+	return rc
+}
+
+// Waits for any frame being delivered, so no frame of the stream arrives once this returns.
+func (dev *remoteDevice) stopVideo() int {
+	_, rc := dev.call(remoteRequest{Op: opStopVideo})
+	dev.remote.events.Lock()
+	dev.lock.Lock()
+	dev.video = nil
+	dev.lock.Unlock()
+	dev.remote.events.Unlock()
+	return rc
+}
+
+func (dev *remoteDevice) startDepth() int {
+	_, rc := dev.call(remoteRequest{Op: opStartDepth})
+	return rc
+}
+
+// See stopVideo.
+func (dev *remoteDevice) stopDepth() int {
+	_, rc := dev.call(remoteRequest{Op: opStopDepth})
+	dev.remote.events.Lock()
+	dev.lock.Lock()
+	dev.depth = nil
+	dev.lock.Unlock()
+	dev.remote.events.Unlock()
+	return rc
+}
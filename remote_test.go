@@ -0,0 +1,135 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"freenect"
+)
+
+// Serves a simulated device over the loopback interface and drives it through a remote context.
+func TestRemote(t *testing.T) {
+	host, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer host.Shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go host.Serve(listener)
+
+	lib, err := freenect.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Shutdown()
+
+	if len(lib.Devices) != 1 || lib.Devices[0].Serial() != host.Devices[0].Serial() {
+		t.Fatalf("expected the host's device, got %d devices", len(lib.Devices))
+	}
+	dev := lib.Devices[0]
+	if rc = dev.Open(); rc != 0 {
+		t.Fatalf("Open failed: %d", rc)
+	}
+
+	// a second client cannot take the device over
+	other, err := freenect.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc = other.Devices[0].Open(); rc == 0 {
+		t.Error("expected a device in use to be refused")
+	}
+	other.Shutdown()
+
+	if rc = dev.LED(freenect.RED); rc != 0 {
+		t.Errorf("LED failed: %d", rc)
+	}
+	if rc = dev.SetFlag(freenect.MIRROR_DEPTH, true); rc != 0 {
+		t.Errorf("SetFlag failed: %d", rc)
+	}
+	tilt := dev.GetTilt()
+	if rc = tilt.MoveTo(context.Background(), -5); rc != 0 {
+		t.Errorf("MoveTo failed: %d", rc)
+	}
+	if tilt.Angle > -4 || tilt.Angle < -6 {
+		t.Errorf("expected -5 degrees, got %f", tilt.Angle)
+	}
+
+	frames := make(chan []uint16, 1)
+	depth, rc := dev.DepthCamera(freenect.MEDIUM, freenect.MM,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) },
+		func(frame []uint16, stamp int32) {
+			select {
+			case frames <- append([]uint16(nil), frame...):
+			default:
+			}
+		})
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+	if _, rc = dev.DepthCamera(freenect.LOW, freenect.MM, nil, nil); rc != -999 {
+		t.Errorf("expected the host to refuse an invalid mode, got %d", rc)
+	}
+	if rc = depth.Start(); rc != 0 {
+		t.Fatalf("Start failed: %d", rc)
+	}
+
+	select {
+	case frame := <-frames:
+		if len(frame) != 640*480 || frame[0] != 3000 {
+			t.Errorf("expected the simulated scene, got %d values starting %d", len(frame), frame[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame arrived")
+	}
+
+	// mode requests race neither each other nor the polling for frames
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, rc := dev.VideoCamera(freenect.MEDIUM, freenect.RGB,
+				func(bytes int) []byte { return make([]byte, bytes) }, func(frame []byte, stamp int32) {}); rc != 0 {
+				t.Errorf("VideoCamera failed: %d", rc)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rc = depth.Stop(); rc != 0 {
+		t.Errorf("Stop failed: %d", rc)
+	}
+	if rc = dev.Close(); rc != 0 {
+		t.Errorf("Close failed: %d", rc)
+	}
+
+	// closing frees the device on the host
+	if rc = host.Devices[0].Open(); rc != 0 {
+		t.Errorf("expected the host to reopen the device, got %d", rc)
+	}
+	host.Devices[0].Close()
+}
@@ -0,0 +1,483 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	simFrameInterval	= time.Second / 30
+	simIdle						= 10 * time.Millisecond
+	simTiltSpeed			= 30.0	// degrees per second
+	simTiltLimit			= 31.0
+	simGravity				= 9.80665
+)
+
+// A backend generating synthetic frames and motor movement, so the library can be exercised without hardware.
+type simulator struct {
+	lock			sync.Mutex
+	// held while frames are delivered, so a stream stopped by another go routine receives no further frames
+	events		sync.Mutex
+	serials		[]string
+	opened		map[string]*simDevice
+	start			time.Time
+}
+
+type simStream struct {
+	mode		frameMode
+	format	int32
+	buffer	unsafe.Pointer
+	running	bool
+	next		time.Time
+	frames	int
+}
+
+type simDevice struct {
+	sim				*simulator
+	serial		string
+	owner			*Device
+	closed		bool
+	gone			bool
+	video			simStream
+	depth			simStream
+	led				LEDOption
+	flags			map[Flag]bool
+	angle			float64
+	target		float64
+	moved			time.Time
+}
+
+// Creates a context backed by count simulated devices instead of libfreenect. The devices stream synthetic video
+// and depth frames at 30 frames per second and have a working motor, accelerometer and LED. Any number of simulated
+// contexts may exist alongside a real one.
+func Simulate(count int) (*Freenect, int) {
+	if count < 0 {
+		return nil, -998
+	}
+
+	sim := &simulator{opened: map[string]*simDevice{}, start: time.Now()}
+	for x := 0; x < count; x++ {
+		sim.serials = append(sim.serials, fmt.Sprintf("SIM%08d", x))
+	}
+	return start(sim), 0
+}
+
+func (sim *simulator) attach(freenect *Freenect) {
+}
+
+func (sim *simulator) devices() []string {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return append([]string{}, sim.serials...)
+}
+
+func (sim *simulator) open(index int, serial string, owner *Device) (deviceBackend, int) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	if index >= 0 {
+		if index >= len(sim.serials) {
+			return nil, -1
+		}
+		serial = sim.serials[index]
+	} else {
+		found := false
+		for _, s := range sim.serials {
+			found = found || s == serial
+		}
+		if !found {
+			return nil, -1
+		}
+	}
+	if _, ok := sim.opened[serial]; ok {
+		return nil, -1
+	}
+
+	dev := &simDevice{sim: sim, serial: serial, owner: owner, moved: time.Now()}
+	sim.opened[serial] = dev
+	return dev, 0
+}
+
+// Detaches a device from the simulated bus. An open handle stops delivering frames and fails every call.
+func (sim *simulator) unplug(serial string) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	for x, s := range sim.serials {
+		if s == serial {
+			sim.serials = append(sim.serials[:x], sim.serials[x+1:]...)
+			break
+		}
+	}
+	if dev, ok := sim.opened[serial]; ok {
+		dev.gone = true
+		delete(sim.opened, serial)
+	}
+}
+
+// Attaches a device to the simulated bus.
+func (sim *simulator) plug(serial string) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	sim.serials = append(sim.serials, serial)
+}
+
+type simFrame struct {
+	owner			*Device
+	depth			bool
+	buffer		unsafe.Pointer
+	timestamp	uint32
+}
+
+// Waits until the next frame is due, or briefly if no stream is running, then renders and delivers the frames due.
+func (sim *simulator) process() int {
+	sim.lock.Lock()
+	now := time.Now()
+	wait := simIdle
+	for _, dev := range sim.opened {
+		for _, s := range []*simStream{&dev.video, &dev.depth} {
+			if s.running && s.next.Sub(now) < wait {
+				wait = s.next.Sub(now)
+			}
+		}
+	}
+	sim.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	sim.events.Lock()
+	defer sim.events.Unlock()
+
+	sim.lock.Lock()
+	now = time.Now()
+	frames := []simFrame{}
+	for _, dev := range sim.opened {
+		if dev.video.running && !now.Before(dev.video.next) {
+			dev.renderVideo(now)
+			frames = append(frames, simFrame{dev.owner, false, dev.video.buffer, sim.timestamp(now)})
+		}
+		if dev.depth.running && !now.Before(dev.depth.next) {
+			dev.renderDepth(now)
+			frames = append(frames, simFrame{dev.owner, true, dev.depth.buffer, sim.timestamp(now)})
+		}
+	}
+	sim.lock.Unlock()
+
+	for _, frame := range frames {
+		if frame.depth {
+			frame.owner.depthFrame(frame.buffer, frame.timestamp)
+		} else {
+			frame.owner.videoFrame(frame.buffer, frame.timestamp)
+		}
+	}
+	return 0
+}
+
+// Frame timestamps count ticks of the 60MHz camera clock, as the device's do.
+func (sim *simulator) timestamp(now time.Time) uint32 {
+	return uint32(now.Sub(sim.start).Seconds() * 60e6)
+}
+
+func (sim *simulator) setLogLevel(level LoggerLevel) {
+}
+
+func (sim *simulator) shutdown() int {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	for serial, dev := range sim.opened {
+		dev.closed = true
+		delete(sim.opened, serial)
+	}
+	return 0
+}
+
+// Must be called with the simulator lock held. Returns false if the handle can no longer be used.
+func (dev *simDevice) usable() bool {
+	return !dev.closed && !dev.gone
+}
+
+func (dev *simDevice) close() int {
+	dev.sim.events.Lock()
+	defer dev.sim.events.Unlock()
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+
+	if dev.closed {
+		return -1
+	}
+	dev.closed = true
+	if dev.sim.opened[dev.serial] == dev {
+		delete(dev.sim.opened, dev.serial)
+	}
+	return 0
+}
+
+func (dev *simDevice) setLED(option LEDOption) int {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	dev.led = option
+	return 0
+}
+
+func (dev *simDevice) setFlag(flag Flag, on bool) int {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	if dev.flags == nil {
+		dev.flags = map[Flag]bool{}
+	}
+	dev.flags[flag] = on
+	return 0
+}
+
+// Must be called with the simulator lock held. Moves the motor towards its target at a constant speed.
+func (dev *simDevice) move(now time.Time) {
+	step := simTiltSpeed * now.Sub(dev.moved).Seconds()
+	dev.moved = now
+	if math.Abs(dev.target-dev.angle) <= step {
+		dev.angle = dev.target
+	} else if dev.target > dev.angle {
+		dev.angle += step
+	} else {
+		dev.angle -= step
+	}
+}
+
+func (dev *simDevice) tiltState() (TiltState, int) {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return TiltState{}, -1
+	}
+
+	dev.move(time.Now())
+	status := TILT_MOVING
+	switch {
+	case math.Abs(dev.angle) >= simTiltLimit:
+		status = TILT_AT_LIMIT
+	case dev.angle == dev.target:
+		status = TILT_STOPPED
+	}
+
+	rad := dev.angle * math.Pi / 180
+	return TiltState{
+		Angle:		float32(dev.angle),
+		Status:		status,
+		AccelX:		0,
+		AccelY:		float32(simGravity * math.Cos(rad)),
+		AccelZ:		float32(simGravity * math.Sin(rad)),
+	}, 0
+}
+
+func (dev *simDevice) setTilt(deg float64) int {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	dev.move(time.Now())
+	dev.target = math.Max(-simTiltLimit, math.Min(simTiltLimit, deg))
+	return 0
+}
+
+// Returns the frame size of a video mode, as libfreenect's mode table does, or false if the mode is not supported.
+func simVideoMode(res Resolution, format VideoFormat) (frameMode, bool) {
+	width, height := 640, 480
+	switch res {
+	case MEDIUM:
+	case HIGH:
+		if format != RGB && format != BAYER && format != IR_8BIT && format != IR_10BIT {
+			return frameMode{}, false
+		}
+		width, height = 1280, 1024
+	default:
+		return frameMode{}, false
+	}
+
+	switch format {
+	case RGB, YUV_RGB:
+		return frameMode{width * height * 3, width, height}, true
+	case BAYER, IR_8BIT:
+		return frameMode{width * height, width, height}, true
+	case IR_10BIT:
+		return frameMode{width * height * 2, width, height}, true
+	}
+	return frameMode{}, false
+}
+
+func (dev *simDevice) setVideoMode(res Resolution, format VideoFormat) (frameMode, int) {
+	mode, ok := simVideoMode(res, format)
+	if !ok {
+		return frameMode{}, -999
+	}
+
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return frameMode{}, -1
+	}
+	dev.video.mode = mode
+	dev.video.format = int32(format)
+	return mode, 0
+}
+
+func (dev *simDevice) setDepthMode(res Resolution, format DepthFormat) (frameMode, int) {
+	if res != MEDIUM {
+		return frameMode{}, -999
+	}
+	switch format {
+	case D11BIT, D10BIT, REGISTERED, MM:
+	default:
+		return frameMode{}, -999
+	}
+
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return frameMode{}, -1
+	}
+	dev.depth.mode = frameMode{640 * 480 * 2, 640, 480}
+	dev.depth.format = int32(format)
+	return dev.depth.mode, 0
+}
+
+func (dev *simDevice) setVideoBuffer(buffer unsafe.Pointer) int {
+	return dev.setBuffer(&dev.video, buffer)
+}
+
+func (dev *simDevice) setDepthBuffer(buffer unsafe.Pointer) int {
+	return dev.setBuffer(&dev.depth, buffer)
+}
+
+func (dev *simDevice) setBuffer(s *simStream, buffer unsafe.Pointer) int {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	s.buffer = buffer
+	return 0
+}
+
+func (dev *simDevice) startVideo() int {
+	return dev.startStream(&dev.video)
+}
+
+func (dev *simDevice) stopVideo() int {
+	return dev.stopStream(&dev.video)
+}
+
+func (dev *simDevice) startDepth() int {
+	return dev.startStream(&dev.depth)
+}
+
+func (dev *simDevice) stopDepth() int {
+	return dev.stopStream(&dev.depth)
+}
+
+func (dev *simDevice) startStream(s *simStream) int {
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	if s.mode.bytes == 0 || s.buffer == nil {
+		return -1
+	}
+	s.running = true
+	s.next = time.Now().Add(simFrameInterval)
+	return 0
+}
+
+// Waits for any frame being delivered, so no frame of the stream arrives once this returns.
+func (dev *simDevice) stopStream(s *simStream) int {
+	dev.sim.events.Lock()
+	defer dev.sim.events.Unlock()
+	dev.sim.lock.Lock()
+	defer dev.sim.lock.Unlock()
+	if !dev.usable() {
+		return -1
+	}
+	s.running = false
+	return 0
+}
+
+// Must be called with the simulator lock held. Draws a diagonal gradient drifting one pixel per frame.
+func (dev *simDevice) renderVideo(now time.Time) {
+	s := &dev.video
+	s.next = now.Add(simFrameInterval)
+	s.frames++
+
+	pixels := s.mode.width * s.mode.height
+	channels := s.mode.bytes / pixels
+	buffer := unsafe.Slice((*byte)(s.buffer), s.mode.bytes)
+	for y := 0; y < s.mode.height; y++ {
+		for x := 0; x < s.mode.width; x++ {
+			i := (y*s.mode.width + x) * channels
+			v := byte(x + y + s.frames)
+			for c := 0; c < channels; c++ {
+				buffer[i+c] = v + byte(c*85)
+			}
+		}
+	}
+}
+
+// Must be called with the simulator lock held. Draws a back wall at 3m with a ball swinging across it at 1.5m.
+func (dev *simDevice) renderDepth(now time.Time) {
+	s := &dev.depth
+	s.next = now.Add(simFrameInterval)
+	s.frames++
+
+	width, height := s.mode.width, s.mode.height
+	phase := float64(s.frames) * 2 * math.Pi / 90
+	cx, cy, r := float64(width)/2+float64(width)/4*math.Sin(phase), float64(height)/2, float64(height)/6
+
+	buffer := unsafe.Slice((*uint16)(s.buffer), width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mm := 3000.0
+			dx, dy := float64(x)-cx, float64(y)-cy
+			if d := dx*dx + dy*dy; d < r*r {
+				mm = 1500 - 200*math.Sqrt(1-d/(r*r))
+			}
+			buffer[y*width+x] = simDepth(DepthFormat(s.format), mm)
+		}
+	}
+}
+
+// Encodes a distance in millimeters in the given depth format.
+func simDepth(format DepthFormat, mm float64) uint16 {
+	switch format {
+	case MM, REGISTERED:
+		return uint16(mm)
+	case D10BIT:
+		return simDepth(D11BIT, mm) >> 1
+	}
+	raw := (1000/mm - 3.3309495161) / -0.0030711016
+	return uint16(math.Max(0, math.Min(2046, raw)))
+}
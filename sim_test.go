@@ -0,0 +1,459 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests run against the simulated backend, so they need no hardware. Run them with -race.
+
+func simulate(t *testing.T) (*Freenect, *Device) {
+	lib, rc := Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	dev := lib.Devices[0]
+	if rc = dev.Open(); rc != 0 {
+		t.Fatalf("Open failed: %d", rc)
+	}
+	return lib, dev
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimulatedStreams(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	if _, rc := dev.DepthCamera(LOW, D11BIT, nil, nil); rc != -999 {
+		t.Errorf("expected -999 for an unsupported mode, got %d", rc)
+	}
+
+	var videoFrames, depthFrames atomic.Int64
+	video, rc := dev.VideoCamera(MEDIUM, RGB,
+		func(bytes int) []byte { return make([]byte, bytes) },
+		func(frame []byte, stamp int32) { videoFrames.Add(1) })
+	if rc != 0 {
+		t.Fatalf("VideoCamera failed: %d", rc)
+	}
+	depth, rc := dev.DepthCamera(MEDIUM, MM,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) },
+		func(frame []uint16, stamp int32) {
+			if frame[0] != 3000 {
+				t.Errorf("expected the back wall at 3000mm, got %d", frame[0])
+			}
+			depthFrames.Add(1)
+		})
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+
+	if video.Start() != 0 || depth.Start() != 0 {
+		t.Fatal("failed to start streams")
+	}
+	if video.Start() != 1 {
+		t.Error("expected 1 when starting a running stream")
+	}
+	if video.State() != StreamRunning {
+		t.Errorf("expected running, got %d", video.State())
+	}
+	waitFor(t, "frames", func() bool { return videoFrames.Load() >= 5 && depthFrames.Load() >= 5 })
+
+	if video.Stop() != 0 || depth.Stop() != 0 {
+		t.Fatal("failed to stop streams")
+	}
+	if video.Stop() != 1 {
+		t.Error("expected 1 when stopping an idle stream")
+	}
+	seen := videoFrames.Load()
+	time.Sleep(100 * time.Millisecond)
+	if n := videoFrames.Load(); n != seen {
+		t.Errorf("received %d frames after Stop", n-seen)
+	}
+	if stats := video.Stats(); stats.Received != uint64(seen) {
+		t.Errorf("expected %d frames in stats, got %d", seen, stats.Received)
+	}
+
+	// a stopped stream can be started again
+	if video.Start() != 0 {
+		t.Fatal("failed to restart video")
+	}
+	waitFor(t, "frames after restart", func() bool { return videoFrames.Load() > seen })
+	video.Stop()
+}
+
+func TestSimulatedTilt(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	tilt := dev.GetTilt()
+	if rc := tilt.MoveTo(context.Background(), 10); rc != 0 {
+		t.Fatalf("MoveTo failed: %d", rc)
+	}
+	if tilt.Angle < 9 || tilt.Angle > 11 {
+		t.Errorf("expected 10 degrees, got %f", tilt.Angle)
+	}
+	if o := tilt.Latest().Accel().Orientation(); o.Pitch < 9 || o.Pitch > 11 {
+		t.Errorf("expected a pitch of 10 degrees, got %f", o.Pitch)
+	}
+}
+
+func TestSweepAngles(t *testing.T) {
+	for _, c := range []struct {
+		from, to, step	float64
+		stops					int
+	}{
+		{-20, 20, 10, 5},
+		{20, -20, 10, 5},
+		{0, 27, 2.7, 11},
+		{0, 1, 0.1, 11},
+		{0, 25, 10, 4},
+		{5, 5, 1, 1},
+	} {
+		angles := sweepAngles(c.from, c.to, c.step)
+		if len(angles) != c.stops || angles[0] != c.from || angles[len(angles)-1] != c.to {
+			t.Errorf("sweep from %v to %v by %v: expected %d stops ending at %v, got %v", c.from, c.to, c.step, c.stops, c.to, angles)
+		}
+	}
+}
+
+func TestSettled(t *testing.T) {
+	// moving away from a limit, the first poll still reports the limit
+	moved := false
+	for i, c := range []struct {
+		angle		float32
+		status	int
+		done		bool
+	}{
+		{27, TILT_AT_LIMIT, false},
+		{20, TILT_MOVING, false},
+		{0.5, TILT_STOPPED, true},
+	} {
+		if done := settled(TiltState{Angle: c.angle, Status: c.status}, 0, &moved); done != c.done {
+			t.Errorf("poll %d: expected done %v, got %v", i, c.done, done)
+		}
+	}
+
+	// a limit reached on the way to the target ends the move
+	moved = false
+	settled(TiltState{Angle: 10, Status: TILT_MOVING}, 27, &moved)
+	if !settled(TiltState{Angle: 25, Status: TILT_AT_LIMIT}, 27, &moved) {
+		t.Errorf("expected the limit to end the move")
+	}
+}
+
+func TestRegisterLEDPattern(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	blink := LEDPattern{Steps: []LEDStep{{BLINK_GREEN, time.Millisecond}}, Repeat: true}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			RegisterLEDPattern("blink", blink)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		dev.PlayLED("blink")
+	}
+	<-done
+
+	if rc := dev.PlayLED("blink"); rc != 0 {
+		t.Errorf("expected the registered pattern to play, got %d", rc)
+	}
+	dev.StopLED()
+
+	// a pattern is copied as it starts, so changing it does not touch the one playing
+	if rc := dev.PlayLEDPattern(blink); rc != 0 {
+		t.Fatalf("expected the pattern to play, got %d", rc)
+	}
+	for i := 0; i < 10; i++ {
+		blink.Steps[0].Option = LEDOption(i % 2)
+		time.Sleep(time.Millisecond)
+	}
+	dev.StopLED()
+
+	// steps held for no time would spin on the LED
+	spin := LEDPattern{Steps: []LEDStep{{GREEN, time.Second}, {OFF, 0}}, Repeat: true}
+	if err := RegisterLEDPattern("spin", spin); err != ErrLEDPattern {
+		t.Errorf("expected ErrLEDPattern, got %v", err)
+	}
+	if rc := dev.PlayLEDPattern(spin); rc != -998 {
+		t.Errorf("expected the pattern to be refused, got %d", rc)
+	}
+	if rc := dev.PlayLED("spin"); rc != -998 {
+		t.Errorf("expected no pattern registered, got %d", rc)
+	}
+}
+
+func TestExhaustedPool(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	// the sink keeps every frame; with one buffer always in the camera, the pool runs dry after two
+	pool, _ := NewVideoPool(3)
+	defer pool.Free()
+	var lock sync.Mutex
+	var held, copies [][]byte
+	video, rc := dev.VideoCamera(MEDIUM, RGB, pool.Source(), func(frame []byte, stamp int32) {
+		lock.Lock()
+		defer lock.Unlock()
+		held = append(held, frame)
+		copies = append(copies, append([]byte(nil), frame...))
+	})
+	if rc != 0 {
+		t.Fatalf("VideoCamera failed: %d", rc)
+	}
+	if video.Start() != 0 {
+		t.Fatal("failed to start video")
+	}
+	waitFor(t, "dropped frames", func() bool { return video.Stats().Dropped >= 5 })
+	video.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(held) != 2 {
+		t.Fatalf("expected the sink to get a frame per buffer, got %d", len(held))
+	}
+	for i := range held {
+		if string(held[i]) != string(copies[i]) {
+			t.Errorf("frame %d was overwritten while borrowed", i)
+		}
+	}
+}
+
+// A source that hands back the same buffer every time still has each frame delivered.
+func TestSameBufferSource(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	var buffer []byte
+	var received atomic.Int32
+	video, rc := dev.VideoCamera(MEDIUM, RGB, func(bytes int) []byte {
+		if buffer == nil {
+			buffer = make([]byte, bytes)
+		}
+		return buffer
+	}, func(frame []byte, stamp int32) { received.Add(1) })
+	if rc != 0 {
+		t.Fatalf("VideoCamera failed: %d", rc)
+	}
+	if video.Start() != 0 {
+		t.Fatal("failed to start video")
+	}
+	waitFor(t, "frames", func() bool { return received.Load() >= 5 })
+	video.Stop()
+
+	if stats := video.Stats(); stats.Dropped != 0 {
+		t.Errorf("expected no frames dropped, got %d", stats.Dropped)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	device := &Device{index: 1, serial: "a\"b\\c\nd\té"}
+	want := `device="1",serial="a\"b\\c\nd` + "\té" + `",stream="video"`
+	if labels := metricLabels(device, "video"); labels != want {
+		t.Errorf("expected %s, got %s", want, labels)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+
+	pool, _ := NewVideoPool(4)
+	defer pool.Free()
+	video, rc := dev.VideoCamera(MEDIUM, RGB, pool.Source(), func(frame []byte, stamp int32) { pool.Return(frame) })
+	if rc != 0 {
+		t.Fatalf("VideoCamera failed: %d", rc)
+	}
+	depth, rc := dev.DepthCamera(MEDIUM, D11BIT,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) },
+		func(frame []uint16, stamp int32) {})
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+	tilt := dev.GetTilt()
+	tilt.StartPolling(10 * time.Millisecond)
+	defer tilt.StopPolling()
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	hammer := func(f func(x int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for x := 0; ; x++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(x)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	for x := 0; x < 2; x++ {
+		hammer(func(x int) { video.Start(); time.Sleep(50 * time.Millisecond); video.Stop() })
+		hammer(func(x int) { depth.Start(); time.Sleep(40 * time.Millisecond); depth.Stop() })
+	}
+	hammer(func(x int) { dev.LED(LEDOption(x % 6)) })
+	hammer(func(x int) { tilt.SetAngle(float64(x%20 - 10)) })
+	hammer(func(x int) { tilt.Refresh(); tilt.Latest() })
+	hammer(func(x int) { video.Stats(); depth.State(); lib.Stats() })
+	hammer(func(x int) { lib.writeMetrics(io.Discard) })
+
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	video.Stop()
+	depth.Stop()
+	if video.State() != StreamIdle || depth.State() != StreamIdle {
+		t.Error("expected both streams idle")
+	}
+
+	// the streams must still work after the churn
+	received := video.Stats().Received + depth.Stats().Received
+	if video.Start() != 0 || depth.Start() != 0 {
+		t.Fatal("failed to start streams")
+	}
+	waitFor(t, "frames", func() bool { return video.Stats().Received+depth.Stats().Received > received+1 })
+	video.Stop()
+	depth.Stop()
+}
+
+// A remote open by index refers to the enumeration the client was sent, not the order the host first saw devices in.
+func TestRemoteOpenIndex(t *testing.T) {
+	lib, rc := Simulate(2)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+	lib.backend.(*simulator).unplug(lib.Devices[0].Serial())
+
+	s := &remoteSession{freenect: lib, handles: map[int]*remoteHandle{}}
+	handle, rc := s.open(0, "")
+	if rc != 0 {
+		t.Fatalf("open failed: %d", rc)
+	}
+	defer s.handles[handle].device.Close()
+	if serial := s.handles[handle].device.Serial(); serial != lib.Devices[1].Serial() {
+		t.Errorf("expected the device now first, %s, got %s", lib.Devices[1].Serial(), serial)
+	}
+	if _, rc = s.open(1, ""); rc != -1 {
+		t.Errorf("expected no second device, got %d", rc)
+	}
+}
+
+func TestSimulatedReconnect(t *testing.T) {
+	lib, dev := simulate(t)
+	defer lib.Shutdown()
+	defer dev.Close()
+	sim := lib.backend.(*simulator)
+
+	var frames atomic.Int64
+	depth, _ := dev.DepthCamera(MEDIUM, D11BIT,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) },
+		func(frame []uint16, stamp int32) { frames.Add(1) })
+	depth.Start()
+	dev.LED(RED)
+
+	events := lib.Watch(20 * time.Millisecond)
+	if dev.AutoReconnect(true) != 0 {
+		t.Fatal("AutoReconnect failed")
+	}
+
+	serial := dev.Serial()
+	sim.unplug(serial)
+	if event := <-events; event.Type != DeviceRemoved || event.Serial != serial {
+		t.Fatalf("expected removal of %s, got %+v", serial, event)
+	}
+	waitFor(t, "device lost", func() bool { return dev.handle() == nil })
+
+	sim.plug(serial)
+	if event := <-events; event.Type != DeviceAdded {
+		t.Fatalf("expected addition, got %+v", event)
+	}
+	if event := <-events; event.Type != DeviceReconnected || event.Device != dev {
+		t.Fatalf("expected reconnection, got %+v", event)
+	}
+
+	// a device not seen before comes with the event, and opens although the enumeration has changed
+	sim.unplug(serial)
+	waitFor(t, "device lost again", func() bool { return dev.handle() == nil })
+	sim.plug("SIMNEW")
+	sim.plug(serial)
+	var added *Device
+	for added == nil {
+		if event := <-events; event.Type == DeviceAdded && event.Serial == "SIMNEW" {
+			added = event.Device
+		}
+	}
+	if added == nil || added.Serial() != "SIMNEW" || added == dev {
+		t.Fatalf("expected a new device, got %+v", added)
+	}
+	if rc := added.Open(); rc != 0 {
+		t.Fatalf("failed to open the new device: %d", rc)
+	}
+	defer added.Close()
+	waitFor(t, "device reconnected", func() bool { return dev.handle() != nil })
+
+	seen := frames.Load()
+	waitFor(t, "frames after reconnect", func() bool { return frames.Load() > seen })
+	sim.lock.Lock()
+	led := dev.handle().(*simDevice).led
+	sim.lock.Unlock()
+	if led != RED {
+		t.Errorf("expected the LED restored to red, got %d", led)
+	}
+	depth.Stop()
+
+	// the enumeration has changed, but the device is still found by its serial
+	dev.Close()
+	if rc := dev.Open(); rc != 0 || dev.handle().(*simDevice).serial != serial {
+		t.Errorf("expected the device reopened by serial, got %d", rc)
+	}
+
+	// stopping closes the channel
+	lib.StopWatching()
+	for range events {
+	}
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package freenect
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runtime statistics of a video or depth stream. FPS, Jitter and SinkLatency are smoothed over roughly the last
+// second of frames. Dropped counts frames for which the source had no new buffer to offer: either the next frame
+// overwrote the frame in place, or, when the source's pool ran dry, the frame was not delivered.
+type StreamStats struct {
+	Received		uint64
+	Dropped			uint64
+	Errors			uint64
+	FPS					float64
+	Jitter			time.Duration
+	SinkLatency	time.Duration
+	LastFrame		time.Time
+}
+
+// Runtime statistics of the event processing loop.
+type LoopStats struct {
+	Iterations	uint64
+	Errors			uint64
+	LastError		int
+}
+
+// The weight of each new sample in the smoothed statistics.
+const statsSmoothing = 1.0 / 30.0
+
+type streamStats struct {
+	lock			sync.Mutex
+	stats			StreamStats
+	interval	float64
+}
+
+type loopStats struct {
+	lock		sync.Mutex
+	stats		LoopStats
+}
+
+// Records the arrival of a frame and the time the sink took to process it.
+func (s *streamStats) frame(arrived time.Time, sink time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.stats.LastFrame.IsZero() {
+		interval := arrived.Sub(s.stats.LastFrame).Seconds()
+		if s.interval == 0 {
+			s.interval = interval
+		}
+		deviation := math.Abs(interval - s.interval)
+		s.interval += statsSmoothing * (interval - s.interval)
+		s.stats.Jitter += time.Duration(statsSmoothing * (deviation*float64(time.Second) - float64(s.stats.Jitter)))
+		if s.interval > 0 {
+			s.stats.FPS = 1 / s.interval
+		}
+	}
+	if s.stats.Received == 0 {
+		s.stats.SinkLatency = sink
+	} else {
+		s.stats.SinkLatency += time.Duration(statsSmoothing * float64(sink-s.stats.SinkLatency))
+	}
+	s.stats.LastFrame = arrived
+	s.stats.Received++
+}
+
+func (s *streamStats) dropped() {
+	s.lock.Lock()
+	s.stats.Dropped++
+	s.lock.Unlock()
+}
+
+func (s *streamStats) failed() {
+	s.lock.Lock()
+	s.stats.Errors++
+	s.lock.Unlock()
+}
+
+func (s *streamStats) snapshot() StreamStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+func (s *loopStats) iteration(rc int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Iterations++
+	if rc < 0 {
+		s.stats.Errors++
+		s.stats.LastError = rc
+	}
+}
+
+// Returns the statistics of the stream.
+func (s *stream) Stats() StreamStats {
+	return s.stats.snapshot()
+}
+
+// Returns the statistics of the event processing loop.
+func (freenect *Freenect) Stats() LoopStats {
+	return freenect.loop.snapshot()
+}
+
+func (s *loopStats) snapshot() LoopStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// Returns an HTTP handler serving the loop and stream statistics of every device with a camera in the Prometheus text format.
+func (freenect *Freenect) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		freenect.writeMetrics(w)
+	})
+}
+
+type streamMetrics struct {
+	labels	string
+	stats		StreamStats
+}
+
+func (freenect *Freenect) writeMetrics(w io.Writer) {
+	streams := []streamMetrics{}
+	for _, device := range freenect.attached() {
+		if camera := device.videoCamera(); camera != nil {
+			streams = append(streams, streamMetrics{metricLabels(device, "video"), camera.Stats()})
+		}
+		if camera := device.depthCamera(); camera != nil {
+			streams = append(streams, streamMetrics{metricLabels(device, "depth"), camera.Stats()})
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].labels < streams[j].labels })
+
+	loop := freenect.Stats()
+	fmt.Fprintf(w, "# HELP freenect_loop_iterations_total Event processing loop iterations.\n")
+	fmt.Fprintf(w, "# TYPE freenect_loop_iterations_total counter\n")
+	fmt.Fprintf(w, "freenect_loop_iterations_total %d\n", loop.Iterations)
+	fmt.Fprintf(w, "# HELP freenect_loop_errors_total Event processing loop errors.\n")
+	fmt.Fprintf(w, "# TYPE freenect_loop_errors_total counter\n")
+	fmt.Fprintf(w, "freenect_loop_errors_total %d\n", loop.Errors)
+
+	metric := func(name, kind, help string, value func(StreamStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		for _, s := range streams {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, s.labels, value(s.stats))
+		}
+	}
+	metric("freenect_frames_received_total", "counter", "Frames delivered to the sink.",
+		func(s StreamStats) float64 { return float64(s.Received) })
+	metric("freenect_frames_dropped_total", "counter", "Frames overwritten or not delivered because the source had no new buffer.",
+		func(s StreamStats) float64 { return float64(s.Dropped) })
+	metric("freenect_stream_errors_total", "counter", "Errors raised while handling frames.",
+		func(s StreamStats) float64 { return float64(s.Errors) })
+	metric("freenect_stream_fps", "gauge", "Effective frame rate.",
+		func(s StreamStats) float64 { return s.FPS })
+	metric("freenect_stream_jitter_seconds", "gauge", "Mean deviation of the inter-frame interval.",
+		func(s StreamStats) float64 { return s.Jitter.Seconds() })
+	metric("freenect_sink_latency_seconds", "gauge", "Mean time spent in the sink per frame.",
+		func(s StreamStats) float64 { return s.SinkLatency.Seconds() })
+}
+
+// Escapes a label value as the Prometheus text format requires: only backslash, double quote and newline.
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func metricLabels(device *Device, stream string) string {
+	return fmt.Sprintf("device=\"%d\",serial=\"%s\",stream=\"%s\"", device.index, labelEscaper.Replace(device.serial), labelEscaper.Replace(stream))
+}
@@ -0,0 +1,235 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vision
+
+import (
+	"math"
+	"sync"
+
+	"freenect"
+)
+
+// The default settings of a background model.
+const (
+	DefaultLearnFrames	= 30
+	DefaultTolerance		= 0.05
+	DefaultDeviations		= 3.0
+	DefaultAdapt				= 0.01
+	DefaultSettle				= 90
+)
+
+// A depth based model of the static scene. It learns the depth of each pixel over the first Frames frames and from
+// then on marks as foreground every pixel whose depth differs from the background by more than Tolerance meters, or
+// by Deviations times the spread seen while learning if that is larger, so noisy far pixels need a bigger change.
+// Pixels that had no reading while learning, such as the shadows beside objects or a wall out of range, count as
+// foreground until their reading holds within Tolerance for Settle frames, when it becomes their background; someone
+// walking into them is seen until they have stood still that long. The background lies behind whatever else is seen,
+// so for these pixels a farther reading later replaces it.
+//
+// The background keeps up with slow changes, such as light drift or a door left open: each background pixel moves
+// towards its reading by Adapt per frame, and each foreground pixel by Absorb, so with Absorb set an object that stays
+// put eventually becomes part of the scene.
+//
+// The model sizes itself on the first frame and starts learning again when the frame size or format changes. All
+// methods are safe for concurrent use.
+type Background struct {
+	Frames			int
+	Tolerance		float64
+	Deviations	float64
+	Adapt				float64
+	Absorb			float64
+	Settle			int
+
+	lock				sync.Mutex
+	width				int
+	height			int
+	format			freenect.DepthFormat
+	learned			int
+	sum					[]float64
+	sumSq				[]float64
+	count				[]int
+	model				[]float64
+	spread			[]float64
+	unseen			[]bool
+	pending			[]float64
+	steady			[]int
+}
+
+// Creates a background model learning over the given number of frames, with the default settings otherwise.
+func NewBackground(frames int) *Background {
+	return &Background{
+		Frames:			frames,
+		Tolerance:	DefaultTolerance,
+		Deviations:	DefaultDeviations,
+		Adapt:			DefaultAdapt,
+		Settle:			DefaultSettle,
+	}
+}
+
+// Forgets the background and starts learning again.
+func (b *Background) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.width = 0
+}
+
+// Reports whether the model is still learning the background.
+func (b *Background) Learning() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.learning()
+}
+
+func (b *Background) learning() bool {
+	frames := b.Frames
+	if frames < 1 {
+		frames = DefaultLearnFrames
+	}
+	return b.width == 0 || b.learned < frames
+}
+
+// Returns the learned depth of each pixel in meters, NaN where the background is unknown, or nil while learning.
+func (b *Background) Model() []float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.learning() {
+		return nil
+	}
+	return append([]float64(nil), b.model...)
+}
+
+// Feeds a depth image to the model. While learning it returns nil; afterwards, the foreground mask of the image.
+// Packed formats are not supported and yield nil.
+func (b *Background) Update(depth []uint16, width, height int, format freenect.DepthFormat) *Mask {
+	convert := freenect.MetersConverter(format)
+	if convert == nil || len(depth) < width*height {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if width != b.width || height != b.height || format != b.format {
+		b.restart(width, height, format)
+	}
+	if b.learning() {
+		b.learn(depth, convert)
+		return nil
+	}
+	return b.subtract(depth, convert)
+}
+
+// Feeds a depth frame, such as one received from a camera subscription, to the model. See Update.
+func (b *Background) UpdateFrame(frame *freenect.Frame) *Mask {
+	if frame.Stream != "depth" {
+		return nil
+	}
+	return b.Update(frame.Depth, frame.Width, frame.Height, frame.DepthFormat())
+}
+
+// Wraps a handler of foreground masks as a depth sink, for feeding the model straight from a DepthCamera. The handler
+// is not called while the model is learning. The size and format must be those the camera was created with.
+func (b *Background) Sink(next func(mask *Mask, depth []uint16, stamp int32), width, height int, format freenect.DepthFormat) freenect.DepthSink {
+	return func(buffer []uint16, stamp int32) {
+		if mask := b.Update(buffer, width, height, format); mask != nil && next != nil {
+			next(mask, buffer, stamp)
+		}
+	}
+}
+
+func (b *Background) restart(width, height int, format freenect.DepthFormat) {
+	size := width * height
+	b.width, b.height, b.format = width, height, format
+	b.learned = 0
+	b.sum = make([]float64, size)
+	b.sumSq = make([]float64, size)
+	b.count = make([]int, size)
+	b.model = make([]float64, size)
+	b.spread = make([]float64, size)
+	b.unseen = make([]bool, size)
+	b.pending = make([]float64, size)
+	b.steady = make([]int, size)
+}
+
+func (b *Background) learn(depth []uint16, convert func(uint16) float64) {
+	for i := range b.sum {
+		if z := convert(depth[i]); !math.IsNaN(z) {
+			b.sum[i] += z
+			b.sumSq[i] += z * z
+			b.count[i]++
+		}
+	}
+	b.learned++
+	if b.learning() {
+		return
+	}
+
+	// done: settle the mean and spread of every pixel
+	for i, n := range b.count {
+		b.unseen[i] = n == 0
+		if n == 0 {
+			b.model[i], b.spread[i] = math.NaN(), 0
+			continue
+		}
+		mean := b.sum[i] / float64(n)
+		b.model[i] = mean
+		b.spread[i] = math.Sqrt(math.Max(0, b.sumSq[i]/float64(n)-mean*mean))
+	}
+	b.sum, b.sumSq, b.count = nil, nil, nil
+}
+
+func (b *Background) subtract(depth []uint16, convert func(uint16) float64) *Mask {
+	settle := b.Settle
+	if settle < 1 {
+		settle = DefaultSettle
+	}
+
+	mask := NewMask(b.width, b.height)
+	for i, model := range b.model {
+		z := convert(depth[i])
+		if math.IsNaN(z) {
+			continue
+		}
+		if math.IsNaN(model) {
+			// no background yet: the reading is foreground until it has held still long enough to be the scene
+			if math.Abs(z-b.pending[i]) <= b.Tolerance {
+				b.steady[i]++
+			} else {
+				b.pending[i], b.steady[i] = z, 1
+			}
+			if b.steady[i] >= settle {
+				b.model[i] = b.pending[i]
+			} else {
+				mask.Pix[i] = true
+			}
+			continue
+		}
+
+		tolerance := math.Max(b.Tolerance, b.Deviations*b.spread[i])
+		if b.unseen[i] && z-model > tolerance {
+			b.model[i] = z
+			continue
+		}
+		rate := b.Adapt
+		if math.Abs(z-model) > tolerance {
+			mask.Pix[i] = true
+			rate = b.Absorb
+		}
+		b.model[i] += rate * (z - model)
+	}
+	return mask
+}
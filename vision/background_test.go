@@ -0,0 +1,188 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vision_test
+
+import (
+	"testing"
+	"time"
+
+	"freenect"
+	"freenect/vision"
+)
+
+// A 4x1 scene: a wall at 2m, a noisy pixel, a pixel beyond range and a wall at 3m.
+func scene(noise uint16) []uint16 {
+	return []uint16{2000, 1900 + noise, 0, 3000}
+}
+
+func TestBackground(t *testing.T) {
+	b := vision.NewBackground(4)
+	for i := 0; i < 4; i++ {
+		if !b.Learning() {
+			t.Fatalf("frame %d: expected the model to be learning", i)
+		}
+		if mask := b.Update(scene(uint16(i%2)*100), 4, 1, freenect.MM); mask != nil {
+			t.Fatalf("frame %d: expected no mask while learning", i)
+		}
+	}
+	if b.Learning() {
+		t.Fatal("expected the model to have learned")
+	}
+	if model := b.Model(); model[0] != 2 || model[1] != 1.95 {
+		t.Errorf("expected the mean depths, got %v", model)
+	}
+
+	// the unchanged scene is background, noise included
+	if mask := b.Update(scene(100), 4, 1, freenect.MM); mask.Count() != 0 {
+		t.Errorf("expected no foreground, got %v", mask.Pix)
+	}
+
+	// a person steps in front of the first wall, something appears where there was nothing, the second wall is gone
+	mask := b.Update([]uint16{1200, 1950, 800, 0}, 4, 1, freenect.MM)
+	expected := []bool{true, false, true, false}
+	for i := range expected {
+		if mask.Pix[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, mask.Pix)
+			break
+		}
+	}
+
+	if model := b.Model(); model[0] != 2 {
+		t.Errorf("expected the person not to leak into the background, got %f", model[0])
+	}
+
+	// a change within the tolerance is background and adapted to
+	b.Update([]uint16{2040, 1950, 0, 3000}, 4, 1, freenect.MM)
+	if model := b.Model(); model[0] <= 2 || model[0] >= 2.04 {
+		t.Errorf("expected the background to drift towards 2.04m, got %f", model[0])
+	}
+
+	// resizing starts over
+	if b.Update(make([]uint16, 8), 8, 1, freenect.MM) != nil || !b.Learning() {
+		t.Error("expected a new frame size to restart learning")
+	}
+}
+
+func TestUnseenPixels(t *testing.T) {
+	// the pixel has no reading while learning, like the shadow beside an object
+	b := vision.NewBackground(2)
+	b.Settle = 3
+	b.Update([]uint16{0}, 1, 1, freenect.MM)
+	b.Update([]uint16{0}, 1, 1, freenect.MM)
+
+	// a reading is foreground until it has held still for three frames, missing frames aside, then the background
+	for i, expected := range []int{1, 1, 0, 0} {
+		if n := b.Update([]uint16{1500}, 1, 1, freenect.MM).Count(); n != expected {
+			t.Errorf("frame %d: expected %d foreground pixels, got %d", i, expected, n)
+		}
+		b.Update([]uint16{0}, 1, 1, freenect.MM)
+	}
+
+	// a farther reading shows what really lies behind, and the nearer one is foreground from then on
+	if n := b.Update([]uint16{3000}, 1, 1, freenect.MM).Count(); n != 0 {
+		t.Errorf("expected the wall behind to be background")
+	}
+	if model := b.Model(); model[0] != 3 {
+		t.Errorf("expected the wall to replace the background, got %v", model)
+	}
+	if n := b.Update([]uint16{1500}, 1, 1, freenect.MM).Count(); n != 1 {
+		t.Errorf("expected the nearer reading to be foreground")
+	}
+}
+
+// Someone walking into a part of the room out of range while learning stays foreground.
+func TestUnseenRegion(t *testing.T) {
+	// a wall at 2m on the left, out of range on the right
+	scene := []uint16{2000, 2000, 0, 0}
+	b := vision.NewBackground(3)
+	for i := 0; i < 3; i++ {
+		b.Update(scene, 4, 1, freenect.MM)
+	}
+
+	// a person walks in on the right, moving about a little
+	for i := 0; i < 20; i++ {
+		z := uint16(1500 + 10*(i%2))
+		if mask := b.Update([]uint16{2000, 2000, z, z}, 4, 1, freenect.MM); mask.Count() != 2 || !mask.Pix[2] || !mask.Pix[3] {
+			t.Fatalf("frame %d: expected the person in the foreground, got %v", i, mask.Pix)
+		}
+	}
+
+	// and leaves
+	if n := b.Update(scene, 4, 1, freenect.MM).Count(); n != 0 {
+		t.Errorf("expected nothing in the foreground, got %d pixels", n)
+	}
+}
+
+func TestAbsorb(t *testing.T) {
+	b := vision.NewBackground(1)
+	b.Absorb = 0.5
+	b.Update([]uint16{2000}, 1, 1, freenect.MM)
+
+	// a chair put down becomes part of the scene
+	foreground := 0
+	for i := 0; i < 10; i++ {
+		foreground += b.Update([]uint16{1500}, 1, 1, freenect.MM).Count()
+	}
+	if foreground == 0 || foreground == 10 {
+		t.Errorf("expected the chair to be foreground for a while, got %d frames", foreground)
+	}
+}
+
+// Feeds the model from a simulated depth camera, whose ball swings in front of a wall.
+func TestBackgroundSink(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+
+	dev := lib.Devices[0]
+	if rc = dev.Open(); rc != 0 {
+		t.Fatalf("Open failed: %d", rc)
+	}
+	defer dev.Close()
+
+	b := vision.NewBackground(3)
+	masks := make(chan *vision.Mask, 1)
+	sink := b.Sink(func(mask *vision.Mask, depth []uint16, stamp int32) {
+		select {
+		case masks <- mask:
+		default:
+		}
+	}, 640, 480, freenect.MM)
+
+	depth, rc := dev.DepthCamera(freenect.MEDIUM, freenect.MM, func(bytes int) []uint16 { return make([]uint16, bytes/2) }, sink)
+	if rc != 0 {
+		t.Fatalf("DepthCamera failed: %d", rc)
+	}
+	if rc = depth.Start(); rc != 0 {
+		t.Fatalf("Start failed: %d", rc)
+	}
+	defer depth.Stop()
+
+	select {
+	case mask := <-masks:
+		if mask.Width != 640 || mask.Height != 480 || mask.At(0, 0) {
+			t.Errorf("expected the wall to be background")
+		}
+		if img := mask.Image(); img.Bounds().Dx() != 640 {
+			t.Errorf("expected a full size image")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mask arrived")
+	}
+}
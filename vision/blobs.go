@@ -0,0 +1,164 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vision
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"freenect"
+)
+
+// A connected region of a mask. X and Y are its centroid in pixels and Bounds encloses it. Where depth was given,
+// Position is the mean of its points in the camera frame and Size the extent of the bounds at that depth, with Z the
+// distance from its nearest point to its farthest, in meters; without depth both hold NaN.
+type Blob struct {
+	Pixels		int
+	X, Y			float64
+	Bounds		image.Rectangle
+	Position	freenect.Vector
+	Size			freenect.Vector
+}
+
+// The default settings of a blob detector.
+const (
+	DefaultMinPixels	= 200
+	DefaultMaxStep		= 0.1
+)
+
+// Finds the blobs of a foreground mask. Neighboring pixels belong to the same blob unless, where depth is known, their
+// depths differ by more than MaxStep meters, which separates people standing one behind the other. Blobs smaller than
+// MinPixels are ignored. Intrinsics project the pixels into 3D; they are scaled to the width of the mask.
+type Detector struct {
+	MinPixels		int
+	MaxStep			float64
+	Intrinsics	freenect.Intrinsics
+}
+
+// Creates a detector with the default settings and the Kinect's typical intrinsics.
+func NewDetector() *Detector {
+	return &Detector{MinPixels: DefaultMinPixels, MaxStep: DefaultMaxStep, Intrinsics: freenect.DefaultIntrinsics}
+}
+
+// Returns the blobs of the mask, largest first. The depth image, if not nil, is the one the mask was made from.
+// A mask holding fewer pixels than its size calls for has none.
+func (d *Detector) Find(mask *Mask, depth []uint16, format freenect.DepthFormat) []Blob {
+	width, height := mask.Width, mask.Height
+	if width <= 0 || height <= 0 || len(mask.Pix) < width*height {
+		return nil
+	}
+	z := make([]float64, width*height)
+	convert := freenect.MetersConverter(format)
+	for i := range z {
+		z[i] = math.NaN()
+		if depth != nil && convert != nil && i < len(depth) {
+			z[i] = convert(depth[i])
+		}
+	}
+
+	scale := float64(width) / 640
+	intr := freenect.Intrinsics{Fx: d.Intrinsics.Fx * scale, Fy: d.Intrinsics.Fy * scale, Cx: d.Intrinsics.Cx * scale, Cy: d.Intrinsics.Cy * scale}
+
+	var blobs []Blob
+	seen := make([]bool, width*height)
+	stack := make([]int, 0, 64)
+	for seed, set := range mask.Pix[:width*height] {
+		if !set || seen[seed] {
+			continue
+		}
+
+		var sx, sy, px, py, pz float64
+		near, far := math.Inf(1), math.Inf(-1)
+		pixels, points := 0, 0
+		bounds := image.Rect(seed%width, seed/width, seed%width+1, seed/width+1)
+		seen[seed] = true
+		stack = append(stack[:0], seed)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%width, i/width
+
+			pixels++
+			sx += float64(x)
+			sy += float64(y)
+			bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+			if !math.IsNaN(z[i]) {
+				px += (float64(x) - intr.Cx) * z[i] / intr.Fx
+				py += -(float64(y) - intr.Cy) * z[i] / intr.Fy
+				pz += z[i]
+				near, far = math.Min(near, z[i]), math.Max(far, z[i])
+				points++
+			}
+
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= width || n[1] < 0 || n[1] >= height {
+					continue
+				}
+				j := n[1]*width + n[0]
+				if seen[j] || !mask.Pix[j] {
+					continue
+				}
+				if d.MaxStep > 0 && math.Abs(z[j]-z[i]) > d.MaxStep {
+					continue
+				}
+				seen[j] = true
+				stack = append(stack, j)
+			}
+		}
+
+		if pixels < d.MinPixels {
+			continue
+		}
+		blob := Blob{
+			Pixels:		pixels,
+			X:				sx / float64(pixels),
+			Y:				sy / float64(pixels),
+			Bounds:		bounds,
+			Position:	freenect.Vector{X: math.NaN(), Y: math.NaN(), Z: math.NaN()},
+			Size:			freenect.Vector{X: math.NaN(), Y: math.NaN(), Z: math.NaN()},
+		}
+		if points > 0 {
+			n := float64(points)
+			blob.Position = freenect.Vector{X: px / n, Y: py / n, Z: pz / n}
+			blob.Size = freenect.Vector{
+				X:	float64(bounds.Dx()) * blob.Position.Z / intr.Fx,
+				Y:	float64(bounds.Dy()) * blob.Position.Z / intr.Fy,
+				Z:	far - near,
+			}
+		}
+		blobs = append(blobs, blob)
+	}
+
+	sort.SliceStable(blobs, func(i, j int) bool { return blobs[i].Pixels > blobs[j].Pixels })
+	return blobs
+}
+
+// The extent of a standing or walking person, in meters.
+const (
+	PersonMinHeight		= 1.0
+	PersonMaxHeight		= 2.2
+	PersonMinWidth		= 0.25
+	PersonMaxWidth		= 1.2
+)
+
+// Reports whether the blob is the size of a person. Blobs without depth never are. The test is a coarse one: a person
+// cut off by the edge of the image, or crouching, is missed.
+func (b Blob) Person() bool {
+	return b.Size.Y >= PersonMinHeight && b.Size.Y <= PersonMaxHeight &&
+		b.Size.X >= PersonMinWidth && b.Size.X <= PersonMaxWidth
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vision_test
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"freenect"
+	"freenect/vision"
+)
+
+// Paints a box of the given depth into a 640x480 mask and depth image.
+func box(mask *vision.Mask, depth []uint16, r image.Rectangle, mm uint16) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			mask.Pix[y*640+x] = true
+			depth[y*640+x] = mm
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	mask := vision.NewMask(640, 480)
+	depth := make([]uint16, 640*480)
+
+	// a person 3m away, about 0.5m by 1.7m, with someone nearer standing right beside them, and a speck of noise
+	person := image.Rect(290, 100, 390, 436)
+	box(mask, depth, person, 3000)
+	box(mask, depth, image.Rect(390, 200, 450, 300), 2000)
+	box(mask, depth, image.Rect(10, 10, 15, 15), 1000)
+
+	blobs := vision.NewDetector().Find(mask, depth, freenect.MM)
+	if len(blobs) != 2 {
+		t.Fatalf("expected two blobs, got %d", len(blobs))
+	}
+
+	b := blobs[0]
+	if b.Pixels != 100*336 || b.Bounds != person {
+		t.Errorf("expected the person's pixels and bounds, got %d in %v", b.Pixels, b.Bounds)
+	}
+	if b.X != 339.5 || b.Y != 267.5 {
+		t.Errorf("expected the centroid at the middle of the box, got %f,%f", b.X, b.Y)
+	}
+	if math.Abs(b.Position.Z-3) > 1e-9 || math.Abs(b.Position.X) > 0.01 {
+		t.Errorf("expected the person 3m straight ahead, got %+v", b.Position)
+	}
+	if b.Size.Z != 0 || blobs[1].Size.Z != 0 {
+		t.Errorf("expected flat boxes to have no depth extent, got %f and %f", b.Size.Z, blobs[1].Size.Z)
+	}
+	if !b.Person() || blobs[1].Person() {
+		t.Errorf("expected only the first blob to be person sized, got %+v and %+v", b.Size, blobs[1].Size)
+	}
+
+	// without depth the two boxes merge and have no position
+	blobs = vision.NewDetector().Find(mask, nil, freenect.MM)
+	if len(blobs) != 1 || blobs[0].Position.Valid() || blobs[0].Person() || !math.IsNaN(blobs[0].Size.Z) {
+		t.Errorf("expected one blob without position, got %d", len(blobs))
+	}
+
+	// a mask short of its size has no blobs
+	short := &vision.Mask{Width: 640, Height: 480, Pix: mask.Pix[:1000]}
+	if blobs = vision.NewDetector().Find(short, depth, freenect.MM); blobs != nil {
+		t.Errorf("expected no blobs in a short mask, got %d", len(blobs))
+	}
+}
+
+func blob(x, y, z float64) vision.Blob {
+	return vision.Blob{Pixels: 1000, X: x, Y: y, Position: freenect.Vector{X: x, Y: y, Z: z}}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := vision.NewTracker()
+	tracker.MaxMissed = 1
+
+	// two people walk towards each other
+	tracks := tracker.Update([]vision.Blob{blob(-1, 0, 3), blob(1, 0, 3)})
+	if len(tracks) != 2 || tracks[0].ID != 1 || tracks[1].ID != 2 {
+		t.Fatalf("expected tracks 1 and 2, got %+v", tracks)
+	}
+	tracks = tracker.Update([]vision.Blob{blob(0.8, 0, 3), blob(-0.8, 0, 3)})
+	if len(tracks) != 2 || tracks[0].Blob.Position.X != -0.8 || tracks[1].Blob.Position.X != 0.8 || tracks[0].Age != 2 {
+		t.Fatalf("expected the tracks to follow, got %+v", tracks)
+	}
+
+	// one is hidden for a frame, then reappears; a third arrives far away
+	tracks = tracker.Update([]vision.Blob{blob(-0.6, 0, 3)})
+	if len(tracks) != 1 || tracks[0].ID != 1 {
+		t.Fatalf("expected only track 1 seen, got %+v", tracks)
+	}
+	if all := tracker.Tracks(); len(all) != 2 || all[1].Missed != 1 {
+		t.Errorf("expected track 2 to be missed but alive, got %+v", all)
+	}
+	tracks = tracker.Update([]vision.Blob{blob(-0.4, 0, 3), blob(0.5, 0, 3), blob(0, 0, 6)})
+	if len(tracks) != 3 || tracks[1].ID != 2 || tracks[2].ID != 3 {
+		t.Fatalf("expected tracks 1, 2 and a new 3, got %+v", tracks)
+	}
+
+	// everyone leaves
+	tracker.Update(nil)
+	tracker.Update(nil)
+	if len(tracker.Tracks()) != 0 || tracker.Count() != 3 {
+		t.Errorf("expected no tracks left of the 3 seen, got %d of %d", len(tracker.Tracks()), tracker.Count())
+	}
+}
+
+// Blobs seen without depth, as beyond range, are followed by their centroids in pixels.
+func TestTrackerPixels(t *testing.T) {
+	flat := func(x, y float64) vision.Blob {
+		nan := math.NaN()
+		return vision.Blob{Pixels: 1000, X: x, Y: y, Position: freenect.Vector{X: nan, Y: nan, Z: nan}}
+	}
+
+	tracker := vision.NewTracker()
+	tracker.Update([]vision.Blob{flat(100, 200), flat(400, 200)})
+	tracks := tracker.Update([]vision.Blob{flat(420, 205), flat(130, 190)})
+	if len(tracks) != 2 || tracks[0].Blob.X != 130 || tracks[1].Blob.X != 420 || tracker.Count() != 2 {
+		t.Fatalf("expected both tracks to follow by pixels, got %+v", tracks)
+	}
+
+	// a blob gaining depth is still matched by pixels, and one that jumps too far starts a new track
+	tracks = tracker.Update([]vision.Blob{blob(140, 190, 3), flat(600, 200)})
+	if len(tracks) != 2 || tracks[0].ID != 1 || tracks[1].ID != 3 {
+		t.Errorf("expected track 1 to follow and a new track 3, got %+v", tracks)
+	}
+}
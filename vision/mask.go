@@ -0,0 +1,65 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package vision finds what is happening in front of the sensor: which pixels differ from the static scene and, from
+// those, the objects moving through it.
+package vision
+
+import (
+	"image"
+)
+
+// A binary image marking the pixels of interest, one entry per pixel in row order.
+type Mask struct {
+	Width		int
+	Height	int
+	Pix			[]bool
+}
+
+// Creates an empty mask of the given size.
+func NewMask(width, height int) *Mask {
+	return &Mask{width, height, make([]bool, width*height)}
+}
+
+// Reports whether the pixel is set. Pixels outside the mask are not.
+func (m *Mask) At(x, y int) bool {
+	if x < 0 || x >= m.Width || y < 0 || y >= m.Height {
+		return false
+	}
+	return m.Pix[y*m.Width+x]
+}
+
+// Returns the number of pixels set.
+func (m *Mask) Count() int {
+	n := 0
+	for _, set := range m.Pix {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the mask as a grayscale image, white where set, for display or saving.
+func (m *Mask) Image() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, m.Width, m.Height))
+	for i, set := range m.Pix {
+		if set {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vision
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// A blob followed across frames. ID stays the same for as long as the track lives. Age counts the frames since it
+// was first seen and Missed the frames in a row it has not been, in which case Blob is its last sighting.
+type Track struct {
+	ID			int
+	Blob		Blob
+	Age			int
+	Missed	int
+}
+
+// The default settings of a tracker.
+const (
+	DefaultMaxDistance	= 0.5
+	DefaultMaxPixels		= 100.0
+	DefaultMaxMissed		= 5
+)
+
+// Follows blobs from frame to frame, giving each a persistent ID. Every frame the closest pairs of track and blob are
+// matched first; a blob matches no track farther than MaxDistance meters, or, unless both have a position, than
+// MaxPixels between their centroids. Closeness is measured against these limits, so the two kinds of pair rank
+// together. A blob left unmatched starts a new track; a track unmatched for more than MaxMissed frames ends. All
+// methods are safe for concurrent use.
+type Tracker struct {
+	MaxDistance	float64
+	MaxPixels		float64
+	MaxMissed		int
+
+	lock				sync.Mutex
+	tracks			[]*Track
+	next				int
+}
+
+// Creates a tracker with the default settings.
+func NewTracker() *Tracker {
+	return &Tracker{MaxDistance: DefaultMaxDistance, MaxPixels: DefaultMaxPixels, MaxMissed: DefaultMaxMissed}
+}
+
+// Matches the blobs of a new frame to the tracks and returns the tracks seen in it.
+func (t *Tracker) Update(blobs []Blob) []Track {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	type pair struct {
+		track, blob	int
+		distance		float64
+	}
+	var pairs []pair
+	for i, track := range t.tracks {
+		for j := range blobs {
+			if d := t.distance(track.Blob, blobs[j]); d <= 1 {
+				pairs = append(pairs, pair{i, j, d})
+			}
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool { return pairs[a].distance < pairs[b].distance })
+
+	matched := make([]bool, len(t.tracks))
+	claimed := make([]bool, len(blobs))
+	for _, p := range pairs {
+		if matched[p.track] || claimed[p.blob] {
+			continue
+		}
+		matched[p.track], claimed[p.blob] = true, true
+		track := t.tracks[p.track]
+		track.Blob = blobs[p.blob]
+		track.Missed = 0
+	}
+
+	// age the tracks, ending the ones lost for too long
+	live := t.tracks[:0]
+	for i, track := range t.tracks {
+		track.Age++
+		if !matched[i] {
+			track.Missed++
+			if track.Missed > t.MaxMissed {
+				continue
+			}
+		}
+		live = append(live, track)
+	}
+	t.tracks = live
+
+	for j, blob := range blobs {
+		if !claimed[j] {
+			t.next++
+			t.tracks = append(t.tracks, &Track{ID: t.next, Blob: blob, Age: 1})
+		}
+	}
+
+	var seen []Track
+	for _, track := range t.tracks {
+		if track.Missed == 0 {
+			seen = append(seen, *track)
+		}
+	}
+	return seen
+}
+
+// Returns every live track, including those missed in the latest frames.
+func (t *Tracker) Tracks() []Track {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tracks := make([]Track, len(t.tracks))
+	for i, track := range t.tracks {
+		tracks[i] = *track
+	}
+	return tracks
+}
+
+// Returns the number of tracks started so far, such as the number of people who have walked by.
+func (t *Tracker) Count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.next
+}
+
+// The distance between two blobs as a fraction of its limit: between their positions over MaxDistance if both have
+// one, else between their centroids over MaxPixels.
+func (t *Tracker) distance(a, b Blob) float64 {
+	if a.Position.Valid() && b.Position.Valid() {
+		return a.Position.Sub(b.Position).Norm() / t.MaxDistance
+	}
+	return math.Hypot(a.X-b.X, a.Y-b.Y) / t.MaxPixels
+}
@@ -0,0 +1,322 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Just enough of RFC 6455 to move binary messages: no extensions, no subprotocols.
+
+const (
+	opContinuation	= 0x0
+	opText					= 0x1
+	opBinary				= 0x2
+	opClose					= 0x8
+	opPing					= 0x9
+	opPong					= 0xa
+)
+
+// Status codes sent in close frames.
+const (
+	closeNormal			= 1000
+	closeProtocol		= 1002
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The largest message accepted; a raw high resolution video frame is a little under 4MB.
+const maxMessage = 16 << 20
+
+var (
+	ErrHandshake		= errors.New("websocket: bad handshake")
+	ErrProtocol			= errors.New("websocket: protocol error")
+	ErrTooLarge			= errors.New("websocket: message too large")
+)
+
+type conn struct {
+	net			net.Conn
+	reader	*bufio.Reader
+	lock		sync.Mutex
+	client	bool
+	closed	bool
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Completes the opening handshake of a server connection and takes the connection over from the HTTP server.
+func upgrade(w http.ResponseWriter, r *http.Request) (*conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrHandshake
+	}
+	c, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err = c.Write([]byte(response)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &conn{net: c, reader: rw.Reader}, nil
+}
+
+// Opens a client connection to a ws:// URL.
+func dial(url string) (*conn, error) {
+	if !strings.HasPrefix(url, "ws://") {
+		return nil, ErrHandshake
+	}
+	rest := strings.TrimPrefix(url, "ws://")
+	host, path := rest, "/"
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":80"
+	}
+
+	c, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err = c.Write([]byte(request)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(c)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		c.Close()
+		return nil, ErrHandshake
+	}
+	return &conn{net: c, reader: reader, client: true}, nil
+}
+
+// Writes a single unfragmented frame. Frames from the client are masked, as the protocol requires.
+func (c *conn) write(opcode byte, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	if c.client {
+		header[1] |= 0x80
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		header = append(header, mask...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ mask[i%4]
+		}
+		payload = masked
+	}
+
+	if _, err := c.net.Write(header); err != nil {
+		return err
+	}
+	_, err := c.net.Write(payload)
+	return err
+}
+
+// Reads the next data message, answering pings on the way. Returns io.EOF once the peer has closed the connection.
+// A peer breaking the protocol fails the connection: it is closed with a protocol error and ErrProtocol returned.
+func (c *conn) read() (opcode byte, message []byte, err error) {
+	defer func() {
+		if err == ErrProtocol {
+			c.closeWith(closeProtocol)
+		}
+	}()
+
+	for {
+		fin, op, payload, err := c.frame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opClose:
+			c.write(opClose, nil)
+			return 0, nil, io.EOF
+		case opPing:
+			if err = c.write(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opContinuation:
+			if message == nil {
+				return 0, nil, ErrProtocol
+			}
+		default:
+			if message != nil {
+				return 0, nil, ErrProtocol
+			}
+			opcode = op
+		}
+
+		if len(message)+len(payload) > maxMessage {
+			return 0, nil, ErrTooLarge
+		}
+		message = append(message, payload...)
+		if message == nil {
+			message = []byte{}
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *conn) frame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	// only clients mask their frames, and control frames are neither fragmented nor longer than 125 bytes
+	if masked == c.client || (op&0x8 != 0 && (!fin || n > 125)) {
+		return false, 0, nil, ErrProtocol
+	}
+	if n > maxMessage {
+		return false, 0, nil, ErrTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// Sends a close frame, if the connection is still open, and closes the connection.
+func (c *conn) close() error {
+	return c.closeWith(closeNormal)
+}
+
+// Closes the connection as close does, with the given status code.
+func (c *conn) closeWith(code uint16) error {
+	c.write(opClose, binary.BigEndian.AppendUint16(nil, code))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.net.Close()
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package websocket streams the exact frames of freenect cameras over WebSocket connections, and reads them back
+// into freenect.Frame values on the other side.
+//
+// Each frame travels as one binary message: a 20 byte header followed by the frame data, all little endian.
+//
+//	offset  size  field
+//	0       1     version, currently 1
+//	1       1     stream: 0 for video, 1 for depth
+//	2       2     the VideoFormat or DepthFormat
+//	4       2     width
+//	6       2     height
+//	8       4     timestamp
+//	12      8     sequence number
+//	20            the video bytes, or the depth values as 16 bit words
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+
+	"freenect"
+)
+
+const (
+	headerVersion		= 1
+	headerSize			= 20
+)
+
+const (
+	streamVideo			= 0
+	streamDepth			= 1
+)
+
+// Returned when a message is not a frame in the expected encoding.
+var ErrBadFrame = errors.New("websocket: malformed frame")
+
+// Encodes a frame as a binary message.
+func MarshalFrame(frame *freenect.Frame) []byte {
+	kind, payload := byte(streamVideo), len(frame.Video)
+	if frame.Stream == "depth" {
+		kind, payload = streamDepth, len(frame.Depth)*2
+	}
+
+	data := make([]byte, headerSize, headerSize+payload)
+	data[0], data[1] = headerVersion, kind
+	binary.LittleEndian.PutUint16(data[2:], uint16(frame.Format))
+	binary.LittleEndian.PutUint16(data[4:], uint16(frame.Width))
+	binary.LittleEndian.PutUint16(data[6:], uint16(frame.Height))
+	binary.LittleEndian.PutUint32(data[8:], frame.Timestamp)
+	binary.LittleEndian.PutUint64(data[12:], frame.Sequence)
+
+	if kind == streamDepth {
+		for _, v := range frame.Depth {
+			data = binary.LittleEndian.AppendUint16(data, v)
+		}
+	} else {
+		data = append(data, frame.Video...)
+	}
+	return data
+}
+
+// Decodes a binary message produced by MarshalFrame.
+func UnmarshalFrame(data []byte) (*freenect.Frame, error) {
+	if len(data) < headerSize || data[0] != headerVersion || data[1] > streamDepth {
+		return nil, ErrBadFrame
+	}
+
+	frame := &freenect.Frame{
+		Stream:			"video",
+		Format:			int32(binary.LittleEndian.Uint16(data[2:])),
+		Width:			int(binary.LittleEndian.Uint16(data[4:])),
+		Height:			int(binary.LittleEndian.Uint16(data[6:])),
+		Timestamp:	binary.LittleEndian.Uint32(data[8:]),
+		Sequence:		binary.LittleEndian.Uint64(data[12:]),
+	}
+
+	payload := data[headerSize:]
+	if data[1] == streamVideo {
+		frame.Video = append([]byte(nil), payload...)
+		return frame, nil
+	}
+
+	if len(payload)%2 != 0 {
+		return nil, ErrBadFrame
+	}
+	frame.Stream = "depth"
+	frame.Depth = make([]uint16, len(payload)/2)
+	for i := range frame.Depth {
+		frame.Depth[i] = binary.LittleEndian.Uint16(payload[i*2:])
+	}
+	return frame, nil
+}
+
+// An http.Handler that upgrades requests to WebSocket connections and streams camera frames to them. By default a
+// connection receives the frames of every attached camera; add ?stream=video or ?stream=depth to the URL for one.
+// Each connection keeps only the newest frame of each stream waiting, so a slow client skips frames instead of
+// holding up the cameras.
+type Server struct {
+	lock		sync.Mutex
+	video		*freenect.VideoCamera
+	depth		*freenect.DepthCamera
+	conns		map[*conn]bool
+}
+
+// Creates a server with no cameras attached.
+func NewServer() *Server {
+	return &Server{conns: map[*conn]bool{}}
+}
+
+// Streams the frames of a video camera to connections opened from now on.
+func (s *Server) Video(camera *freenect.VideoCamera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.video = camera
+}
+
+// Streams the frames of a depth camera to connections opened from now on.
+func (s *Server) Depth(camera *freenect.DepthCamera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.depth = camera
+}
+
+// Closes every open connection.
+func (s *Server) Close() {
+	s.lock.Lock()
+	conns := s.conns
+	s.conns = map[*conn]bool{}
+	s.lock.Unlock()
+
+	for c := range conns {
+		c.close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query().Get("stream")
+	if want != "" && want != "video" && want != "depth" {
+		http.Error(w, "unknown stream "+want, http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	video, depth := s.video, s.depth
+	s.lock.Unlock()
+	if want == "video" {
+		depth = nil
+	} else if want == "depth" {
+		video = nil
+	}
+	if video == nil && depth == nil {
+		http.Error(w, "no camera", http.StatusNotFound)
+		return
+	}
+
+	c, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conns[c] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		c.close()
+	}()
+
+	// nil channels never deliver, which leaves the stream that was not asked for out of the select
+	var videoFrames, depthFrames <-chan freenect.Frame
+	if video != nil {
+		videoFrames = video.Subscribe()
+		defer video.Unsubscribe(videoFrames)
+	}
+	if depth != nil {
+		depthFrames = depth.Subscribe()
+		defer depth.Unsubscribe(depthFrames)
+	}
+
+	// the client sends nothing but control frames; reading them notices when it goes away
+	gone := make(chan bool)
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := c.read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var frame freenect.Frame
+		select {
+		case <-gone:
+			return
+		case frame = <-videoFrames:
+		case frame = <-depthFrames:
+		}
+		if err := c.write(opBinary, MarshalFrame(&frame)); err != nil {
+			return
+		}
+	}
+}
+
+// A connection receiving frames from a Server.
+type Client struct {
+	conn	*conn
+}
+
+// Connects to a Server at a ws:// URL, such as "ws://host:8080/frames?stream=depth".
+func Dial(url string) (*Client, error) {
+	c, err := dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c}, nil
+}
+
+// Blocks until the next frame arrives. Returns io.EOF once the server has closed the connection.
+func (client *Client) Next() (*freenect.Frame, error) {
+	for {
+		op, data, err := client.conn.read()
+		if err != nil {
+			return nil, err
+		}
+		if op == opBinary {
+			return UnmarshalFrame(data)
+		}
+	}
+}
+
+// Closes the connection.
+func (client *Client) Close() error {
+	return client.conn.close()
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright 2011-2012 Garrick Evans
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"freenect"
+	"freenect/websocket"
+)
+
+func TestMarshalFrame(t *testing.T) {
+	frames := []*freenect.Frame{
+		{Stream: "depth", Format: int32(freenect.D11BIT), Width: 2, Height: 2, Timestamp: 7, Sequence: 1 << 40,
+			Depth: []uint16{0, 1, 2047, 65535}},
+		{Stream: "video", Format: int32(freenect.IR_8BIT), Width: 2, Height: 1, Timestamp: 9, Sequence: 3,
+			Video: []byte{1, 255}},
+	}
+	for _, frame := range frames {
+		got, err := websocket.UnmarshalFrame(websocket.MarshalFrame(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, frame) {
+			t.Errorf("expected %+v, got %+v", frame, got)
+		}
+	}
+
+	if _, err := websocket.UnmarshalFrame([]byte{1, 2, 3}); err != websocket.ErrBadFrame {
+		t.Errorf("expected ErrBadFrame, got %v", err)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+	dev := lib.Devices[0]
+	dev.Open()
+	defer dev.Close()
+
+	depth, _ := dev.DepthCamera(freenect.MEDIUM, freenect.MM,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) }, func(frame []uint16, stamp int32) {})
+	video, _ := dev.VideoCamera(freenect.MEDIUM, freenect.RGB,
+		func(bytes int) []byte { return make([]byte, bytes) }, func(frame []byte, stamp int32) {})
+
+	server := websocket.NewServer()
+	server.Video(video)
+	server.Depth(depth)
+	defer server.Close()
+	web := httptest.NewServer(server)
+	defer web.Close()
+
+	depth.Start()
+	defer depth.Stop()
+	video.Start()
+	defer video.Stop()
+
+	client, err := websocket.Dial(strings.Replace(web.URL, "http://", "ws://", 1) + "/?stream=depth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var sequence uint64
+	for x := 0; x < 3; x++ {
+		frame, err := client.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Stream != "depth" || frame.DepthFormat() != freenect.MM || frame.Width != 640 || frame.Height != 480 {
+			t.Fatalf("unexpected frame %s %d %dx%d", frame.Stream, frame.Format, frame.Width, frame.Height)
+		}
+		if len(frame.Depth) != 640*480 || frame.Depth[0] != 3000 {
+			t.Errorf("expected exact depth values")
+		}
+		if frame.Sequence <= sequence {
+			t.Errorf("sequence went from %d to %d", sequence, frame.Sequence)
+		}
+		sequence = frame.Sequence
+	}
+
+	if _, err = websocket.Dial(strings.Replace(web.URL, "http://", "ws://", 1) + "/?stream=ir"); err == nil {
+		t.Error("expected an unknown stream to be refused")
+	}
+}
+
+// Frames a client must not send: each fails the connection with a protocol error.
+func TestProtocolErrors(t *testing.T) {
+	lib, rc := freenect.Simulate(1)
+	if rc != 0 {
+		t.Fatalf("Simulate failed: %d", rc)
+	}
+	defer lib.Shutdown()
+	dev := lib.Devices[0]
+	dev.Open()
+	defer dev.Close()
+
+	// the camera is not started, so the server sends nothing but the close
+	depth, _ := dev.DepthCamera(freenect.MEDIUM, freenect.MM,
+		func(bytes int) []uint16 { return make([]uint16, bytes/2) }, func(frame []uint16, stamp int32) {})
+	server := websocket.NewServer()
+	server.Depth(depth)
+	defer server.Close()
+	web := httptest.NewServer(server)
+	defer web.Close()
+
+	mask := []byte{1, 2, 3, 4}
+	for name, frame := range map[string][]byte{
+		"unmasked":		{0x82, 0x01, 'x'},
+		"long ping":	append(append([]byte{0x89, 0x80 | 126, 0, 126}, mask...), make([]byte, 126)...),
+		"fragmented":	append([]byte{0x09, 0x80}, mask...),
+	} {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(web.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: handshake failed: %v", name, err)
+		}
+
+		conn.Write(frame)
+		reply := make([]byte, 4)
+		if _, err = io.ReadFull(reader, reply); err != nil || !bytes.Equal(reply, []byte{0x88, 0x02, 0x03, 0xea}) {
+			t.Errorf("%s: expected a close with a protocol error, got %x (%v)", name, reply, err)
+		}
+		conn.Close()
+	}
+}